@@ -32,6 +32,9 @@ type Transition interface {
 	Guard() string
 	Effect() []string
 	Events() []string
+	// TransitionKind returns how the transition is classified from its source and target:
+	// kind.Internal, kind.Self, kind.Local or kind.External.
+	TransitionKind() uint64
 }
 
 type Vertex interface {
@@ -51,24 +54,28 @@ type Event struct {
 	Name string    `json:"name"`
 	Id   muid.MUID `json:"id"`
 	Data any       `json:"data"`
+	// DedupeKey identifies logically identical events, e.g. redeliveries from an at-least-once source.
+	DedupeKey string `json:"dedupe_key,omitempty"`
 }
 
 func (e Event) WithData(data any) Event {
 	return Event{
-		Kind: e.Kind,
-		Name: e.Name,
-		Id:   e.Id,
-		Data: data,
+		Kind:      e.Kind,
+		Name:      e.Name,
+		Id:        e.Id,
+		Data:      data,
+		DedupeKey: e.DedupeKey,
 	}
 }
 
 // Deprecated: Events can't wait anymore, hsm processing waits for all events by default
 func (e Event) WithDone(done chan struct{}) Event {
 	return Event{
-		Kind: e.Kind,
-		Name: e.Name,
-		Id:   e.Id,
-		Data: e.Data,
+		Kind:      e.Kind,
+		Name:      e.Name,
+		Id:        e.Id,
+		Data:      e.Data,
+		DedupeKey: e.DedupeKey,
 	}
 }
 
@@ -1,10 +1,16 @@
 package hsm
 
 import (
+	"bufio"
+	"cmp"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"math/rand"
+	"os"
 	"path"
 	"reflect"
 	"runtime"
@@ -19,6 +25,7 @@ import (
 	"github.com/runpod/hsm/v2/elements"
 	"github.com/runpod/hsm/v2/kind"
 	"github.com/runpod/hsm/v2/muid"
+	"github.com/runpod/hsm/v2/pkg/plantuml"
 )
 
 var (
@@ -30,8 +37,62 @@ var (
 	ErrInvalidState     = errors.New("invalid state")
 	ErrMissingHSM       = errors.New("missing hsm in context")
 	ErrInvalidPattern   = errors.New("invalid pattern")
+	ErrMaxResidency     = errors.New("max residency exceeded")
+	ErrTxRejected       = errors.New("transaction rejected")
+	ErrDeadEnd          = errors.New("no choice branch enabled")
+	ErrCascadeLimit     = errors.New("cascade limit exceeded")
+	ErrNotProcessed     = errors.New("event not processed")
+	ErrNotRun           = errors.New("behavior not run by middleware")
 )
 
+// Kinds of the elements of a model, for classifying the members returned by Model.Members with
+// IsKind and KindName. Kinds form a hierarchy, e.g. a FinalStateKind element is also a StateKind
+// and a VertexKind element.
+var (
+	ElementKind      = kind.Element
+	NamespaceKind    = kind.Namespace
+	VertexKind       = kind.Vertex
+	ConstraintKind   = kind.Constraint
+	BehaviorKind     = kind.Behavior
+	ConcurrentKind   = kind.Concurrent
+	StateMachineKind = kind.StateMachine
+	StateKind        = kind.State
+	FinalStateKind   = kind.FinalState
+	PseudostateKind  = kind.Pseudostate
+	InitialKind      = kind.Initial
+	ChoiceKind       = kind.Choice
+	TransitionKind   = kind.Transition
+	InternalKind     = kind.Internal
+	ExternalKind     = kind.External
+	LocalKind        = kind.Local
+	SelfKind         = kind.Self
+	TimeEventKind    = kind.TimeEvent
+	CustomKind       = kind.Custom
+)
+
+// IsKind reports whether k is, or derives from, any of the given kinds.
+//
+// Example:
+//
+//	for name, member := range model.Members() {
+//	    if hsm.IsKind(member.Kind(), hsm.StateKind) {
+//	        fmt.Println(name)
+//	    }
+//	}
+func IsKind(k uint64, kinds ...uint64) bool {
+	return kind.IsKind(k, kinds...)
+}
+
+// KindName returns the name of a kind, e.g. "State" for StateKind or "Unknown" for kinds not
+// defined by this package.
+//
+// Example:
+//
+//	fmt.Printf("%s is a %s\n", member.QualifiedName(), hsm.KindName(member.Kind()))
+func KindName(k uint64) string {
+	return kind.Name(k)
+}
+
 // Package hsm provides a powerful hierarchical state machine (HSM) implementation for Go.
 // It enables modeling complex state-driven systems with features like hierarchical states,
 // entry/exit actions, guard conditions, and event-driven transitions.
@@ -111,19 +172,132 @@ type Element = elements.NamedElement
 // It contains the root state and maintains a namespace of all elements.
 type Model struct {
 	element
-	state    state
-	members  map[string]elements.NamedElement
-	elements []RedefinableElement
+	state      state
+	members    map[string]elements.NamedElement
+	elements   []RedefinableElement
+	definition []RedefinableElement
+	aliases    map[string]string // alias -> canonical event name
+	merging    bool              // the elements of a Merge overlay are being applied, see Merge
+	// children indexes the qualified names of the members by their parent's, so that the members
+	// nested in a state are found without scanning the whole model. Members are only ever added,
+	// so it is rebuilt whenever their number changed.
+	children struct {
+		index   map[string][]string
+		members int
+	}
 }
 
 func (model *Model) Members() map[string]elements.NamedElement {
 	return model.members
 }
 
+// descendants returns the qualified name of the member and of every member nested in it.
+func (model *Model) descendants(qualifiedName string) []string {
+	if model.children.index == nil || model.children.members != len(model.members) {
+		model.children.index = make(map[string][]string, len(model.members))
+		for member := range model.members {
+			if parent := path.Dir(member); parent != member {
+				model.children.index[parent] = append(model.children.index[parent], member)
+			}
+		}
+		model.children.members = len(model.members)
+	}
+	descendants := []string{qualifiedName}
+	for i := 0; i < len(descendants); i++ {
+		descendants = append(descendants, model.children.index[descendants[i]]...)
+	}
+	return descendants
+}
+
 func (model *Model) push(partial RedefinableElement) {
 	model.elements = append(model.elements, partial)
 }
 
+// TreeNode is a vertex in the state hierarchy of a model as returned by StateTree.
+// Pseudostates (initial and choice) and final states are included and can be told apart by Kind.
+type TreeNode struct {
+	QualifiedName string
+	Kind          uint64
+	Children      []*TreeNode
+	// Transitions are the qualified names of the transitions whose source is this vertex.
+	Transitions []string
+}
+
+// StateTree builds the state hierarchy of a model from the qualified names of its members.
+// The root node is the state machine itself ("/"), and children are ordered by qualified name.
+//
+// Example:
+//
+//	var walk func(node *hsm.TreeNode, depth int)
+//	walk = func(node *hsm.TreeNode, depth int) {
+//	    fmt.Println(strings.Repeat("  ", depth) + node.QualifiedName)
+//	    for _, child := range node.Children {
+//	        walk(child, depth+1)
+//	    }
+//	}
+//	walk(hsm.StateTree(&model), 0)
+func StateTree(model *Model) *TreeNode {
+	if model == nil {
+		return nil
+	}
+	nodes := map[string]*TreeNode{}
+	qualifiedNames := []string{}
+	for qualifiedName, member := range model.members {
+		vertex, ok := member.(elements.Vertex)
+		if !ok || !kind.IsKind(member.Kind(), kind.Vertex) {
+			continue
+		}
+		nodes[qualifiedName] = &TreeNode{
+			QualifiedName: qualifiedName,
+			Kind:          member.Kind(),
+			Children:      []*TreeNode{},
+			Transitions:   slices.Clone(vertex.Transitions()),
+		}
+		qualifiedNames = append(qualifiedNames, qualifiedName)
+	}
+	slices.Sort(qualifiedNames)
+	root := nodes["/"]
+	for _, qualifiedName := range qualifiedNames {
+		if qualifiedName == "/" {
+			continue
+		}
+		parent, ok := nodes[path.Dir(qualifiedName)]
+		if !ok {
+			parent = root
+		}
+		parent.Children = append(parent.Children, nodes[qualifiedName])
+	}
+	return root
+}
+
+// BehaviorNames lists the qualified names of a state's behaviors, in the order they run, as returned by StateBehaviors.
+type BehaviorNames struct {
+	Entry      []string
+	Exit       []string
+	Activities []string
+}
+
+// StateBehaviors returns the qualified names of the entry, exit and activity behaviors of the state
+// with the given qualified name, e.g. to document what each state does. It returns empty lists if
+// the model has no such state.
+//
+// Example:
+//
+//	behaviors := hsm.StateBehaviors(&model, "/connected")
+//	fmt.Printf("on entry: %v; activities: %v\n", behaviors.Entry, behaviors.Activities)
+func StateBehaviors(model *Model, qualifiedName string) BehaviorNames {
+	names := BehaviorNames{Entry: []string{}, Exit: []string{}, Activities: []string{}}
+	if model == nil {
+		return names
+	}
+	if state := get[*state](model, qualifiedName); state != nil {
+		names.Entry = append(names.Entry, state.entry...)
+		names.Exit = append(names.Exit, state.exit...)
+		names.Activities = append(names.Activities, state.activities...)
+	}
+	return names
+}
+
 // RedefinableElement is a function type that modifies a Model by adding or updating elements.
 // It's used to build the state machine structure in a declarative way.
 type RedefinableElement = func(model *Model, stack []elements.NamedElement) elements.NamedElement
@@ -148,6 +322,45 @@ type state struct {
 	exit       []string
 	activities []string
 	deferred   []string
+	ignored    []string
+	handles    []string
+	idle       []*idle
+	// activityFirst starts the activities before running the entry actions
+	activityFirst bool
+	// keepOnSelf keeps the activities running across transitions that exit and re-enter the state
+	keepOnSelf bool
+	// lazy delays the start of the activities, see LazyActivities; nil defers to Config.LazyActivities
+	lazy *time.Duration
+	// autoRestart restarts the state machine when the final state is entered, see AutoRestart
+	autoRestart *autoRestart
+	exitTo      []exitTo
+	// completion is the name of the completion event generated for the state, empty if no
+	// transition is triggered by it
+	completion string
+	// composite states complete on entering a final state rather than after their activities
+	composite bool
+}
+
+// exitTo is an exit behavior that only runs when the state is exited toward a matching target.
+type exitTo struct {
+	pattern  string
+	behavior string
+}
+
+// autoRestart is the initial event data and minimum interval between starts of an AutoRestart final.
+type autoRestart struct {
+	data     any
+	interval time.Duration
+}
+
+// idle is a timer started on entry to its state and reset whenever an event is processed.
+type idle struct {
+	element
+	duration time.Duration
+	// residency timers are not reset by events, see MaxResidency
+	residency bool
+	// err is dispatched with an ErrorEvent instead of the timer event when set
+	err error
 }
 
 func (state *state) Entry() []string {
@@ -171,18 +384,31 @@ type paths struct {
 
 type transition struct {
 	element
-	source string
-	target string
-	guard  string
-	effect []string
-	events []string
-	paths  map[string]paths
+	source  string
+	target  string
+	guard   string
+	preExit []string
+	effect  []string
+	events  []string
+	paths   map[string]paths
+	count   int
+	tags    []string
+	// segmented holds the events that are matched segment by segment, see OnSegments
+	segmented map[string]bool
 }
 
 func (transition *transition) Guard() string {
 	return transition.guard
 }
 
+func (transition *transition) TransitionKind() uint64 {
+	return transition.kind
+}
+
+func (transition *transition) PreExit() []string {
+	return transition.preExit
+}
+
 func (transition *transition) Effect() []string {
 	return transition.effect
 }
@@ -199,14 +425,21 @@ func (transition *transition) Target() string {
 	return transition.target
 }
 
+func (transition *transition) Tags() []string {
+	return transition.tags
+}
+
 /******* Behavior *******/
 
 type Operation[T Instance] func(ctx context.Context, hsm T, event Event)
 type Expression[T Instance] func(ctx context.Context, hsm T, event Event) bool
+type Validation[T Instance] func(ctx context.Context, hsm T, event Event) error
 
 type behavior[T Instance] struct {
 	element
 	operation Operation[T]
+	condition Expression[T] // optional, concurrent behaviors only start when it holds
+	timer     bool          // started for the trigger of After, Every or When rather than being a do-activity
 }
 
 /******* Constraint *******/
@@ -214,6 +447,12 @@ type behavior[T Instance] struct {
 type constraint[T Instance] struct {
 	element
 	expression Expression[T]
+	pure       bool // results are memoized per event, see PureGuard
+}
+
+type validation[T Instance] struct {
+	element
+	validation Validation[T]
 }
 
 /******* Events *******/
@@ -222,6 +461,9 @@ type constraint[T Instance] struct {
 // Events can carry data and have completion tracking through the Done channel.
 type Event = elements.Event
 
+// completion is the reserved event name suffix of a state's completion event, see OnCompletion.
+const completion = ".completion"
+
 var (
 	InitialEvent = Event{
 		Name: "hsm_initial",
@@ -240,6 +482,19 @@ var (
 		Kind: kind.CompletionEvent,
 	}
 	InfiniteDuration = time.Duration(-1)
+
+	restartActivitiesEvent = Event{
+		Name: "hsm_restart_activities",
+		Kind: kind.Event,
+	}
+	reactivateEvent = Event{
+		Name: "hsm_reactivate",
+		Kind: kind.Event,
+	}
+	reparentEvent = Event{
+		Name: "hsm_reparent",
+		Kind: kind.Event,
+	}
 )
 
 var closedChannel = func() chan struct{} {
@@ -248,10 +503,16 @@ var closedChannel = func() chan struct{} {
 	return done
 }()
 
+// queue holds pending events. Regular events are kept in a ring buffer so that popping does not
+// retain the backing array of already processed events, the buffer only grows when it is full.
 type queue struct {
 	mutex            sync.RWMutex
 	completionEvents []Event // lifo
-	events           []Event // fifo
+	events           []Event // fifo ring buffer
+	head, size       int
+	staged           []Event // dispatched while processing the current event, see Config.CausalOrdering
+	deferred         []Event // deferred by the current state, held until the next transition
+	maxLen           atomic.Int64
 }
 
 var empty = Event{}
@@ -259,7 +520,124 @@ var empty = Event{}
 func (q *queue) len() int {
 	q.mutex.RLock()
 	defer q.mutex.RUnlock()
-	return len(q.events) + len(q.completionEvents)
+	return q.size + len(q.completionEvents) + len(q.staged)
+}
+
+// stage holds events back until the current event has been processed.
+func (q *queue) stage(events ...Event) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.staged = append(q.staged, events...)
+	q.observe()
+}
+
+// flush queues the staged events in dispatch order. If any of them is a completion event they are
+// queued together ahead of all other events, otherwise behind them.
+func (q *queue) flush() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.staged) == 0 {
+		return
+	}
+	if slices.ContainsFunc(q.staged, func(event Event) bool { return kind.IsKind(event.Kind, kind.CompletionEvent) }) {
+		// completion events are a stack, push in reverse so the staged events pop in dispatch order
+		for i := len(q.staged) - 1; i >= 0; i-- {
+			q.completionEvents = append(q.completionEvents, q.staged[i])
+		}
+	} else {
+		for _, event := range q.staged {
+			q.enqueue(event)
+		}
+	}
+	clear(q.staged)
+	q.staged = q.staged[:0]
+}
+
+// enqueue appends an event to the ring buffer, the caller must hold the mutex.
+func (q *queue) enqueue(event Event) {
+	if q.size == len(q.events) {
+		q.grow()
+	}
+	q.events[(q.head+q.size)%len(q.events)] = event
+	q.size++
+}
+
+// observe records the queue length, the caller must hold the mutex.
+func (q *queue) observe() {
+	// writes are serialized by the mutex, the atomic only allows lock free reads
+	if length := int64(q.size + len(q.completionEvents) + len(q.staged)); length > q.maxLen.Load() {
+		q.maxLen.Store(length)
+	}
+}
+
+// deferEvent holds an event deferred by the current state, it is not counted by len.
+func (q *queue) deferEvent(event Event) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.deferred = append(q.deferred, event)
+}
+
+// release queues the deferred events again behind the pending ones.
+func (q *queue) release() {
+	q.mutex.Lock()
+	deferred := q.deferred
+	q.deferred = nil
+	q.mutex.Unlock()
+	if len(deferred) > 0 {
+		q.push(deferred...)
+	}
+}
+
+func (q *queue) deferredEvents() []Event {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	return slices.Clone(q.deferred)
+}
+
+// snapshot returns the pending events in processing order, followed by the deferred events.
+func (q *queue) snapshot() []Event {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	events := make([]Event, 0, q.size+len(q.completionEvents)+len(q.staged)+len(q.deferred))
+	for i := len(q.completionEvents) - 1; i >= 0; i-- {
+		events = append(events, q.completionEvents[i])
+	}
+	for i := 0; i < q.size; i++ {
+		events = append(events, q.events[(q.head+i)%len(q.events)])
+	}
+	events = append(events, q.staged...)
+	return append(events, q.deferred...)
+}
+
+// discard empties the queue, except for the deferred events, and returns the events it held in
+// processing order.
+func (q *queue) discard() []Event {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	events := make([]Event, 0, q.size+len(q.completionEvents)+len(q.staged))
+	for i := len(q.completionEvents) - 1; i >= 0; i-- {
+		events = append(events, q.completionEvents[i])
+	}
+	for i := 0; i < q.size; i++ {
+		events = append(events, q.events[(q.head+i)%len(q.events)])
+	}
+	events = append(events, q.staged...)
+	clear(q.completionEvents)
+	q.completionEvents = q.completionEvents[:0]
+	clear(q.events)
+	q.head, q.size = 0, 0
+	clear(q.staged)
+	q.staged = q.staged[:0]
+	return events
+}
+
+// grow doubles the ring buffer, unwrapping the pending events to the front.
+func (q *queue) grow() {
+	events := make([]Event, max(2*len(q.events), 8))
+	n := copy(events, q.events[q.head:])
+	copy(events[n:], q.events[:q.head])
+	q.events = events
+	q.head = 0
 }
 
 func (q *queue) pop() (Event, bool) {
@@ -268,17 +646,36 @@ func (q *queue) pop() (Event, bool) {
 	switch {
 	case len(q.completionEvents) > 0:
 		event := q.completionEvents[len(q.completionEvents)-1]
+		q.completionEvents[len(q.completionEvents)-1] = empty
 		q.completionEvents = q.completionEvents[:len(q.completionEvents)-1]
 		return event, true
-	case len(q.events) > 0:
-		event := q.events[0]
-		q.events = q.events[1:]
+	case q.size > 0:
+		event := q.events[q.head]
+		// release the data and done channel of the event
+		q.events[q.head] = empty
+		q.head = (q.head + 1) % len(q.events)
+		q.size--
 		return event, true
 	default:
 		return empty, false
 	}
 }
 
+// prepend queues the events, in order, ahead of all other events except completion events.
+func (q *queue) prepend(events ...Event) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for i := len(events) - 1; i >= 0; i-- {
+		if q.size == len(q.events) {
+			q.grow()
+		}
+		q.head = (q.head - 1 + len(q.events)) % len(q.events)
+		q.events[q.head] = events[i]
+		q.size++
+	}
+	q.observe()
+}
+
 func (q *queue) push(events ...Event) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
@@ -286,9 +683,41 @@ func (q *queue) push(events ...Event) {
 		if kind.IsKind(event.Kind, kind.CompletionEvent) {
 			q.completionEvents = append(q.completionEvents, event)
 		} else {
-			q.events = append(q.events, event)
+			q.enqueue(event)
 		}
 	}
+	q.observe()
+}
+
+// dedupeCapacity bounds the number of keys remembered by a dedupe window.
+const dedupeCapacity = 1024
+
+// dedupe remembers recently seen event dedupe keys for a fixed window, evicting the oldest keys first.
+type dedupe struct {
+	mutex  sync.Mutex
+	window time.Duration
+	seen   map[string]time.Time
+	order  []string // oldest first
+}
+
+func (d *dedupe) duplicate(key string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	now := time.Now()
+	for len(d.order) > 0 {
+		oldest := d.order[0]
+		if len(d.order) < dedupeCapacity && now.Sub(d.seen[oldest]) < d.window {
+			break
+		}
+		delete(d.seen, oldest)
+		d.order = d.order[1:]
+	}
+	if _, ok := d.seen[key]; ok {
+		return true
+	}
+	d.seen[key] = now
+	d.order = append(d.order, key)
+	return false
 }
 
 func apply(model *Model, stack []elements.NamedElement, partials ...RedefinableElement) {
@@ -335,6 +764,13 @@ func Define[T interface{ RedefinableElement | string }](nameOrRedefinableElement
 		apply(&model, stack, elements...)
 	}
 
+	for qualifiedName, member := range model.members {
+		if state, ok := member.(*state); ok && state.completion != "" {
+			state.composite = slices.ContainsFunc(model.descendants(qualifiedName)[1:], func(descendant string) bool {
+				return kind.IsKind(model.members[descendant].Kind(), kind.Vertex)
+			})
+		}
+	}
 	if model.state.initial == "" {
 		panic(fmt.Errorf("initial state is required for state machine %s", model.state.id))
 	}
@@ -345,9 +781,63 @@ func Define[T interface{ RedefinableElement | string }](nameOrRedefinableElement
 		panic(fmt.Errorf("exit actions are not allowed on top level state machine %s", model.state.id))
 	}
 	model.qualifiedName = name
+	model.definition = redefinableElements
 	return model
 }
 
+// Merge creates a new model from an already defined base model with additional elements applied on top.
+// The base model is left untouched. States in the overlay that already exist in the base are extended
+// rather than replaced, so nested states, transitions and behaviors can be added to them. Within
+// Define, a state defined again under the same name replaces the earlier one instead.
+// The merged model is validated the same way as Define, including initial states and transition targets.
+//
+// Example:
+//
+//	extended := hsm.Merge(&base,
+//	    hsm.State("archived"),
+//	    hsm.Transition(hsm.On("archive"), hsm.Source("done"), hsm.Target("archived")),
+//	)
+func Merge(base *Model, overlay ...RedefinableElement) Model {
+	if base == nil {
+		panic(fmt.Errorf("cannot merge into a nil model"))
+	}
+	definition := make([]RedefinableElement, 0, len(base.definition)+len(overlay))
+	definition = append(definition, base.definition...)
+	definition = append(definition, func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		model.merging = true
+		return nil
+	})
+	definition = append(definition, overlay...)
+	return Define(base.Id(), definition...)
+}
+
+// DefineFunc returns a factory for a family of models that only differ by a few parameters, such as
+// timeouts or target names. Each call runs build with the given parameters and defines a new model
+// from the elements it returns, validated as with Define, so that the element-building code is
+// shared instead of copied across near-identical definitions.
+//
+// Example:
+//
+//	type RetryParams struct {
+//	    Attempts int
+//	    Backoff  time.Duration
+//	}
+//	retrying := hsm.DefineFunc("retrying", func(params RetryParams) []hsm.RedefinableElement {
+//	    return []hsm.RedefinableElement{
+//	        hsm.Initial(hsm.Target("waiting")),
+//	        hsm.State("waiting", hsm.Transition(hsm.After(backoff(params.Backoff)), hsm.Target("../trying"))),
+//	        hsm.State("trying", hsm.Transition(hsm.OnCount("failed", params.Attempts), hsm.Target("../gaveUp"))),
+//	        hsm.Final("gaveUp"),
+//	    }
+//	})
+//	fast := retrying(RetryParams{Attempts: 3, Backoff: time.Second})
+//	slow := retrying(RetryParams{Attempts: 10, Backoff: time.Minute})
+func DefineFunc[P any](name string, build func(params P) []RedefinableElement) func(params P) Model {
+	return func(params P) Model {
+		return Define(name, build(params)...)
+	}
+}
+
 func find(stack []elements.NamedElement, maybeKinds ...uint64) elements.NamedElement {
 	for i := len(stack) - 1; i >= 0; i-- {
 		if kind.IsKind(stack[i].Kind(), maybeKinds...) {
@@ -382,11 +872,24 @@ func get[T elements.NamedElement](model *Model, name string) T {
 	return zero
 }
 
+// getFunctionName derives an element name from a function. Method values are named after their
+// type and method, e.g. "pkg.Handlers.onStart" rather than "pkg.(*Handlers).onStart-fm".
 func getFunctionName(fn any) string {
 	if fn == nil {
 		return ""
 	}
-	return path.Base(runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name())
+	name := path.Base(strings.TrimSuffix(runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name(), "-fm"))
+	return strings.NewReplacer("(*", "", "(", "", ")", "").Replace(name)
+}
+
+// uniqueName suffixes qualifiedName with a counter if names already holds it, so functions with the
+// same name, e.g. a method bound to different receivers, do not replace each other.
+func uniqueName(qualifiedName string, names []string) string {
+	unique := qualifiedName
+	for i := 2; slices.Contains(names, unique); i++ {
+		unique = fmt.Sprintf("%s-%d", qualifiedName, i)
+	}
+	return unique
 }
 
 func hasWildcard(events ...string) bool {
@@ -398,6 +901,29 @@ func hasWildcard(events ...string) bool {
 	return false
 }
 
+// resolve joins a relative name onto the qualified name of base, reporting an
+// error instead of silently clamping when ".." segments would escape the model root.
+func resolve(base, name string) (string, error) {
+	if path.IsAbs(name) {
+		return path.Clean(name), nil
+	}
+	resolved := base
+	for _, segment := range strings.Split(name, "/") {
+		switch segment {
+		case "", ".":
+			continue
+		case "..":
+			if resolved == "/" {
+				return "", fmt.Errorf("relative path \"%s\" escapes the state machine root when resolved from \"%s\"", name, base)
+			}
+			resolved = path.Dir(resolved)
+		default:
+			resolved = path.Join(resolved, segment)
+		}
+	}
+	return resolved, nil
+}
+
 // State creates a new state element with the given name and optional child elements.
 // States can have entry/exit actions, activities, and transitions.
 //
@@ -421,10 +947,16 @@ func State(name string, partialElements ...RedefinableElement) RedefinableElemen
 		if owner == nil {
 			traceback(fmt.Errorf("state \"%s\" must be called within Define() or State()", name))
 		}
-		element := &state{
-			vertex: vertex{element: element{kind: kind.State, qualifiedName: path.Join(owner.QualifiedName(), name)}, transitions: []string{}},
+		qualifiedName := path.Join(owner.QualifiedName(), name)
+		// a Merge overlay extends the existing state instead of replacing it
+		existing, ok := model.members[qualifiedName].(*state)
+		if !ok || existing.Kind() != kind.State || !model.merging {
+			existing = &state{
+				vertex: vertex{element: element{kind: kind.State, qualifiedName: qualifiedName}, transitions: []string{}},
+			}
+			model.members[qualifiedName] = existing
 		}
-		model.members[element.QualifiedName()] = element
+		element := existing
 		stack = append(stack, element)
 		apply(model, stack, partialElements...)
 		model.push(func(model *Model, stack []elements.NamedElement) elements.NamedElement {
@@ -463,7 +995,9 @@ func State(name string, partialElements ...RedefinableElement) RedefinableElemen
 // For example:
 // - LCA("/s/s1", "/s/s2") returns "/s"
 // - LCA("/s/s1", "/s/s1/s11") returns "/s/s1"
-// - LCA("/s/s1", "/s/s1") returns "/s/s1"
+// - LCA("/s/s1", "/s/s1") returns "/s"
+// - LCA("/s1", "/s2") returns "/"
+// - LCA("/", "/s/s1") and LCA("/", "/") return "/"
 func LCA(a, b string) string {
 	// if both are the same the lca is the parent
 	if a == b {
@@ -476,6 +1010,10 @@ func LCA(a, b string) string {
 	if b == "" {
 		return a
 	}
+	// the root has no parent, it is the lca of itself and of every other state
+	if a == "/" || b == "/" {
+		return "/"
+	}
 	// if the parents are the same the lca is the parent
 	if path.Dir(a) == path.Dir(b) {
 		return path.Dir(a)
@@ -513,6 +1051,13 @@ func IsAncestor(current, target string) bool {
 
 // Transition creates a new transition between states.
 // Transitions can have triggers, guards, and effects.
+// Taking a transition exits the active states leaf to root up to the least common ancestor of its
+// source and target, runs its effects, then enters the states root to leaf down to its target.
+// The paths are computed when the model is defined, so the order does not depend on definition order.
+// A transition without triggers from a state is a completion transition: it is triggered by the
+// completion event of its source, which is generated once a simple state has run its entry actions
+// and its activities have all returned, or once a composite state has entered one of its final
+// states.
 //
 // Example:
 //
@@ -569,14 +1114,16 @@ func Transition[T interface{ RedefinableElement | string }](nameOrPartialElement
 		case *vertex:
 			source.transitions = append(source.transitions, transition.QualifiedName())
 		}
+		for i, name := range transition.events {
+			if name == completion {
+				transition.events[i] = path.Join(transition.source, completion)
+			}
+		}
 		if len(transition.events) == 0 && !kind.IsKind(sourceElement.Kind(), kind.Pseudostate) {
-
-			// TODO: completion transition
-			// qualifiedName := path.Join(transition.source, ".completion")
-			// transition.events = append(transition.events, &event{
-			// 	element: element{kind: kind.CompletionEvent, qualifiedName: qualifiedName},
-			// })
-			traceback(fmt.Errorf("completion transition not implemented"))
+			transition.events = append(transition.events, path.Join(transition.source, completion))
+		}
+		if source, ok := sourceElement.(*state); ok && slices.Contains(transition.events, path.Join(transition.source, completion)) {
+			source.completion = path.Join(transition.source, completion)
 		}
 		if transition.target == transition.source {
 			transition.kind = kind.Self
@@ -611,8 +1158,8 @@ func Transition[T interface{ RedefinableElement | string }](nameOrPartialElement
 					traceback(fmt.Errorf("internal transitions require an effect"))
 				}
 				// precompute transition paths for the source state and nested states
-				for qualifiedName, element := range model.members {
-					if strings.HasPrefix(qualifiedName, transition.source) && kind.IsKind(element.Kind(), kind.Vertex) {
+				for _, qualifiedName := range model.descendants(transition.source) {
+					if element, ok := model.members[qualifiedName]; ok && kind.IsKind(element.Kind(), kind.Vertex) {
 						exit := []string{}
 						if transition.kind != kind.Internal {
 							exiting := element.QualifiedName()
@@ -663,15 +1210,23 @@ func Source[T interface{ RedefinableElement | string }](nameOrPartialElement T)
 		var name string
 		switch any(nameOrPartialElement).(type) {
 		case string:
-			name = any(nameOrPartialElement).(string)
+			relative := any(nameOrPartialElement).(string)
+			name = relative
 			if !path.IsAbs(name) {
 				if ancestor := find(stack, kind.State); ancestor != nil {
-					name = path.Join(ancestor.QualifiedName(), name)
+					resolved, err := resolve(ancestor.QualifiedName(), relative)
+					if err != nil {
+						traceback(fmt.Errorf("invalid source for transition \"%s\": %w", transition.QualifiedName(), err))
+					}
+					name = resolved
 				}
 			}
 			// push a validation step to ensure the source exists after the model is built
 			model.push(func(model *Model, stack []elements.NamedElement) elements.NamedElement {
 				if _, ok := model.members[name]; !ok {
+					if relative != name {
+						traceback(fmt.Errorf("missing source \"%s\" (resolved to \"%s\") for transition \"%s\"", relative, name, transition.QualifiedName()))
+					}
 					traceback(fmt.Errorf("missing source \"%s\" for transition \"%s\"", name, transition.QualifiedName()))
 				}
 				return owner
@@ -716,6 +1271,67 @@ func Defer[T interface{ string | *Event | Event }](events ...T) RedefinableEleme
 	}
 }
 
+// Ignore declares events that are deliberately consumed without effect while the state is active.
+// Ignored events do not bubble up to ancestor states and are not reported as dropped to the
+// Config.EventObserver, which distinguishes "swallowed here" from "nobody handled it".
+// Transitions of the state for the same event take precedence. Wildcards are supported.
+//
+// Example:
+//
+//	hsm.State("closed",
+//	    hsm.Ignore("heartbeat", "metrics.*"),
+//	)
+func Ignore[T interface{ string | *Event | Event }](events ...T) RedefinableElement {
+	traceback := traceback()
+	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		state, ok := find(stack, kind.State).(*state)
+		if !ok {
+			traceback(fmt.Errorf("ignore must be called within a State"))
+		}
+		for _, event := range events {
+			switch evt := any(event).(type) {
+			case string:
+				state.ignored = append(state.ignored, evt)
+			case *Event:
+				state.ignored = append(state.ignored, evt.Name)
+			case Event:
+				state.ignored = append(state.ignored, evt.Name)
+			}
+		}
+		return state
+	}
+}
+
+// Handles documents the events a state expects to handle, for CheckEventCoverage to cross-reference
+// with the events its transitions actually trigger on. It has no effect at runtime.
+//
+// Example:
+//
+//	hsm.State("processing",
+//	    hsm.Handles("stateChanged", "cancel"),
+//	    hsm.Transition(hsm.On("stateChanged"), hsm.Target("../done")),
+//	)
+func Handles[T interface{ string | *Event | Event }](events ...T) RedefinableElement {
+	traceback := traceback()
+	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		state, ok := find(stack, kind.State).(*state)
+		if !ok {
+			traceback(fmt.Errorf("handles must be called within a State"))
+		}
+		for _, event := range events {
+			switch evt := any(event).(type) {
+			case string:
+				state.handles = append(state.handles, evt)
+			case *Event:
+				state.handles = append(state.handles, evt.Name)
+			case Event:
+				state.handles = append(state.handles, evt.Name)
+			}
+		}
+		return state
+	}
+}
+
 // Target specifies the target state of a transition.
 // It can be used within a Transition definition.
 //
@@ -742,12 +1358,19 @@ func Target[T interface{ RedefinableElement | string }](nameOrPartialElement T)
 			qualifiedName = target
 			if !path.IsAbs(qualifiedName) {
 				if ancestor := find(stack, kind.State); ancestor != nil {
-					qualifiedName = path.Join(ancestor.QualifiedName(), qualifiedName)
+					resolved, err := resolve(ancestor.QualifiedName(), target)
+					if err != nil {
+						traceback(fmt.Errorf("invalid target for transition \"%s\": %w", transition.QualifiedName(), err))
+					}
+					qualifiedName = resolved
 				}
 			}
 			// push a validation step to ensure the target exists after the model is built
 			model.push(func(model *Model, stack []elements.NamedElement) elements.NamedElement {
 				if _, exists := model.members[qualifiedName]; !exists {
+					if target != qualifiedName {
+						traceback(fmt.Errorf("missing target \"%s\" (resolved to \"%s\") for transition \"%s\"", target, qualifiedName, transition.QualifiedName()))
+					}
 					traceback(fmt.Errorf("missing target \"%s\" for transition \"%s\"", target, transition.QualifiedName()))
 				}
 				return transition
@@ -781,9 +1404,12 @@ func Effect[T Instance](funcs ...func(ctx context.Context, hsm T, event Event))
 			traceback(fmt.Errorf("effect must be called within a Transition"))
 		}
 		for _, fn := range funcs {
+			if fn == nil {
+				traceback(fmt.Errorf("effect function for \"%s\" cannot be nil", owner.QualifiedName()))
+			}
 			name := getFunctionName(fn)
 			behavior := &behavior[T]{
-				element:   element{kind: kind.Behavior, qualifiedName: path.Join(owner.QualifiedName(), name)},
+				element:   element{kind: kind.Behavior, qualifiedName: uniqueName(path.Join(owner.QualifiedName(), name), owner.effect)},
 				operation: fn,
 			}
 			model.members[behavior.QualifiedName()] = behavior
@@ -809,6 +1435,9 @@ func Guard[T Instance](fn func(ctx context.Context, hsm T, event Event) bool) Re
 		if owner == nil {
 			traceback(fmt.Errorf("guard must be called within a Transition"))
 		}
+		if fn == nil {
+			traceback(fmt.Errorf("guard function for \"%s\" cannot be nil", owner.QualifiedName()))
+		}
 		constraint := &constraint[T]{
 			element:    element{kind: kind.Constraint, qualifiedName: path.Join(owner.QualifiedName(), name)},
 			expression: fn,
@@ -819,43 +1448,209 @@ func Guard[T Instance](fn func(ctx context.Context, hsm T, event Event) bool) Re
 	}
 }
 
-// Initial defines the initial state for a composite state or the entire state machine.
-// When a composite state is entered, its initial state is automatically entered.
+// PureGuard defines a guard like Guard whose result depends only on the instance and the event.
+// Transitions sharing the same key share one constraint, and its result is memoized for the event
+// being processed, so the guard runs at most once per event no matter how many candidate
+// transitions or choice branches consult it. The key identifies the guard, including any values
+// it captures: closures of the same function capturing different values need different keys.
+// Registering two different functions under the same key panics when the model is defined.
 //
 // Example:
 //
-//	hsm.State("operational",
-//	    hsm.State("idle"),
-//	    hsm.State("running"),
-//	    hsm.Initial("idle")
+//	hsm.Transition(
+//	    hsm.On("charge"),
+//	    hsm.Target("approved"),
+//	    hsm.PureGuard("creditworthy", isCreditworthy),
 //	)
-func Initial[T interface{ string | RedefinableElement }](elementOrName T, partialElements ...RedefinableElement) RedefinableElement {
-	name := ".initial"
-	switch any(elementOrName).(type) {
-	case string:
-		name = any(elementOrName).(string)
-	case RedefinableElement:
-		partialElements = append([]RedefinableElement{any(elementOrName).(RedefinableElement)}, partialElements...)
-	}
+func PureGuard[T Instance](key string, fn func(ctx context.Context, hsm T, event Event) bool) RedefinableElement {
+	name := getFunctionName(fn)
 	traceback := traceback()
 	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
-		owner := find(stack, kind.State)
+		owner := find(stack, kind.Transition)
 		if owner == nil {
-			traceback(fmt.Errorf("initial must be called within a State or Model"))
-		}
-		initial := &vertex{
-			element: element{kind: kind.Initial, qualifiedName: path.Join(owner.QualifiedName(), name)},
+			traceback(fmt.Errorf("guard must be called within a Transition"))
 		}
-		owner.(*state).initial = initial.QualifiedName()
-		if model.members[initial.QualifiedName()] != nil {
-			traceback(fmt.Errorf("initial \"%s\" state already exists for \"%s\"", initial.QualifiedName(), owner.QualifiedName()))
+		if fn == nil {
+			traceback(fmt.Errorf("guard function for \"%s\" cannot be nil", owner.QualifiedName()))
 		}
-		model.members[initial.QualifiedName()] = initial
-		stack = append(stack, initial)
-		transition := (Transition(Source(initial.QualifiedName()), append(partialElements, On(InitialEvent))...)(model, stack)).(*transition)
-		// validation logic
-		if transition.guard != "" {
-			traceback(fmt.Errorf("initial \"%s\" cannot have a guard", initial.QualifiedName()))
+		if key == "" {
+			traceback(fmt.Errorf("pure guard for \"%s\" must have a key", owner.QualifiedName()))
+		}
+		qualifiedName := path.Join("/", ".pure", key)
+		if existing, ok := model.members[qualifiedName].(*constraint[T]); ok {
+			if existingName := getFunctionName(existing.expression); existingName != name {
+				traceback(fmt.Errorf("pure guard key \"%s\" is already used by %s, not %s", key, existingName, name))
+			}
+		} else {
+			model.members[qualifiedName] = &constraint[T]{
+				element:    element{kind: kind.Constraint, qualifiedName: qualifiedName},
+				expression: fn,
+				pure:       true,
+			}
+		}
+		owner.(*transition).guard = qualifiedName
+		return owner
+	}
+}
+
+// GuardExpr defines a guard from a boolean expression string, for guards authored in configuration
+// rather than Go. The expression is compiled when the model is defined and evaluated with reflection
+// when the transition is considered. Go function guards defined with Guard remain the primary path.
+//
+// The expression supports literals (numbers, 'single' or "double" quoted strings, true, false, nil),
+// the operators ||, &&, !, ==, !=, <, <=, >, >= and parentheses, and dotted paths rooted at:
+//
+//   - event: the event, e.g. event.name; other names are looked up in the event data
+//   - data: the event data, e.g. data.tier
+//   - hsm: the state machine instance, e.g. hsm.retries
+//
+// Paths resolve struct fields case-insensitively and string map keys; missing values are nil.
+// Numbers compare numerically regardless of their Go type, comparing values of different types is false.
+//
+// Example:
+//
+//	hsm.Transition(
+//	    hsm.On("charge"),
+//	    hsm.Target("approved"),
+//	    hsm.GuardExpr("event.amount > 100 && data.tier == 'gold'")
+//	)
+func GuardExpr(expr string) RedefinableElement {
+	traceback := traceback()
+	expression, err := parseGuardExpression(expr)
+	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		owner, ok := find(stack, kind.Transition).(*transition)
+		if !ok {
+			traceback(fmt.Errorf("guard must be called within a Transition"))
+		}
+		if err != nil {
+			traceback(fmt.Errorf("invalid guard expression %q for \"%s\": %w", expr, owner.QualifiedName(), err))
+		}
+		guard := &guardExpression{
+			element:    element{kind: kind.Constraint, qualifiedName: path.Join(owner.QualifiedName(), "guard_expr")},
+			source:     expr,
+			expression: expression,
+		}
+		model.members[guard.QualifiedName()] = guard
+		owner.guard = guard.QualifiedName()
+		return owner
+	}
+}
+
+// PreExit defines validations that run after a transition has been selected but before any state
+// is exited. Unlike a Guard, a pre-exit validation may have side effects and fails with a reason:
+// if it returns an error the transition is aborted, the state is left unchanged and an ErrorEvent
+// carrying the error is dispatched. The event is then reported to the EventObserver as dropped, and
+// an OnCount trigger of the transition keeps its count.
+//
+// Example:
+//
+//	hsm.Transition(
+//	    hsm.On("disconnect"),
+//	    hsm.Target("idle"),
+//	    hsm.PreExit(func(ctx context.Context, hsm *MyHSM, event Event) error {
+//	        return hsm.conn.Flush()
+//	    })
+//	)
+func PreExit[T Instance](funcs ...func(ctx context.Context, hsm T, event Event) error) RedefinableElement {
+	traceback := traceback()
+	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		owner, ok := find(stack, kind.Transition).(*transition)
+		if !ok {
+			traceback(fmt.Errorf("pre exit must be called within a Transition"))
+		}
+		for _, fn := range funcs {
+			if fn == nil {
+				traceback(fmt.Errorf("pre exit function for \"%s\" cannot be nil", owner.QualifiedName()))
+			}
+			element := &validation[T]{
+				element:    element{kind: kind.Constraint, qualifiedName: uniqueName(path.Join(owner.QualifiedName(), getFunctionName(fn)), owner.preExit)},
+				validation: fn,
+			}
+			model.members[element.QualifiedName()] = element
+			owner.preExit = append(owner.preExit, element.QualifiedName())
+		}
+		return owner
+	}
+}
+
+// Tag annotates a transition with metadata tags, e.g. for auditing or policy.
+// Tagged transitions can be looked up with TransitionsByTag.
+//
+// Example:
+//
+//	hsm.Transition(
+//	    hsm.On("delete"),
+//	    hsm.Target("deleted"),
+//	    hsm.Tag("audit", "dangerous")
+//	)
+func Tag(tags ...string) RedefinableElement {
+	traceback := traceback()
+	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		owner, ok := find(stack, kind.Transition).(*transition)
+		if !ok {
+			traceback(fmt.Errorf("tag must be called within a Transition"))
+		}
+		for _, tag := range tags {
+			if !slices.Contains(owner.tags, tag) {
+				owner.tags = append(owner.tags, tag)
+			}
+		}
+		return owner
+	}
+}
+
+// TransitionsByTag returns the qualified names of the transitions in the model annotated with tag, in sorted order.
+func TransitionsByTag(model *Model, tag string) []string {
+	transitions := []string{}
+	if model == nil {
+		return transitions
+	}
+	for qualifiedName, member := range model.members {
+		if transition, ok := member.(*transition); ok && slices.Contains(transition.tags, tag) {
+			transitions = append(transitions, qualifiedName)
+		}
+	}
+	slices.Sort(transitions)
+	return transitions
+}
+
+// Initial defines the initial state for a composite state or the entire state machine.
+// When a composite state is entered, its initial state is automatically entered.
+//
+// Example:
+//
+//	hsm.State("operational",
+//	    hsm.State("idle"),
+//	    hsm.State("running"),
+//	    hsm.Initial("idle")
+//	)
+func Initial[T interface{ string | RedefinableElement }](elementOrName T, partialElements ...RedefinableElement) RedefinableElement {
+	name := ".initial"
+	switch any(elementOrName).(type) {
+	case string:
+		name = any(elementOrName).(string)
+	case RedefinableElement:
+		partialElements = append([]RedefinableElement{any(elementOrName).(RedefinableElement)}, partialElements...)
+	}
+	traceback := traceback()
+	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		owner := find(stack, kind.State)
+		if owner == nil {
+			traceback(fmt.Errorf("initial must be called within a State or Model"))
+		}
+		initial := &vertex{
+			element: element{kind: kind.Initial, qualifiedName: path.Join(owner.QualifiedName(), name)},
+		}
+		owner.(*state).initial = initial.QualifiedName()
+		if model.members[initial.QualifiedName()] != nil {
+			traceback(fmt.Errorf("initial \"%s\" state already exists for \"%s\"", initial.QualifiedName(), owner.QualifiedName()))
+		}
+		model.members[initial.QualifiedName()] = initial
+		stack = append(stack, initial)
+		transition := (Transition(Source(initial.QualifiedName()), append(partialElements, On(InitialEvent))...)(model, stack)).(*transition)
+		// validation logic
+		if transition.guard != "" {
+			traceback(fmt.Errorf("initial \"%s\" cannot have a guard", initial.QualifiedName()))
 		}
 		if transition.events[0] != InitialEvent.Name {
 			traceback(fmt.Errorf("initial \"%s\" must not have a trigger \"%s\"", initial.QualifiedName(), InitialEvent.Name))
@@ -951,9 +1746,12 @@ func Entry[T Instance](funcs ...func(ctx context.Context, hsm T, event Event)) R
 			traceback(fmt.Errorf("entry must be called within a State"))
 		}
 		for _, fn := range funcs {
+			if fn == nil {
+				traceback(fmt.Errorf("entry function for \"%s\" cannot be nil", owner.QualifiedName()))
+			}
 			name := getFunctionName(fn)
 			element := &behavior[T]{
-				element:   element{kind: kind.Behavior, qualifiedName: path.Join(owner.QualifiedName(), name)},
+				element:   element{kind: kind.Behavior, qualifiedName: uniqueName(path.Join(owner.QualifiedName(), name), owner.entry)},
 				operation: fn,
 			}
 			model.members[element.QualifiedName()] = element
@@ -963,6 +1761,114 @@ func Entry[T Instance](funcs ...func(ctx context.Context, hsm T, event Event)) R
 	}
 }
 
+// Alias makes the events named after any of the aliases behave as the canonical event, for the same
+// logical event arriving under different names from different sources. Dispatched events are
+// renamed to the canonical name before they are queued, so transitions, Defer, Ignore and event
+// observers only ever see the canonical name. Aliases are exact names, not patterns: they are
+// renamed before any matching, so a wildcard such as On("ab*") matches the canonical name and not
+// the alias "abort". It must be called within Define().
+//
+// Example:
+//
+//	hsm.Define("job",
+//	    hsm.Alias("cancel", "abort", "stop"),
+//	    hsm.State("running", hsm.Transition(hsm.On("cancel"), hsm.Target("../cancelled"))),
+//	    ...
+//	)
+func Alias(canonical string, aliases ...string) RedefinableElement {
+	traceback := traceback()
+	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		owner := find(stack, kind.State)
+		if owner == nil || owner.QualifiedName() != "/" {
+			traceback(fmt.Errorf("alias must be called within Define()"))
+		}
+		if model.aliases == nil {
+			model.aliases = map[string]string{}
+		}
+		for _, alias := range aliases {
+			if strings.Contains(alias, "*") || strings.Contains(canonical, "*") {
+				traceback(fmt.Errorf("alias \"%s\" of \"%s\" must not contain wildcards", alias, canonical))
+			}
+			if existing, ok := model.aliases[alias]; ok && existing != canonical {
+				traceback(fmt.Errorf("alias \"%s\" is already an alias of \"%s\"", alias, existing))
+			}
+			model.aliases[alias] = canonical
+		}
+		return owner
+	}
+}
+
+// DefaultEntry defines entry actions that run on entry to every state of the model, before the
+// state's own entry actions. It must be called within Define(); the state machine itself and final
+// states are not affected.
+//
+// Example:
+//
+//	hsm.Define("example",
+//	    hsm.DefaultEntry(func(ctx context.Context, hsm *MyHSM, event Event) {
+//	        slog.Info("entered", "state", hsm.State())
+//	    }),
+//	    ...
+//	)
+func DefaultEntry[T Instance](funcs ...func(ctx context.Context, hsm T, event Event)) RedefinableElement {
+	traceback := traceback()
+	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		return defaults(model, stack, traceback, "entry", funcs, func(state *state, names []string) {
+			state.entry = append(slices.Clone(names), state.entry...)
+		})
+	}
+}
+
+// DefaultExit defines exit actions that run on exit from every state of the model, before the
+// state's own exit actions. It must be called within Define(); the state machine itself and final
+// states are not affected.
+//
+// Example:
+//
+//	hsm.Define("example",
+//	    hsm.DefaultExit(func(ctx context.Context, hsm *MyHSM, event Event) {
+//	        slog.Info("exiting", "state", hsm.State())
+//	    }),
+//	    ...
+//	)
+func DefaultExit[T Instance](funcs ...func(ctx context.Context, hsm T, event Event)) RedefinableElement {
+	traceback := traceback()
+	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		return defaults(model, stack, traceback, "exit", funcs, func(state *state, names []string) {
+			state.exit = append(slices.Clone(names), state.exit...)
+		})
+	}
+}
+
+func defaults[T Instance](model *Model, stack []elements.NamedElement, traceback func(error), name string, funcs []func(ctx context.Context, hsm T, event Event), inject func(state *state, names []string)) elements.NamedElement {
+	owner := find(stack, kind.State)
+	if owner == nil || owner.QualifiedName() != "/" {
+		traceback(fmt.Errorf("default %s must be called within Define()", name))
+	}
+	names := []string{}
+	for _, fn := range funcs {
+		if fn == nil {
+			traceback(fmt.Errorf("default %s function cannot be nil", name))
+		}
+		element := &behavior[T]{
+			element:   element{kind: kind.Behavior, qualifiedName: path.Join("/", ".default", name, getFunctionName(fn))},
+			operation: fn,
+		}
+		model.members[element.QualifiedName()] = element
+		names = append(names, element.QualifiedName())
+	}
+	// inject once every state has been defined
+	model.push(func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		for qualifiedName, member := range model.members {
+			if state, ok := member.(*state); ok && qualifiedName != "/" && state.Kind() == kind.State {
+				inject(state, names)
+			}
+		}
+		return owner
+	})
+	return owner
+}
+
 // Activity defines a long-running action that is executed while in a state.
 // The activity is started after the entry action and stopped before the exit action.
 //
@@ -979,21 +1885,124 @@ func Entry[T Instance](funcs ...func(ctx context.Context, hsm T, event Event)) R
 //	    }
 //	})
 func Activity[T Instance](funcs ...func(ctx context.Context, hsm T, event Event)) RedefinableElement {
+	traceback := traceback()
+	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		return activities(model, stack, traceback, nil, funcs)
+	}
+}
+
+// ActivityIf defines activities that are only started if the predicate holds on entry to the state,
+// e.g. for feature flagged background work. Unlike checking the condition inside the activity, no
+// goroutine is spawned when the predicate is false. The predicate is evaluated again whenever the
+// activities would be started, such as on re-entry or with RestartActivities.
+//
+// Example:
+//
+//	hsm.ActivityIf(
+//	    func(ctx context.Context, hsm *MyHSM, event Event) bool {
+//	        return hsm.env == "production"
+//	    },
+//	    poll,
+//	)
+func ActivityIf[T Instance](predicate func(ctx context.Context, hsm T, event Event) bool, funcs ...func(ctx context.Context, hsm T, event Event)) RedefinableElement {
+	traceback := traceback()
+	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		if predicate == nil {
+			traceback(fmt.Errorf("activity predicate cannot be nil"))
+		}
+		return activities(model, stack, traceback, predicate, funcs)
+	}
+}
+
+func activities[T Instance](model *Model, stack []elements.NamedElement, traceback func(error), condition Expression[T], funcs []func(ctx context.Context, hsm T, event Event)) elements.NamedElement {
+	owner, ok := find(stack, kind.State).(*state)
+	if !ok {
+		traceback(fmt.Errorf("activity must be called within a State"))
+	}
+	for _, fn := range funcs {
+		if fn == nil {
+			traceback(fmt.Errorf("activity function for \"%s\" cannot be nil", owner.QualifiedName()))
+		}
+		name := getFunctionName(fn)
+		element := &behavior[T]{
+			element:   element{kind: kind.Concurrent, qualifiedName: uniqueName(path.Join(owner.QualifiedName(), name), owner.activities)},
+			operation: fn,
+			condition: condition,
+		}
+		model.members[element.QualifiedName()] = element
+		owner.activities = append(owner.activities, element.QualifiedName())
+	}
+	return owner
+}
+
+// ActivityFirst makes the enclosing state start its activities before running its entry actions,
+// for entry actions that depend on an activity being up or activities that must not wait for a slow
+// entry action. By default entry actions run first and activities start once they have finished.
+// Either way the state is entered, and AfterEntry fires, only once both have been done.
+//
+// Example:
+//
+//	hsm.State("connected",
+//	    hsm.ActivityFirst(),
+//	    hsm.Activity(serve),
+//	    hsm.Entry(waitUntilServing),
+//	)
+func ActivityFirst() RedefinableElement {
 	traceback := traceback()
 	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
 		owner, ok := find(stack, kind.State).(*state)
 		if !ok {
-			traceback(fmt.Errorf("activity must be called within a State"))
+			traceback(fmt.Errorf("activity first must be called within a State"))
 		}
-		for _, fn := range funcs {
-			name := getFunctionName(fn)
-			element := &behavior[T]{
-				element:   element{kind: kind.Concurrent, qualifiedName: path.Join(owner.QualifiedName(), name)},
-				operation: fn,
-			}
-			model.members[element.QualifiedName()] = element
-			owner.activities = append(owner.activities, element.QualifiedName())
+		owner.activityFirst = true
+		return owner
+	}
+}
+
+// KeepActivitiesOnSelf keeps the activities of the enclosing state running across self-transitions,
+// i.e. transitions that exit the state and enter it again as their target, for activities such as
+// pollers that should not drop in-flight work when a self-transition only updates data. Exit and
+// entry actions still run. By default self-transitions terminate the activities and start them again.
+//
+// Example:
+//
+//	hsm.State("polling",
+//	    hsm.KeepActivitiesOnSelf(),
+//	    hsm.Activity(poll),
+//	    hsm.Transition(hsm.On("configure"), hsm.Target("."), hsm.Effect(configure)),
+//	)
+func KeepActivitiesOnSelf() RedefinableElement {
+	traceback := traceback()
+	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		owner, ok := find(stack, kind.State).(*state)
+		if !ok {
+			traceback(fmt.Errorf("keep activities on self must be called within a State"))
+		}
+		owner.keepOnSelf = true
+		return owner
+	}
+}
+
+// LazyActivities delays the start of the activities of the enclosing state by the given duration,
+// so that they never start when the state is left before, e.g. for intermediate states of a setup
+// sequence that are usually left right away. Their goroutines are only spawned once the delay has
+// elapsed. Overrides Config.LazyActivities for the state, zero starts them on entry.
+//
+// Example:
+//
+//	hsm.State("resolving",
+//	    hsm.LazyActivities(10*time.Millisecond),
+//	    hsm.Activity(resolve),
+//	    hsm.Transition(hsm.On("resolved"), hsm.Target("../connecting")),
+//	)
+func LazyActivities(delay time.Duration) RedefinableElement {
+	traceback := traceback()
+	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		owner, ok := find(stack, kind.State).(*state)
+		if !ok {
+			traceback(fmt.Errorf("lazy activities must be called within a State"))
 		}
+		owner.lazy = &delay
 		return owner
 	}
 }
@@ -1014,9 +2023,12 @@ func Exit[T Instance](funcs ...func(ctx context.Context, hsm T, event Event)) Re
 			traceback(fmt.Errorf("exit must be called within a State"))
 		}
 		for _, fn := range funcs {
+			if fn == nil {
+				traceback(fmt.Errorf("exit function for \"%s\" cannot be nil", owner.QualifiedName()))
+			}
 			name := getFunctionName(fn)
 			element := &behavior[T]{
-				element:   element{kind: kind.Behavior, qualifiedName: path.Join(owner.QualifiedName(), name)},
+				element:   element{kind: kind.Behavior, qualifiedName: uniqueName(path.Join(owner.QualifiedName(), name), owner.exit)},
 				operation: fn,
 			}
 			model.members[element.QualifiedName()] = element
@@ -1026,6 +2038,49 @@ func Exit[T Instance](funcs ...func(ctx context.Context, hsm T, event Event)) Re
 	}
 }
 
+// ExitTo defines exit actions that only run when the enclosing state is exited by a transition whose
+// target matches the pattern, e.g. to clean up differently when cancelled than when completed.
+// The pattern is resolved relative to the state and may contain wildcards. ExitTo actions run after
+// the state's Exit actions, and not at all when the state machine is stopped.
+//
+// Example:
+//
+//	hsm.State("uploading",
+//	    hsm.ExitTo("../cancelled", func(ctx context.Context, hsm *MyHSM, event Event) {
+//	        hsm.deletePartialUpload()
+//	    }),
+//	)
+func ExitTo[T Instance](targetPattern string, funcs ...func(ctx context.Context, hsm T, event Event)) RedefinableElement {
+	traceback := traceback()
+	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		owner, ok := find(stack, kind.State).(*state)
+		if !ok {
+			traceback(fmt.Errorf("exit to must be called within a State"))
+		}
+		pattern := targetPattern
+		if !path.IsAbs(pattern) {
+			pattern = path.Join(owner.QualifiedName(), pattern)
+		}
+		names := []string{}
+		for _, exitTo := range owner.exitTo {
+			names = append(names, exitTo.behavior)
+		}
+		for _, fn := range funcs {
+			if fn == nil {
+				traceback(fmt.Errorf("exit to function for \"%s\" cannot be nil", owner.QualifiedName()))
+			}
+			element := &behavior[T]{
+				element:   element{kind: kind.Behavior, qualifiedName: uniqueName(path.Join(owner.QualifiedName(), "exit_to", getFunctionName(fn)), names)},
+				operation: fn,
+			}
+			model.members[element.QualifiedName()] = element
+			names = append(names, element.QualifiedName())
+			owner.exitTo = append(owner.exitTo, exitTo{pattern: pattern, behavior: element.QualifiedName()})
+		}
+		return owner
+	}
+}
+
 // On defines the events that can cause a transition.
 // Multiple events can be specified for a single transition.
 //
@@ -1060,30 +2115,236 @@ func On[T interface{ string | *Event | Event }](events ...T) RedefinableElement
 	}
 }
 
-// After creates a time-based transition that occurs after a specified duration.
-// The duration can be dynamically computed based on the state machine's context.
+// OnCompletion triggers the transition on the completion event of its source state, like a
+// transition without triggers, see Transition. The completion event is generated automatically
+// and can also be dispatched explicitly with DispatchCompletion to signal that the state is done
+// early. It is named after the state, e.g. "/working/.completion", so it only fires the
+// transitions of the state that was active when it was dispatched.
 //
 // Example:
 //
-//	hsm.Transition(
-//	    hsm.After(func(ctx context.Context, hsm *MyHSM, event Event) time.Duration {
-//	        return time.Second * 30
-//	    }),
-//	    hsm.Source("active"),
-//	    hsm.Target("timeout")
+//	hsm.State("working",
+//	    hsm.Transition(hsm.OnCompletion(), hsm.Target("../done"))
 //	)
-func After[T Instance](expr func(ctx context.Context, hsm T, event Event) time.Duration) RedefinableElement {
+func OnCompletion() RedefinableElement {
 	traceback := traceback()
-	name := getFunctionName(expr)
 	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
 		owner, ok := find(stack, kind.Transition).(*transition)
 		if !ok {
-			traceback(fmt.Errorf("after must be called within a Transition"))
+			traceback(fmt.Errorf("trigger must be called within a Transition"))
 		}
-		qualifiedName := path.Join(owner.QualifiedName(), name, strconv.Itoa(len(model.members)))
-		// hash := crc32.ChecksumIEEE([]byte(qualifiedName))
-		event := Event{
-			Kind: kind.TimeEvent,
+		// resolved against the source once the transition is defined
+		owner.events = append(owner.events, completion)
+		return owner
+	}
+}
+
+// OnSegments defines events that are matched as dot separated paths rather than character by
+// character. A '*' matches within a single segment only and the number of segments must be equal,
+// so "order.*" matches "order.created" but neither "ordering" nor "order.item.added".
+//
+// Example:
+//
+//	hsm.Transition(
+//	    hsm.OnSegments(hsm.EventPath("order", "*")),
+//	    hsm.Source("idle"),
+//	    hsm.Target("processing")
+//	)
+func OnSegments[T interface{ string | *Event | Event }](events ...T) RedefinableElement {
+	traceback := traceback()
+	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		owner, ok := find(stack, kind.Transition).(*transition)
+		if !ok {
+			traceback(fmt.Errorf("trigger must be called within a Transition"))
+		}
+		if owner.segmented == nil {
+			owner.segmented = map[string]bool{}
+		}
+		for _, eventOrName := range events {
+			var name string
+			switch e := any(eventOrName).(type) {
+			case string:
+				name = e
+			case Event:
+				name = e.Name
+			case *Event:
+				name = e.Name
+			}
+			owner.events = append(owner.events, name)
+			owner.segmented[name] = true
+		}
+		return owner
+	}
+}
+
+// EventPath joins segments into a dot separated event name, for use with OnSegments.
+//
+// Example:
+//
+//	hsm.EventPath("order", "created") // "order.created"
+func EventPath(segments ...string) string {
+	return strings.Join(segments, ".")
+}
+
+// OnCount defines an event that only enables the transition on its nth occurrence while the source
+// state is active. The occurrence counter is reset when the transition is taken or the source state is exited.
+// When combined with other triggers on the same transition, every matching event counts.
+//
+// Example:
+//
+//	hsm.Transition(
+//	    hsm.OnCount("strike", 3),
+//	    hsm.Source("playing"),
+//	    hsm.Target("out")
+//	)
+func OnCount[T interface{ string | *Event | Event }](event T, n int) RedefinableElement {
+	traceback := traceback()
+	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		owner, ok := find(stack, kind.Transition).(*transition)
+		if !ok {
+			traceback(fmt.Errorf("OnCount() must be called within a Transition"))
+		}
+		if n < 1 {
+			traceback(fmt.Errorf("OnCount() for transition \"%s\" requires a count of at least 1, got %d", owner.QualifiedName(), n))
+		}
+		On(event)(model, stack)
+		owner.count = n
+		return owner
+	}
+}
+
+// Idle defines a transition from the enclosing state that fires once no event has been processed
+// for the given duration. Unlike After, whose timer starts on state entry, the idle timer is reset
+// every time the state machine processes an event while the state is active, which makes it a
+// debounce, e.g. for "user stopped typing" triggers. Additional elements such as guards and effects
+// are applied to the transition.
+//
+// Example:
+//
+//	hsm.State("typing",
+//	    hsm.Transition(hsm.On("keypress"), hsm.Effect(buffer)),
+//	    hsm.Idle(500*time.Millisecond, "../searching"),
+//	)
+func Idle(duration time.Duration, target string, partialElements ...RedefinableElement) RedefinableElement {
+	traceback := traceback()
+	trigger := func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		owner := find(stack, kind.Transition).(*transition)
+		source, ok := find(stack, kind.State).(*state)
+		if !ok || source.QualifiedName() == model.QualifiedName() {
+			traceback(fmt.Errorf("idle must be called within a State"))
+		}
+		if duration <= 0 {
+			traceback(fmt.Errorf("idle duration for \"%s\" must be positive", owner.QualifiedName()))
+		}
+		idle := &idle{
+			element:  element{kind: kind.Concurrent, qualifiedName: path.Join(owner.QualifiedName(), "idle")},
+			duration: duration,
+		}
+		source.idle = append(source.idle, idle)
+		owner.events = append(owner.events, idle.QualifiedName())
+		return owner
+	}
+	return Transition(trigger, append([]RedefinableElement{Target(target)}, partialElements...)...)
+}
+
+// MaxResidency bounds how long the enclosing state may stay active. If the state is still active
+// after the given duration, the state machine transitions to target, or dispatches an ErrorEvent
+// wrapping ErrMaxResidency if target is empty. Unlike Idle, the timer is not reset by events, and
+// it restarts whenever the state is entered again. Additional elements such as guards and effects
+// are applied to the timeout transition.
+//
+// Example:
+//
+//	hsm.State("provisioning",
+//	    hsm.MaxResidency(10*time.Minute, "../failed"),
+//	)
+func MaxResidency(duration time.Duration, target string, partialElements ...RedefinableElement) RedefinableElement {
+	traceback := traceback()
+	timer := func(owner elements.NamedElement, model *Model, stack []elements.NamedElement) *idle {
+		source, ok := find(stack, kind.State).(*state)
+		if !ok || source.QualifiedName() == model.QualifiedName() {
+			traceback(fmt.Errorf("max residency must be called within a State"))
+		}
+		if duration <= 0 {
+			traceback(fmt.Errorf("max residency for \"%s\" must be positive", source.QualifiedName()))
+		}
+		residency := &idle{
+			element:   element{kind: kind.Concurrent, qualifiedName: path.Join(owner.QualifiedName(), "max_residency")},
+			duration:  duration,
+			residency: true,
+		}
+		source.idle = append(source.idle, residency)
+		return residency
+	}
+	if target == "" {
+		return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+			owner := find(stack, kind.State)
+			residency := timer(owner, model, stack)
+			if len(partialElements) > 0 {
+				traceback(fmt.Errorf("max residency for \"%s\" needs a target to apply transition elements to", owner.QualifiedName()))
+			}
+			residency.err = fmt.Errorf("%w: state \"%s\" was active for more than %s", ErrMaxResidency, owner.QualifiedName(), duration)
+			return owner
+		}
+	}
+	trigger := func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		owner := find(stack, kind.Transition).(*transition)
+		owner.events = append(owner.events, timer(owner, model, stack).QualifiedName())
+		return owner
+	}
+	return Transition(trigger, append([]RedefinableElement{Target(target)}, partialElements...)...)
+}
+
+// OnErrorLocal defines a transition triggered by ErrorEvent that is scoped to the enclosing state.
+// Error events bubble up the active state hierarchy like any other event, so an error raised while
+// a nested state is active is handled by the nearest enclosing state with an OnErrorLocal before
+// reaching handlers further up. The target is resolved relative to the enclosing state, and any
+// additional elements such as effects are applied to the transition.
+//
+// Example:
+//
+//	hsm.State("upload",
+//	    hsm.OnErrorLocal("../failed", hsm.Effect(func(ctx context.Context, hsm *MyHSM, event Event) {
+//	        log.Printf("upload failed: %v", event.Data)
+//	    })),
+//	    hsm.State("sending"),
+//	)
+func OnErrorLocal(target string, partialElements ...RedefinableElement) RedefinableElement {
+	traceback := traceback()
+	transition := Transition(On(ErrorEvent), append([]RedefinableElement{Target(target)}, partialElements...)...)
+	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		owner := find(stack, kind.State)
+		if owner == nil || owner.QualifiedName() == model.QualifiedName() {
+			traceback(fmt.Errorf("on error local must be called within a State"))
+		}
+		return transition(model, stack)
+	}
+}
+
+// After creates a time-based transition that occurs after a specified duration.
+// The duration can be dynamically computed based on the state machine's context.
+//
+// Example:
+//
+//	hsm.Transition(
+//	    hsm.After(func(ctx context.Context, hsm *MyHSM, event Event) time.Duration {
+//	        return time.Second * 30
+//	    }),
+//	    hsm.Source("active"),
+//	    hsm.Target("timeout")
+//	)
+func After[T Instance](expr func(ctx context.Context, hsm T, event Event) time.Duration) RedefinableElement {
+	traceback := traceback()
+	name := getFunctionName(expr)
+	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		owner, ok := find(stack, kind.Transition).(*transition)
+		if !ok {
+			traceback(fmt.Errorf("after must be called within a Transition"))
+		}
+		qualifiedName := path.Join(owner.QualifiedName(), name, strconv.Itoa(len(model.members)))
+		// hash := crc32.ChecksumIEEE([]byte(qualifiedName))
+		event := Event{
+			Kind: kind.TimeEvent,
 			// Id:   strconv.FormatUint(uint64(hash), 32),
 			Name: qualifiedName,
 		}
@@ -1099,6 +2360,7 @@ func After[T Instance](expr func(ctx context.Context, hsm T, event Event) time.D
 			}
 			activity := &behavior[T]{
 				element: element{kind: kind.Concurrent, qualifiedName: path.Join(source.QualifiedName(), "activity", qualifiedName)},
+				timer:   true,
 				operation: func(ctx context.Context, hsm T, _ Event) {
 					duration := expr(ctx, hsm, event)
 					if duration < 0 {
@@ -1158,6 +2420,7 @@ func Every[T Instance](expr func(ctx context.Context, hsm T, event Event) time.D
 			}
 			activity := &behavior[T]{
 				element: element{kind: kind.Concurrent, qualifiedName: path.Join(source.QualifiedName(), "activity", qualifiedName)},
+				timer:   true,
 				operation: func(ctx context.Context, hsm T, evt Event) {
 					duration := expr(ctx, hsm, evt)
 					if duration < 0 {
@@ -1209,6 +2472,7 @@ func When[T Instance](expr func(ctx context.Context, hsm T, event Event) <-chan
 			}
 			activity := &behavior[T]{
 				element: element{kind: kind.Concurrent, qualifiedName: path.Join(source.QualifiedName(), "activity", qualifiedName)},
+				timer:   true,
 				operation: func(ctx context.Context, hsm T, _ Event) {
 					ch := expr(ctx, hsm, event)
 					for {
@@ -1231,6 +2495,7 @@ func When[T Instance](expr func(ctx context.Context, hsm T, event Event) <-chan
 
 // Final creates a final state that represents the completion of a composite state or the entire state machine.
 // When a final state is entered, a completion event is generated.
+// A top-level final state terminates the state machine unless it is declared with AutoRestart.
 //
 // Example:
 //
@@ -1242,7 +2507,7 @@ func When[T Instance](expr func(ctx context.Context, hsm T, event Event) <-chan
 //	        hsm.Target("done")
 //	    )
 //	)
-func Final(name string) RedefinableElement {
+func Final(name string, partialElements ...RedefinableElement) RedefinableElement {
 	traceback := traceback()
 	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
 		owner := find(stack, kind.Namespace)
@@ -1253,6 +2518,7 @@ func Final(name string) RedefinableElement {
 			vertex: vertex{element: element{kind: kind.FinalState, qualifiedName: path.Join(owner.QualifiedName(), name)}, transitions: []string{}},
 		}
 		model.members[state.QualifiedName()] = state
+		apply(model, append(stack, state), partialElements...)
 		model.push(
 			func(model *Model, stack []elements.NamedElement) elements.NamedElement {
 				if len(state.transitions) > 0 {
@@ -1274,6 +2540,36 @@ func Final(name string) RedefinableElement {
 	}
 }
 
+// AutoRestart makes entering a top-level final state restart the state machine, as Restart does
+// with data, instead of terminating it, e.g. for a worker that loops back for the next job once it
+// completes one. An optional minimum interval between starts delays the restart, so a machine
+// that reaches its final state right away does not restart in a tight loop.
+//
+// Example:
+//
+//	hsm.Define("worker",
+//	    hsm.State("working", hsm.Transition(hsm.On("done"), hsm.Target("../finished"))),
+//	    hsm.Final("finished", hsm.AutoRestart(nil, time.Second)),
+//	    hsm.Initial(hsm.Target("working")),
+//	)
+func AutoRestart(data any, minInterval ...time.Duration) RedefinableElement {
+	traceback := traceback()
+	return func(model *Model, stack []elements.NamedElement) elements.NamedElement {
+		owner, ok := find(stack, kind.FinalState).(*state)
+		if !ok {
+			traceback(fmt.Errorf("auto restart must be called within a Final"))
+		}
+		if owner.Owner() != "/" {
+			traceback(fmt.Errorf("auto restart final state \"%s\" must be a top-level final state", owner.QualifiedName()))
+		}
+		owner.autoRestart = &autoRestart{data: data}
+		if len(minInterval) > 0 {
+			owner.autoRestart.interval = minInterval[0]
+		}
+		return owner
+	}
+}
+
 // Match provides a simple interface, handling basic cases directly
 // and delegating complex matching to the match function.
 func Match(value string, patterns ...string) bool {
@@ -1303,6 +2599,28 @@ func Match(value string, patterns ...string) bool {
 	return false
 }
 
+// MatchSegments reports whether value matches any of the patterns segment by segment, where
+// segments are separated by '.' and a '*' only matches within its own segment.
+func MatchSegments(value string, patterns ...string) bool {
+	for _, pattern := range patterns {
+		if pattern == value {
+			return true
+		}
+		segments, patternSegments := strings.Split(value, "."), strings.Split(pattern, ".")
+		if len(segments) != len(patternSegments) {
+			continue
+		}
+		matched := true
+		for i := 0; matched && i < len(segments); i++ {
+			matched = Match(segments[i], patternSegments[i])
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
 // parse implements wildcard matching using a goto-based iterative approach.
 // It supports the '*' wildcard, which matches zero or more characters.
 func parse(value, pattern string) bool {
@@ -1364,93 +2682,560 @@ LOOP_START:
 	return false
 }
 
-type Snapshot struct {
-	ID            string
-	QualifiedName string
-	State         string
-	QueueLen      int
+// Overlaps reports whether two event patterns can match a common event name,
+// taking '*' wildcards in either pattern into account.
+func Overlaps(a, b string) bool {
+	memo := map[[2]int]bool{}
+	var overlaps func(i, j int) bool
+	overlaps = func(i, j int) bool {
+		key := [2]int{i, j}
+		if result, ok := memo[key]; ok {
+			return result
+		}
+		result := false
+		switch {
+		case i == len(a) && j == len(b):
+			result = true
+		case i < len(a) && a[i] == '*':
+			result = overlaps(i+1, j) || (j < len(b) && overlaps(i, j+1))
+		case j < len(b) && b[j] == '*':
+			result = overlaps(i, j+1) || (i < len(a) && overlaps(i+1, j))
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			result = overlaps(i+1, j+1)
+		}
+		memo[key] = result
+		return result
+	}
+	return overlaps(0, 0)
 }
 
-// Instance represents an active state machine instance that can process events and track state.
-// It provides methods for event dispatch and state management.
-type Instance interface {
-	// State returns the current state's qualified name.
-	State() string
-	Context() *active
-	// Dispatch sends an event to the state machine and returns a channel that closes when processing completes.
-	Dispatch(ctx context.Context, event Event) <-chan struct{}
+// Conflict describes two transitions out of the same state that can be triggered by the same event.
+type Conflict struct {
+	// State is the qualified name of the source state.
+	State string
+	// Transitions are the qualified names of the conflicting transitions, in priority order.
+	Transitions [2]string
+	// Events are the overlapping event patterns of each transition.
+	Events [2]string
+}
 
-	// non exported
-	channels() *after
-	takeSnapshot() Snapshot
-	wait() <-chan struct{}
-	start(ctx context.Context, instance Instance, event *Event)
-	stop(ctx context.Context) <-chan struct{}
-	restart(ctx context.Context, maybeData ...any) <-chan struct{}
+// DeterminismOptions configures CheckDeterminism.
+type DeterminismOptions struct {
+	// AllowGuarded treats a pair of transitions as unambiguous if either of them has a guard.
+	AllowGuarded bool
 }
 
-// HSM is the base type that should be embedded in custom state machine types.
-// It provides the core state machine functionality.
+// CheckDeterminism statically finds states with more than one transition that can be triggered
+// by the same event, ignoring guards unless DeterminismOptions.AllowGuarded is set.
+// Wildcard patterns are taken into account, e.g. "foo*" conflicts with "foobar".
+// Transitions of nested states take priority over their ancestors' and are not reported.
 //
 // Example:
 //
-//	type MyHSM struct {
-//	    hsm.HSM
-//	    counter int
+//	if conflicts := hsm.CheckDeterminism(&model); len(conflicts) > 0 {
+//	    log.Fatalf("ambiguous transitions: %+v", conflicts)
 //	}
-
-type instance = Instance
-
-type HSM struct {
-	instance
-}
-
-func (hsm *HSM) start(ctx context.Context, instance Instance, event *Event) {
-	if hsm == nil || hsm.instance != nil {
-		return
+func CheckDeterminism(model *Model, maybeOptions ...DeterminismOptions) []Conflict {
+	conflicts := []Conflict{}
+	if model == nil {
+		return conflicts
 	}
-	hsm.instance = instance
-	instance.start(ctx, hsm, event)
-}
-
-type subcontext = context.Context
-
-type active struct {
-	subcontext
-	context context.Context
-	cancel  context.CancelFunc
-	channel chan struct{}
-}
-
-type timeouts struct {
-	activity time.Duration
-}
-
-type mutex struct {
-	internal sync.Mutex
-	signal   atomic.Value
-}
-
-func (mutex *mutex) lock() {
-	mutex.internal.Lock()
-	mutex.signal.Store(make(chan struct{}))
+	var options DeterminismOptions
+	if len(maybeOptions) > 0 {
+		options = maybeOptions[0]
+	}
+	for _, member := range model.members {
+		source, ok := member.(*state)
+		if !ok {
+			continue
+		}
+		for i, a := range source.transitions {
+			first := get[*transition](model, a)
+			if first == nil {
+				continue
+			}
+			for _, b := range source.transitions[i+1:] {
+				second := get[*transition](model, b)
+				if second == nil {
+					continue
+				}
+				if options.AllowGuarded && (first.guard != "" || second.guard != "") {
+					continue
+				}
+			events:
+				for _, x := range first.events {
+					for _, y := range second.events {
+						if Overlaps(x, y) {
+							conflicts = append(conflicts, Conflict{
+								State:       source.QualifiedName(),
+								Transitions: [2]string{a, b},
+								Events:      [2]string{x, y},
+							})
+							break events
+						}
+					}
+				}
+			}
+		}
+	}
+	slices.SortFunc(conflicts, func(a, b Conflict) int {
+		if c := strings.Compare(a.State, b.State); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.Transitions[0], b.Transitions[0]); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Transitions[1], b.Transitions[1])
+	})
+	return conflicts
 }
 
-func (mutex *mutex) unlock() {
-	mutex.internal.Unlock()
-	signal := mutex.signal.Load().(chan struct{})
-	close(signal)
+// RandomEvent picks an event that can trigger a transition of the state with the given qualified
+// name or of one of its ancestors, uniformly at random using rng, e.g. to drive an instance through
+// its reachable states in property-based tests. Guards are not evaluated, so the event may still be
+// rejected at runtime. Wildcards in event patterns are replaced with random text. Timer, completion
+// and error events are never picked. Returns a zero Event if no event can trigger a transition.
+//
+// Example:
+//
+//	rng := rand.New(rand.NewSource(seed))
+//	for range 1000 {
+//	    event := hsm.RandomEvent(&model, sm.State(), rng)
+//	    if event.Name == "" {
+//	        break // dead end
+//	    }
+//	    <-sm.Dispatch(ctx, event)
+//	}
+func RandomEvent(model *Model, currentState string, rng *rand.Rand) Event {
+	if model == nil || rng == nil {
+		return Event{}
+	}
+	candidates := []string{}
+	for qualifiedName := currentState; qualifiedName != ""; {
+		source := get[*state](model, qualifiedName)
+		if source == nil {
+			break
+		}
+		for _, transitionQualifiedName := range source.transitions {
+			transition := get[*transition](model, transitionQualifiedName)
+			if transition == nil {
+				continue
+			}
+			for _, event := range transition.events {
+				// time and completion events are named after their elements, the others are prefixed
+				if strings.HasPrefix(event, "/") || strings.HasPrefix(event, "hsm_") || slices.Contains(candidates, event) {
+					continue
+				}
+				candidates = append(candidates, event)
+			}
+		}
+		qualifiedName = source.Owner()
+	}
+	if len(candidates) == 0 {
+		return Event{}
+	}
+	pattern := candidates[rng.Intn(len(candidates))]
+	var name strings.Builder
+	for _, r := range pattern {
+		if r == '*' {
+			// letters only, so that segmented patterns still match segment by segment
+			for range 1 + rng.Intn(4) {
+				name.WriteByte(byte('a' + rng.Intn(26)))
+			}
+			continue
+		}
+		name.WriteRune(r)
+	}
+	return Event{Name: name.String(), Kind: kind.Event}
 }
 
-func (mutex *mutex) wait() <-chan struct{} {
-	signal := mutex.signal.Load().(chan struct{})
-	return signal
+// EventCoverage is the result of CheckEventCoverage. Both maps are keyed by qualified name and
+// their event lists are sorted.
+type EventCoverage struct {
+	// Undeclared maps transitions to the events they trigger on that no state declares with Handles,
+	// which usually means a typo in On.
+	Undeclared map[string][]string
+	// Unhandled maps states to the events they declare with Handles that are not handled by a
+	// transition, Defer or Ignore of the state or its ancestors.
+	Unhandled map[string][]string
 }
 
-func (mutex *mutex) tryLock() bool {
-	if mutex.internal.TryLock() {
-		mutex.signal.Store(make(chan struct{}))
-		return true
+// CheckEventCoverage statically cross-references the events declared with Handles against the events
+// the transitions of the model trigger on. Wildcards are taken into account on both sides.
+// Events of the package itself, such as timers, completion and error events, are not checked.
+// Models without any Handles declaration have nothing to check and report full coverage.
+//
+// Example:
+//
+//	coverage := hsm.CheckEventCoverage(&model)
+//	for transition, events := range coverage.Undeclared {
+//	    log.Printf("%s triggers on undeclared events %v", transition, events)
+//	}
+func CheckEventCoverage(model *Model) EventCoverage {
+	coverage := EventCoverage{
+		Undeclared: map[string][]string{},
+		Unhandled:  map[string][]string{},
+	}
+	if model == nil {
+		return coverage
+	}
+	internal := func(event string) bool {
+		// time and completion events are named after their elements, the others are prefixed
+		return strings.HasPrefix(event, "/") || strings.HasPrefix(event, "hsm_")
+	}
+	overlapsAny := func(event string, patterns []string) bool {
+		return slices.ContainsFunc(patterns, func(pattern string) bool { return Overlaps(event, pattern) })
+	}
+	declared := []string{}
+	for _, member := range model.members {
+		if owner, ok := member.(*state); ok {
+			declared = append(declared, owner.handles...)
+		}
+	}
+	if len(declared) == 0 {
+		return coverage
+	}
+	for _, member := range model.members {
+		transition, ok := member.(*transition)
+		if !ok {
+			continue
+		}
+		if source, ok := model.members[transition.source]; ok && kind.IsKind(source.Kind(), kind.Pseudostate) {
+			continue
+		}
+		for _, event := range transition.events {
+			if internal(event) || overlapsAny(event, declared) {
+				continue
+			}
+			coverage.Undeclared[transition.QualifiedName()] = append(coverage.Undeclared[transition.QualifiedName()], event)
+		}
+	}
+	for _, member := range model.members {
+		owner, ok := member.(*state)
+		if !ok {
+			continue
+		}
+		for _, event := range owner.handles {
+			handled := false
+			for qualifiedName := owner.QualifiedName(); !handled; qualifiedName = path.Dir(qualifiedName) {
+				if ancestor := get[*state](model, qualifiedName); ancestor != nil {
+					handled = overlapsAny(event, ancestor.deferred) || overlapsAny(event, ancestor.ignored)
+					for _, name := range ancestor.transitions {
+						if transition := get[*transition](model, name); transition != nil && overlapsAny(event, transition.events) {
+							handled = true
+						}
+					}
+				}
+				if qualifiedName == "/" || qualifiedName == "." {
+					break
+				}
+			}
+			if !handled {
+				coverage.Unhandled[owner.QualifiedName()] = append(coverage.Unhandled[owner.QualifiedName()], event)
+			}
+		}
+	}
+	for _, events := range coverage.Undeclared {
+		slices.Sort(events)
+	}
+	for _, events := range coverage.Unhandled {
+		slices.Sort(events)
+	}
+	return coverage
+}
+
+// UnreachableStates statically lists the states, sorted by qualified name, that no path of
+// transitions reaches from the initial transition of the model, e.g. to catch states left behind
+// by a refactoring in CI. Every transition of an entered state or of its ancestors is assumed to
+// fire and every choice branch to be taken, since guards are not evaluated; initial transitions are
+// followed only when their state is entered by default, not when a transition targets one of its
+// descendants. Pseudostates are traversed but not reported.
+//
+// Example:
+//
+//	if unreachable := hsm.UnreachableStates(&model); len(unreachable) > 0 {
+//	    t.Fatalf("unreachable states: %v", unreachable)
+//	}
+func UnreachableStates(model *Model) []string {
+	if model == nil {
+		return nil
+	}
+	reached := map[string]bool{}
+	defaulted := map[string]bool{}
+	pending := []string{}
+	enter := func(qualifiedName string, defaultEntry bool) {
+		for current := qualifiedName; ; current = path.Dir(current) {
+			if !reached[current] {
+				reached[current] = true
+				if vertex, ok := model.members[current].(elements.Vertex); ok {
+					pending = append(pending, vertex.Transitions()...)
+				}
+			}
+			if current == "/" || current == "." {
+				break
+			}
+		}
+		if state, ok := model.members[qualifiedName].(*state); ok && defaultEntry && !defaulted[qualifiedName] {
+			defaulted[qualifiedName] = true
+			if initial := get[*vertex](model, state.initial); initial != nil {
+				pending = append(pending, initial.transitions...)
+			}
+		}
+	}
+	enter("/", true)
+	for len(pending) > 0 {
+		transition := get[*transition](model, pending[0])
+		pending = pending[1:]
+		if transition != nil && transition.target != "" {
+			enter(transition.target, true)
+		}
+	}
+	unreachable := []string{}
+	for qualifiedName, member := range model.members {
+		if qualifiedName != "/" && kind.IsKind(member.Kind(), kind.State) && !reached[qualifiedName] {
+			unreachable = append(unreachable, qualifiedName)
+		}
+	}
+	slices.Sort(unreachable)
+	return unreachable
+}
+
+type Snapshot struct {
+	ID            string
+	QualifiedName string
+	State         string
+	QueueLen      int
+	// MaxQueueLen is the highest queue length observed since the instance was started or restarted.
+	MaxQueueLen int
+	Timing      InstanceTiming
+	// Transitions is the number of transitions taken since the instance was started or restarted.
+	Transitions uint64
+	// GuardTimeouts is the number of guards that exceeded Config.GuardTimeout since the instance was started or restarted.
+	GuardTimeouts uint64
+}
+
+// InstanceTiming holds the lifecycle timestamps of a state machine instance. Timestamps are zero until
+// the corresponding activity has happened.
+type InstanceTiming struct {
+	// StartedAt is when the instance was started or last restarted.
+	StartedAt time.Time
+	// LastTransitionAt is when the instance last took a transition.
+	LastTransitionAt time.Time
+	// LastDispatchAt is when an event was last accepted by Dispatch.
+	LastDispatchAt time.Time
+}
+
+// Uptime returns the time elapsed since the instance was started or last restarted.
+func (timing InstanceTiming) Uptime() time.Duration {
+	if timing.StartedAt.IsZero() {
+		return 0
+	}
+	return time.Since(timing.StartedAt)
+}
+
+// LastActivityAt returns the latest of the timing's timestamps, e.g. for reaping idle instances.
+func (timing InstanceTiming) LastActivityAt() time.Time {
+	latest := timing.StartedAt
+	for _, at := range []time.Time{timing.LastTransitionAt, timing.LastDispatchAt} {
+		if at.After(latest) {
+			latest = at
+		}
+	}
+	return latest
+}
+
+// Instance represents an active state machine instance that can process events and track state.
+// It provides methods for event dispatch and state management.
+type Instance interface {
+	// State returns the current state's qualified name.
+	State() string
+	Context() *active
+	// Dispatch sends an event to the state machine and returns a channel that closes when processing completes.
+	Dispatch(ctx context.Context, event Event) <-chan struct{}
+
+	// non exported
+	channels() *after
+	takeSnapshot() Snapshot
+	deterministic() bool
+	nextStates(ctx context.Context, guarded bool) map[string][]string
+	wait() <-chan struct{}
+	start(ctx context.Context, instance Instance, event *Event)
+	stop(ctx context.Context) <-chan struct{}
+	restart(ctx context.Context, clean bool, resume string, maybeData ...any) <-chan struct{}
+	restartActivities(ctx context.Context) <-chan struct{}
+	dispatch(ctx context.Context, inline bool, events ...Event) <-chan struct{}
+	processingSince() time.Time
+	drain(ctx context.Context) <-chan struct{}
+	pauseActivity(qualifiedName string, paused bool) bool
+	definition() *Model
+	termination() TerminationReason
+	timing() InstanceTiming
+	transitionCounts() map[string]uint64
+	pending() []Event
+	deferredEvents() []Event
+	subscribe(qualifiedName string) <-chan Event
+	previousState() string
+	activeContexts() []string
+	reactivate(ctx context.Context, qualifiedNames []string) <-chan struct{}
+	reparent(ctx context.Context) <-chan struct{}
+	exportEvents() ([]byte, error)
+	importEvents(ctx context.Context, data []byte) (<-chan struct{}, error)
+	hold(ctx context.Context) bool
+	accepts(ctx context.Context, event *Event) bool
+	apply(ctx context.Context, events []Event) <-chan struct{}
+	release()
+	setProgress(ctx context.Context, progress *progress)
+	currentProgress() *progress
+	dispatchAndSnapshot(ctx context.Context, event Event) (Snapshot, error)
+	schedule(event Event, delay time.Duration) func()
+}
+
+// HSM is the base type that should be embedded in custom state machine types.
+// It provides the core state machine functionality.
+//
+// Example:
+//
+//	type MyHSM struct {
+//	    hsm.HSM
+//	    counter int
+//	}
+
+type instance = Instance
+
+type HSM struct {
+	instance
+}
+
+// String returns "id@qualifiedName:state", see hsm.String.
+func (hsm *HSM) String() string {
+	if hsm == nil || hsm.instance == nil {
+		return "<nil>"
+	}
+	return fmt.Sprint(hsm.instance)
+}
+
+func (hsm *HSM) start(ctx context.Context, instance Instance, event *Event) {
+	if hsm == nil || hsm.instance != nil {
+		return
+	}
+	hsm.instance = instance
+	instance.start(ctx, hsm, event)
+}
+
+type subcontext = context.Context
+
+type active struct {
+	subcontext
+	context context.Context
+	cancel  context.CancelFunc
+	channel chan struct{}
+	// pending gives up a lazy activity that has not started yet, see LazyActivities
+	pending func()
+	// finished is set once the activity has returned, guarded by processing
+	finished bool
+}
+
+// running reports whether the behavior is still running, i.e. it was not cancelled and has not
+// signalled completion.
+func (active *active) running() bool {
+	return active.subcontext != nil && active.Err() == nil && len(active.channel) == 0
+}
+
+// slots caps the running activities, see Config.MaxConcurrentActivities. Activities started while
+// all slots are taken wait in line without a goroutine of their own.
+type slots struct {
+	mutex   sync.Mutex
+	free    int
+	waiting []*waiter
+}
+
+type waiter struct {
+	run  func(ctx context.Context)
+	ctx  context.Context
+	stop func() bool
+}
+
+func newSlots(n int) *slots {
+	return &slots{free: n}
+}
+
+// start runs the activity on a new goroutine once a slot is free, releasing the slot when it
+// returns. An activity whose context is done while waiting is run right away without a slot, so
+// that it can signal its termination.
+func (slots *slots) start(ctx context.Context, run func(ctx context.Context)) {
+	slots.mutex.Lock()
+	if slots.free > 0 {
+		slots.free--
+		slots.mutex.Unlock()
+		go slots.run(run, ctx)
+		return
+	}
+	waiter := &waiter{run: run, ctx: ctx}
+	slots.waiting = append(slots.waiting, waiter)
+	waiter.stop = context.AfterFunc(ctx, func() {
+		slots.mutex.Lock()
+		index := slices.Index(slots.waiting, waiter)
+		if index >= 0 {
+			slots.waiting = slices.Delete(slots.waiting, index, index+1)
+		}
+		slots.mutex.Unlock()
+		if index >= 0 {
+			run(ctx)
+		}
+	})
+	slots.mutex.Unlock()
+}
+
+// release frees the slot of a returned activity, handing it to the longest waiting one.
+func (slots *slots) release() {
+	slots.mutex.Lock()
+	if len(slots.waiting) == 0 {
+		slots.free++
+		slots.mutex.Unlock()
+		return
+	}
+	next := slots.waiting[0]
+	slots.waiting = slots.waiting[1:]
+	slots.mutex.Unlock()
+	next.stop()
+	go slots.run(next.run, next.ctx)
+}
+
+func (slots *slots) run(run func(ctx context.Context), ctx context.Context) {
+	defer slots.release()
+	run(ctx)
+}
+
+type timeouts struct {
+	activity time.Duration
+	guard    time.Duration
+}
+
+type mutex struct {
+	internal sync.Mutex
+	signal   atomic.Value
+}
+
+func (mutex *mutex) lock() {
+	mutex.internal.Lock()
+	mutex.signal.Store(make(chan struct{}))
+}
+
+func (mutex *mutex) unlock() {
+	mutex.internal.Unlock()
+	signal := mutex.signal.Load().(chan struct{})
+	close(signal)
+}
+
+func (mutex *mutex) wait() <-chan struct{} {
+	signal := mutex.signal.Load().(chan struct{})
+	return signal
+}
+
+func (mutex *mutex) tryLock() bool {
+	if mutex.internal.TryLock() {
+		mutex.signal.Store(make(chan struct{}))
+		return true
 	}
 	return false
 }
@@ -1474,6 +3259,45 @@ type hsm[T Instance] struct {
 	timeouts   timeouts
 	processing mutex
 	after      after
+	sequence   *muid.Sequence
+	dedupe     *dedupe
+	counts     map[string]int
+	busy       atomic.Int64 // unix nanoseconds the current processing turn started, zero when idle
+	draining   atomic.Bool
+	paused     sync.Map                 // activity qualified name -> channel closed on resume
+	idle       map[string]chan struct{} // running idle timers -> reset signal, guarded by processing
+	observer   EventObserver
+	deadline   time.Time
+	reason     atomic.Int32 // TerminationReason
+	children   bool         // stop child instances with this one
+	previous   atomic.Value // string, qualified name of the leaf state before the last state change
+	onPanic    func(ctx context.Context, hsm Instance, info Panic) PanicAction
+	timestamps struct {
+		started, transitioned, dispatched atomic.Int64 // unix nanoseconds, zero if never
+	}
+	guardTimeouts atomic.Uint64
+	causal        bool // stage events dispatched while processing, see Config.CausalOrdering
+	codec         Codec
+	collector     *Collector
+	slots         *slots // running activities, see Config.MaxConcurrentActivities
+	maxCascade    int    // events processed per drain, see Config.MaxCascadeDepth
+	resume        string // state the next start enters instead of the initial one, see RestartAt
+	progress      atomic.Pointer[progress]
+	snapshots     sync.Map // event ID -> chan Snapshot, see DispatchAndSnapshot
+	middleware    func(next Operation[Instance]) Operation[Instance]
+	lazy          time.Duration // activity start delay, see Config.LazyActivities
+	subscribers   struct {
+		mutex    sync.Mutex
+		channels map[string][]chan Event // transition qualified name -> subscribers
+	}
+	transitions struct {
+		total  atomic.Uint64
+		counts sync.Map // transition qualified name -> *atomic.Uint64
+	}
+	scheduled struct {
+		mutex  sync.Mutex
+		timers map[*time.Timer]struct{} // pending, see Schedule
+	}
 }
 
 // Config provides configuration options for state machine initialization.
@@ -1486,10 +3310,278 @@ type Config struct {
 	Name string
 	// Data to be passed during initialization
 	Data any
+	// InitialEvent overrides the event that starts the instance, e.g. so that initial effects can tell
+	// a fresh start apart from a restart, which always uses the package InitialEvent. It must be a
+	// completion event. Data, when set, replaces its data. Defaults to InitialEvent.
+	InitialEvent Event
+	// Deterministic makes the instance reproducible for simulations and model-based testing.
+	// When set, event IDs (and the instance ID, if none is given) come from a sequence seeded
+	// with Seed instead of the wall clock, and DispatchAll, DispatchTo and InstancesFromContext
+	// visit instances in sorted ID order when called with this instance's context.
+	// Activities still run on their own goroutines, so their interleaving is not controlled.
+	Deterministic bool
+	// Seed is the starting point of the ID sequence used when Deterministic is set.
+	Seed uint64
+	// DedupeWindow drops dispatched events whose Event.DedupeKey was already seen within the window.
+	// Events without a DedupeKey are never dropped. Zero disables deduplication.
+	DedupeWindow time.Duration
+	// EventObserver is notified at each step of an event's lifecycle. Defaults to a no-op observer.
+	EventObserver EventObserver
+	// Deadline is a wall-clock time at which the instance is stopped, with Termination reporting
+	// DeadlineExceeded. The instance context is derived with context.WithDeadline. Zero disables it.
+	Deadline time.Time
+	// StopChildren makes stopping the instance also stop the instances started from its context,
+	// directly or transitively. Children are stopped leaf to root, each one completely, including its
+	// exit actions, before its parent's states are exited.
+	StopChildren bool
+	// OnPanic decides how a recovered panic is handled, depending on whether it happened in an
+	// activity or while processing events (entry and exit actions, effects and guards).
+	// Defaults to dispatching an ErrorEvent carrying the panic for both.
+	OnPanic func(ctx context.Context, hsm Instance, info Panic) PanicAction
+	// GuardTimeout bounds how long a guard may run. Guards are then evaluated on their own goroutine
+	// and a guard that does not return in time is treated as false, logged and counted in
+	// Snapshot.GuardTimeouts. Guards receive a context that is cancelled on timeout, but a guard that
+	// ignores it keeps running on its abandoned goroutine. Zero evaluates guards inline without a timeout.
+	GuardTimeout time.Duration
+	// CausalOrdering keeps the events dispatched by the behaviors run for one event, such as entry
+	// actions and effects, in the order they were dispatched, regardless of their kind. They are held
+	// back until that event has been processed and then queued together: ahead of all other events if
+	// any of them is a completion event, so completion cascades still take priority, and behind them
+	// otherwise. By default completion events are processed last in, first out, ahead of regular
+	// events, so an entry action dispatching "e" then the completion event "c" has "c" processed
+	// first; with CausalOrdering "e" is processed first, then "c", then the events queued earlier.
+	// Events dispatched from activities or other goroutines are queued as usual.
+	CausalOrdering bool
+	// QueueCapacity preallocates room for this many pending events so that steady-state dispatching
+	// does not allocate. The queue still grows beyond it when needed. Zero allocates on first use.
+	QueueCapacity int
+	// MaxCascadeDepth bounds the number of events processed in a single drain of the queue, as a
+	// safety net against models whose events keep dispatching each other forever. When exceeded, the
+	// pending events are dropped and an ErrorEvent wrapping ErrCascadeLimit, listing the names of the
+	// last events processed, is dispatched instead. Events dispatched by other goroutines during the
+	// drain count too, so set it well above the expected bursts. Zero disables the limit.
+	MaxCascadeDepth int
+	// BehaviorMiddleware wraps the execution of every entry, exit and effect action, activity, guard
+	// and pre-exit validation of the instance, e.g. to time them, recover from their panics or
+	// enforce a timeout. The middleware calls next to run the behavior; a guard that is not run by the
+	// middleware is false and a pre-exit validation that is not run fails with ErrNotRun, aborting the
+	// transition. next ignores the instance it is called with and runs the behavior on the instance it
+	// belongs to.
+	BehaviorMiddleware func(next Operation[Instance]) Operation[Instance]
+	// LazyActivities delays the start of every activity by the given duration, so that the activities
+	// of states left before it has elapsed never start, see the LazyActivities element, which
+	// overrides it per state. Zero starts activities on entry.
+	LazyActivities time.Duration
+	// Codec serializes Event.Data when exporting and importing pending events with ExportEvents and
+	// ImportEvents. Defaults to DefaultCodec.
+	Codec Codec
+	// Collector exports the metrics of the instance, see Collector. Nil disables it.
+	Collector *Collector
+	// MaxConcurrentActivities caps how many activities, including the timers of After and Every,
+	// run at the same time. An activity started while all slots are taken waits in line, without a
+	// goroutine of its own, until another one returns; it is not started at all if its state is exited
+	// in the meantime. Entry actions and transitions are not held up. Activities that never return, such as
+	// long-running loops, hold their slot until their state is exited, so the cap must leave room for
+	// them. Zero means no limit.
+	MaxConcurrentActivities int
+}
+
+// PanicOrigin tells where a recovered panic happened.
+type PanicOrigin int
+
+const (
+	// ActivityPanic is a panic in an activity, which runs on its own goroutine.
+	ActivityPanic PanicOrigin = iota + 1
+	// ProcessingPanic is a panic while processing events, e.g. in an effect, guard, entry or exit action.
+	ProcessingPanic
+)
+
+// Panic describes a recovered panic passed to Config.OnPanic.
+type Panic struct {
+	Origin PanicOrigin
+	// QualifiedName is the qualified name of the activity for ActivityPanic, empty otherwise.
+	QualifiedName string
+	// Recovered is the value passed to panic.
+	Recovered any
+	// Err is the error carried by the ErrorEvent when the panic is dispatched, a *PanicInfo for a
+	// ProcessingPanic.
+	Err error
+}
+
+// PanicInfo is the error carried by the ErrorEvent dispatched for a panic while processing an event,
+// so that error transitions can route on the event or state that caused it.
+//
+// Example:
+//
+//	hsm.Transition(hsm.On(hsm.ErrorEvent.Name), hsm.Target("../review"), hsm.Guard(func(ctx context.Context, sm *Payments, event hsm.Event) bool {
+//	    info, ok := event.Data.(*hsm.PanicInfo)
+//	    return ok && info.Event.Name == "charge"
+//	}))
+type PanicInfo struct {
+	// Event is the event being processed.
+	Event Event
+	// State is the qualified name of the state the event was processed in.
+	State string
+	// Recovered is the value passed to panic.
+	Recovered any
+	// Stack is the stack trace of the panicking goroutine.
+	Stack string
+}
+
+func (info *PanicInfo) Error() string {
+	return fmt.Sprintf("hsm: panic while processing event %s in state %s: %v\n\n%s", info.Event.Name, info.State, info.Recovered, info.Stack)
+}
+
+// Unwrap returns the recovered value if it is an error, so errors.Is and errors.As see through the panic.
+func (info *PanicInfo) Unwrap() error {
+	err, _ := info.Recovered.(error)
+	return err
+}
+
+// PanicAction is the response to a recovered panic returned by Config.OnPanic.
+type PanicAction int
+
+const (
+	// DispatchError dispatches an ErrorEvent carrying Panic.Err, the default.
+	DispatchError PanicAction = iota
+	// RestartActivity starts the crashed activity again if its state is still active.
+	// For a ProcessingPanic it is the same as DispatchError.
+	RestartActivity
+	// StopInstance stops the state machine instance.
+	StopInstance
+	// IgnorePanic drops the panic.
+	IgnorePanic
+)
+
+// TerminationReason describes why a state machine instance is no longer running.
+type TerminationReason int32
+
+const (
+	// NotTerminated means the instance is running.
+	NotTerminated TerminationReason = iota
+	// Stopped means the instance was stopped with Stop or Drain.
+	Stopped
+	// Finished means the instance reached a top level final state.
+	Finished
+	// DeadlineExceeded means the instance was stopped because Config.Deadline passed.
+	DeadlineExceeded
+)
+
+func (reason TerminationReason) String() string {
+	switch reason {
+	case NotTerminated:
+		return "not_terminated"
+	case Stopped:
+		return "stopped"
+	case Finished:
+		return "finished"
+	case DeadlineExceeded:
+		return "deadline_exceeded"
+	}
+	return fmt.Sprintf("termination_reason(%d)", int32(reason))
+}
+
+// EventObserver observes the lifecycle of the events of a state machine instance, e.g. for
+// per-instance dashboards. Methods are called synchronously on the dispatching or processing
+// goroutine and must not block or dispatch events to the same instance.
+//
+//   - Queued is called when an event is added to the queue.
+//   - Dropped is called when an event is rejected by Dispatch, because the instance is draining
+//     or the event is a duplicate, or when it is processed without being handled or deferred.
+//   - Deferred is called when an event is deferred by the current state.
+//   - Handled is called when an event triggers a transition, with the states before and after.
+//   - Processed is called once processing of an event has finished, whatever the outcome.
+type EventObserver interface {
+	Queued(ctx context.Context, hsm Instance, event Event)
+	Processed(ctx context.Context, hsm Instance, event Event)
+	Deferred(ctx context.Context, hsm Instance, event Event)
+	Dropped(ctx context.Context, hsm Instance, event Event)
+	Handled(ctx context.Context, hsm Instance, event Event, from, to string)
+}
+
+type noObserver struct{}
+
+func (noObserver) Queued(context.Context, Instance, Event)                  {}
+func (noObserver) Processed(context.Context, Instance, Event)               {}
+func (noObserver) Deferred(context.Context, Instance, Event)                {}
+func (noObserver) Dropped(context.Context, Instance, Event)                 {}
+func (noObserver) Handled(context.Context, Instance, Event, string, string) {}
+
+// Record is an event accepted by an instance and the time it was accepted at.
+type Record struct {
+	Event Event
+	At    time.Time
+}
+
+// Recorder is an EventObserver that records the events accepted by the instances it observes,
+// for Replay. Only events dispatched from outside are recorded: the events an instance dispatches
+// to itself from its behaviors and activities are generated again when replaying. It is safe for
+// concurrent use.
+//
+// Example:
+//
+//	recorder := &hsm.Recorder{}
+//	sm := hsm.Start(ctx, &Session{}, &model, hsm.Config{EventObserver: recorder})
+type Recorder struct {
+	noObserver
+	mutex   sync.Mutex
+	records []Record
+}
+
+func (recorder *Recorder) Queued(ctx context.Context, hsm Instance, event Event) {
+	if dispatchedBySelf(ctx, hsm) {
+		return
+	}
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.records = append(recorder.records, Record{Event: event, At: time.Now()})
+}
+
+// dispatchedBySelf reports whether the event dispatched with ctx comes from one of the instance's own
+// behaviors or activities.
+func dispatchedBySelf(ctx context.Context, hsm Instance) bool {
+	if ctx.Value(processingKey) == hsm {
+		return true
+	}
+	if _, ok := ctx.Value(pausableKey).(pausable); !ok {
+		return false
+	}
+	instance, ok := FromContext(ctx)
+	return ok && instance == hsm
+}
+
+// Records returns the recorded events in the order they were accepted.
+func (recorder *Recorder) Records() []Record {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	return slices.Clone(recorder.records)
 }
 
 type key[T any] struct{}
 
+// processingKey binds the instance currently processing events to the context passed to its behaviors.
+var processingKey = key[Instance]{}
+
+// scratchKey binds the scratch space of the current processing turn to the context passed to behaviors.
+var scratchKey = key[*sync.Map]{}
+
+// pureGuardsKey binds the memoized pure guard results of the event being processed to the context.
+var pureGuardsKey = key[map[string]bool]{}
+
+type pausable struct {
+	paused        *sync.Map
+	qualifiedName string
+}
+
+var pausableKey = key[pausable]{}
+
+// progress is the latest progress published by an activity of state, see SetProgress.
+type progress struct {
+	value  float64
+	detail string
+	state  string
+}
+
 var Keys = struct {
 	Instances key[*atomic.Pointer[[]Instance]]
 	HSM       key[HSM]
@@ -1501,6 +3593,10 @@ var Keys = struct {
 // Start creates and starts a new state machine instance with the given model and configuration.
 // The state machine will begin executing from its initial state.
 //
+// Start returns once the instance is settled: the initial transition and entry behaviors have run,
+// and events they dispatched to the instance, along with any events those trigger in turn, have been
+// processed. Activities started along the way keep running and their events are processed as usual.
+//
 // Example:
 //
 //	model := hsm.Define(...)
@@ -1522,6 +3618,9 @@ func Start[T Instance](ctx context.Context, sm T, model *Model, maybeConfig ...C
 		instance: sm,
 		queue:    queue{},
 		active:   map[string]*active{},
+		counts:   map[string]int{},
+		idle:     map[string]chan struct{}{},
+		observer: noObserver{},
 		context: &active{
 			context: ctx,
 		},
@@ -1533,11 +3632,47 @@ func Start[T Instance](ctx context.Context, sm T, model *Model, maybeConfig ...C
 		config := maybeConfig[0]
 		hsm.behavior.id = config.ID
 		hsm.timeouts.activity = config.ActivityTimeout
+		hsm.timeouts.guard = config.GuardTimeout
+		hsm.causal = config.CausalOrdering
+		hsm.codec = config.Codec
+		hsm.collector = config.Collector
+		if config.MaxConcurrentActivities > 0 {
+			hsm.slots = newSlots(config.MaxConcurrentActivities)
+		}
 		hsm.behavior.qualifiedName = config.Name
-		initialEvent = initialEvent.WithData(config.Data)
+		if config.InitialEvent.Name != "" {
+			if !kind.IsKind(config.InitialEvent.Kind, kind.CompletionEvent) {
+				panic(fmt.Errorf("initial event \"%s\" must be a completion event", config.InitialEvent.Name))
+			}
+			initialEvent = config.InitialEvent
+		}
+		if config.Data != nil {
+			initialEvent = initialEvent.WithData(config.Data)
+		}
+		if config.Deterministic {
+			hsm.sequence = muid.NewSequence(config.Seed)
+		}
+		if config.DedupeWindow > 0 {
+			hsm.dedupe = &dedupe{
+				window: config.DedupeWindow,
+				seen:   map[string]time.Time{},
+			}
+		}
+		if config.EventObserver != nil {
+			hsm.observer = config.EventObserver
+		}
+		hsm.deadline = config.Deadline
+		hsm.children = config.StopChildren
+		hsm.onPanic = config.OnPanic
+		if config.QueueCapacity > 0 {
+			hsm.queue.events = make([]Event, config.QueueCapacity)
+		}
+		hsm.maxCascade = config.MaxCascadeDepth
+		hsm.middleware = config.BehaviorMiddleware
+		hsm.lazy = config.LazyActivities
 	}
 	if hsm.behavior.id == "" {
-		hsm.behavior.id = muid.Make().String()
+		hsm.behavior.id = hsm.makeId().String()
 	}
 	if hsm.behavior.qualifiedName == "" {
 		hsm.behavior.qualifiedName = model.QualifiedName()
@@ -1546,13 +3681,39 @@ func Start[T Instance](ctx context.Context, sm T, model *Model, maybeConfig ...C
 		hsm.timeouts.activity = time.Millisecond
 	}
 	hsm.behavior.operation = func(ctx context.Context, _ T, event Event) {
-		hsm.state.Store(hsm.enter(ctx, &hsm.model.state, &event, true))
+		if resume := hsm.resume; resume != "" {
+			hsm.resume = ""
+			hsm.state.Store(hsm.enterAt(ctx, resume, &event))
+		} else {
+			hsm.state.Store(hsm.enter(ctx, &hsm.model.state, &event, true))
+		}
+		// events deferred before a restart are reconsidered in the initial state
+		hsm.queue.release()
 		hsm.process(ctx)
 	}
 	sm.start(ctx, hsm, &initialEvent)
 	return sm
 }
 
+// New allocates and starts a state machine of type T, like Start(ctx, &T{}, model, config), and
+// returns the typed instance. T must embed HSM, which is checked at compile time, so forgetting the
+// embed or passing a value instead of a pointer cannot happen.
+//
+// Example:
+//
+//	type Worker struct {
+//	    hsm.HSM
+//	    jobs int
+//	}
+//
+//	worker := hsm.New[Worker](ctx, &model, hsm.Config{ID: "worker-1"})
+func New[T any, PT interface {
+	*T
+	Instance
+}](ctx context.Context, model *Model, maybeConfig ...Config) *T {
+	return (*T)(Start(ctx, PT(new(T)), model, maybeConfig...))
+}
+
 func (sm *hsm[T]) State() string {
 	if sm == nil {
 		return ""
@@ -1569,18 +3730,121 @@ func (sm *hsm[T]) start(ctx context.Context, instance Instance, event *Event) {
 	if !ok {
 		instances = &sync.Map{}
 	}
-	sm.context.subcontext, sm.context.cancel = context.WithCancel(context.WithValue(context.WithValue(ctx, Keys.Instances, instances), Keys.HSM, sm))
-	instances.Store(sm.behavior.id, sm)
+	cursor, ok := ctx.Value(cursorKey).(*atomic.Uint64)
+	if !ok {
+		cursor = &atomic.Uint64{}
+	}
+	sm.derive(ctx, instances, cursor)
+	instances.Store(sm.behavior.id, sm)
+	if sm.collector != nil {
+		sm.collector.add(sm)
+	}
+	sm.previous.Store("")
+	sm.timestamps.started.Store(time.Now().UnixNano())
+	sm.timestamps.transitioned.Store(0)
+	sm.timestamps.dispatched.Store(0)
+	sm.transitions.total.Store(0)
+	sm.guardTimeouts.Store(0)
+	sm.transitions.counts.Range(func(key, _ any) bool {
+		sm.transitions.counts.Delete(key)
+		return true
+	})
 	sm.execute(sm.context, &sm.behavior, event)
 }
 
-func (sm *hsm[T]) restart(ctx context.Context, maybeData ...any) <-chan struct{} {
+// derive sets up the instance context under ctx, which is cancelled when the instance is stopped
+// or its deadline passes.
+func (sm *hsm[T]) derive(ctx context.Context, instances *sync.Map, cursor *atomic.Uint64) {
+	ctx = context.WithValue(context.WithValue(context.WithValue(ctx, Keys.Instances, instances), cursorKey, cursor), Keys.HSM, sm)
+	if sm.deadline.IsZero() {
+		sm.context.subcontext, sm.context.cancel = context.WithCancel(ctx)
+		return
+	}
+	sm.context.subcontext, sm.context.cancel = context.WithDeadline(ctx, sm.deadline)
+	go func(ctx context.Context) {
+		<-ctx.Done()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && sm.reason.CompareAndSwap(int32(NotTerminated), int32(DeadlineExceeded)) {
+			// the expired context cannot be used to tear down
+			sm.stop(context.WithoutCancel(ctx))
+		}
+	}(sm.context.subcontext)
+}
+
+func (sm *hsm[T]) reparent(ctx context.Context) <-chan struct{} {
+	if sm == nil {
+		return closedChannel
+	}
+	signal := make(chan struct{})
+	go func() {
+		defer close(signal)
+		sm.processing.lock()
+		previous := sm.context
+		if previous.subcontext == nil || TerminationReason(sm.reason.Load()) != NotTerminated {
+			sm.processing.unlock()
+			return
+		}
+		instances, ok := previous.Value(Keys.Instances).(*sync.Map)
+		if !ok {
+			instances = &sync.Map{}
+		}
+		cursor, ok := previous.Value(cursorKey).(*atomic.Uint64)
+		if !ok {
+			cursor = &atomic.Uint64{}
+		}
+		sm.context = &active{
+			context: ctx,
+		}
+		sm.derive(ctx, instances, cursor)
+		// running activities and idle timers hold contexts derived from the previous one, start them again under the new one
+		names := []string{}
+		for qualifiedName, active := range sm.active {
+			if active.running() && get[*behavior[T]](sm.model, qualifiedName) != nil {
+				names = append(names, qualifiedName)
+			}
+		}
+		slices.Sort(names)
+		for _, qualifiedName := range names {
+			activity := get[*behavior[T]](sm.model, qualifiedName)
+			_, paused := sm.paused.Load(qualifiedName)
+			sm.terminate(ctx, activity)
+			if paused {
+				sm.paused.Store(qualifiedName, make(chan struct{}))
+			}
+			sm.execute(sm.context, activity, &reparentEvent)
+		}
+		for qualifiedName := sm.State(); qualifiedName != "" && qualifiedName != "."; qualifiedName = path.Dir(qualifiedName) {
+			if state := get[*state](sm.model, qualifiedName); state != nil {
+				for _, idle := range state.idle {
+					if active, ok := sm.active[idle.QualifiedName()]; ok && active.running() {
+						sm.terminate(ctx, idle)
+						sm.startIdle(idle)
+					}
+				}
+			}
+			if qualifiedName == "/" {
+				break
+			}
+		}
+		previous.cancel()
+		sm.process(sm.context)
+	}()
+	return signal
+}
+
+func (sm *hsm[T]) restart(ctx context.Context, clean bool, resume string, maybeData ...any) <-chan struct{} {
 	var data any
 	if len(maybeData) > 0 {
 		data = maybeData[0]
 	}
 	<-sm.stop(ctx)
 	sm.processing.lock()
+	if resettable, ok := any(sm.instance).(Resettable); ok && clean {
+		resettable.Reset()
+	}
+	sm.draining.Store(false)
+	sm.queue.maxLen.Store(0)
+	sm.reason.Store(int32(NotTerminated))
+	sm.resume = resume
 	initialEvent := InitialEvent.WithData(data)
 	sm.context = &active{
 		context: ctx,
@@ -1589,6 +3853,344 @@ func (sm *hsm[T]) restart(ctx context.Context, maybeData ...any) <-chan struct{}
 	return sm.processing.wait()
 }
 
+// restartFinished restarts the instance under its current parent context after it entered an
+// AutoRestart final state, once the minimum interval since it was last started has passed. It
+// gives up if the instance is stopped or restarted meanwhile.
+func (sm *hsm[T]) restartFinished(current *active, restart *autoRestart) {
+	if wait := restart.interval - time.Since(time.Unix(0, sm.timestamps.started.Load())); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-current.Done():
+			return
+		}
+	}
+	if current.Err() != nil {
+		return
+	}
+	sm.restart(current.context, false, "", restart.data)
+}
+
+func (sm *hsm[T]) restartActivities(ctx context.Context) <-chan struct{} {
+	if sm == nil {
+		return closedChannel
+	}
+	signal := make(chan struct{})
+	go func() {
+		defer close(signal)
+		sm.processing.lock()
+		if state, ok := sm.state.Load().(*state); ok {
+			for _, activity := range state.activities {
+				if activity := get[*behavior[T]](sm.model, activity); activity != nil {
+					sm.terminate(ctx, activity)
+				}
+			}
+			sm.executeAll(ctx, state.activities, &restartActivitiesEvent)
+		}
+		// drain anything dispatched while the activities were restarting, this also releases the lock
+		sm.process(ctx)
+	}()
+	return signal
+}
+
+func (sm *hsm[T]) schedule(event Event, delay time.Duration) func() {
+	if sm == nil {
+		return func() {}
+	}
+	sm.scheduled.mutex.Lock()
+	defer sm.scheduled.mutex.Unlock()
+	if sm.scheduled.timers == nil {
+		sm.scheduled.timers = map[*time.Timer]struct{}{}
+	}
+	var timer *time.Timer
+	// the callback takes the mutex, so it sees the timer registered
+	timer = time.AfterFunc(delay, func() {
+		sm.scheduled.mutex.Lock()
+		_, pending := sm.scheduled.timers[timer]
+		delete(sm.scheduled.timers, timer)
+		sm.scheduled.mutex.Unlock()
+		if pending {
+			sm.Dispatch(context.Background(), event)
+		}
+	})
+	sm.scheduled.timers[timer] = struct{}{}
+	return func() {
+		sm.scheduled.mutex.Lock()
+		defer sm.scheduled.mutex.Unlock()
+		if _, pending := sm.scheduled.timers[timer]; pending {
+			delete(sm.scheduled.timers, timer)
+			timer.Stop()
+		}
+	}
+}
+
+// unschedule cancels the events scheduled with Schedule that have not been dispatched yet.
+func (sm *hsm[T]) unschedule() {
+	sm.scheduled.mutex.Lock()
+	defer sm.scheduled.mutex.Unlock()
+	for timer := range sm.scheduled.timers {
+		timer.Stop()
+	}
+	clear(sm.scheduled.timers)
+}
+
+// setProgress publishes the progress of the activity running under ctx. The activity's state may
+// be exited, clearing its progress, between the caller's check of ctx and the store, so the store
+// is undone if ctx was cancelled meanwhile.
+func (sm *hsm[T]) setProgress(ctx context.Context, progress *progress) {
+	if sm == nil {
+		return
+	}
+	previous := sm.progress.Swap(progress)
+	if ctx.Err() == nil {
+		return
+	}
+	if previous != nil && previous.state == progress.state {
+		previous = nil
+	}
+	sm.progress.CompareAndSwap(progress, previous)
+}
+
+func (sm *hsm[T]) currentProgress() *progress {
+	if sm == nil {
+		return nil
+	}
+	return sm.progress.Load()
+}
+
+func (sm *hsm[T]) previousState() string {
+	if sm == nil {
+		return ""
+	}
+	previous, _ := sm.previous.Load().(string)
+	return previous
+}
+
+func (sm *hsm[T]) timing() InstanceTiming {
+	timestamp := func(nanoseconds int64) time.Time {
+		if nanoseconds == 0 {
+			return time.Time{}
+		}
+		return time.Unix(0, nanoseconds)
+	}
+	return InstanceTiming{
+		StartedAt:        timestamp(sm.timestamps.started.Load()),
+		LastTransitionAt: timestamp(sm.timestamps.transitioned.Load()),
+		LastDispatchAt:   timestamp(sm.timestamps.dispatched.Load()),
+	}
+}
+
+// subscriberBuffer is the number of events a transition subscriber can lag behind before events are dropped.
+const subscriberBuffer = 16
+
+func (sm *hsm[T]) subscribe(qualifiedName string) <-chan Event {
+	if sm == nil || TerminationReason(sm.reason.Load()) != NotTerminated {
+		ch := make(chan Event)
+		close(ch)
+		return ch
+	}
+	ch := make(chan Event, subscriberBuffer)
+	sm.subscribers.mutex.Lock()
+	defer sm.subscribers.mutex.Unlock()
+	if sm.subscribers.channels == nil {
+		sm.subscribers.channels = map[string][]chan Event{}
+	}
+	sm.subscribers.channels[qualifiedName] = append(sm.subscribers.channels[qualifiedName], ch)
+	return ch
+}
+
+// notify sends the event to the subscribers of the transition without blocking the state machine.
+func (sm *hsm[T]) notify(qualifiedName string, event Event) {
+	sm.subscribers.mutex.Lock()
+	defer sm.subscribers.mutex.Unlock()
+	for _, ch := range sm.subscribers.channels[qualifiedName] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func (sm *hsm[T]) pending() []Event {
+	if sm == nil {
+		return nil
+	}
+	return sm.queue.snapshot()
+}
+
+func (sm *hsm[T]) deferredEvents() []Event {
+	if sm == nil {
+		return nil
+	}
+	return sm.queue.deferredEvents()
+}
+
+func (sm *hsm[T]) transitionCounts() map[string]uint64 {
+	counts := map[string]uint64{}
+	if sm == nil {
+		return counts
+	}
+	sm.transitions.counts.Range(func(key, value any) bool {
+		counts[key.(string)] = value.(*atomic.Uint64).Load()
+		return true
+	})
+	return counts
+}
+
+func (sm *hsm[T]) termination() TerminationReason {
+	if sm == nil {
+		return NotTerminated
+	}
+	return TerminationReason(sm.reason.Load())
+}
+
+func (sm *hsm[T]) definition() *Model {
+	if sm == nil {
+		return nil
+	}
+	return sm.model
+}
+
+func (sm *hsm[T]) activeContexts() []string {
+	if sm == nil {
+		return nil
+	}
+	sm.processing.lock()
+	names := []string{}
+	for qualifiedName, active := range sm.active {
+		if get[*behavior[T]](sm.model, qualifiedName) != nil && active.running() {
+			names = append(names, qualifiedName)
+		}
+	}
+	// drain anything dispatched while the lock was held, this also releases the lock
+	sm.process(sm.context)
+	slices.Sort(names)
+	return names
+}
+
+func (sm *hsm[T]) encoding() Codec {
+	if sm.codec == nil {
+		return DefaultCodec
+	}
+	return sm.codec
+}
+
+func (sm *hsm[T]) exportEvents() ([]byte, error) {
+	if sm == nil {
+		return nil, ErrNilHSM
+	}
+	sm.processing.lock()
+	events := sm.queue.snapshot()
+	// drain anything dispatched while the lock was held, this also releases the lock
+	defer sm.process(sm.context)
+	exported := make([]exportedEvent, 0, len(events))
+	for _, event := range events {
+		encoded := exportedEvent{Kind: event.Kind, Name: event.Name, Id: event.Id, DedupeKey: event.DedupeKey}
+		if event.Data != nil {
+			data, err := sm.encoding().Encode(event.Data)
+			if err != nil {
+				return nil, fmt.Errorf("hsm: encoding data of event %s: %w", event.Name, err)
+			}
+			encoded.Data = data
+		}
+		exported = append(exported, encoded)
+	}
+	return json.Marshal(exported)
+}
+
+func (sm *hsm[T]) importEvents(ctx context.Context, data []byte) (<-chan struct{}, error) {
+	if sm == nil {
+		return closedChannel, ErrNilHSM
+	}
+	var exported []exportedEvent
+	if err := json.Unmarshal(data, &exported); err != nil {
+		return closedChannel, err
+	}
+	events := make([]Event, 0, len(exported))
+	for _, encoded := range exported {
+		event := Event{Kind: encoded.Kind, Name: encoded.Name, Id: encoded.Id, DedupeKey: encoded.DedupeKey}
+		if encoded.Data != nil {
+			value, err := sm.encoding().Decode(encoded.Data)
+			if err != nil {
+				return closedChannel, fmt.Errorf("hsm: decoding data of event %s: %w", encoded.Name, err)
+			}
+			event.Data = value
+		}
+		events = append(events, event)
+	}
+	if len(events) == 0 {
+		return closedChannel, nil
+	}
+	// completion events are processed last in, first out, so they are queued in reverse to be
+	// processed in the exported order
+	queued := make([]Event, 0, len(events))
+	for i := len(events) - 1; i >= 0; i-- {
+		if kind.IsKind(events[i].Kind, kind.CompletionEvent) {
+			queued = append(queued, events[i])
+		}
+	}
+	for _, event := range events {
+		if !kind.IsKind(event.Kind, kind.CompletionEvent) {
+			queued = append(queued, event)
+		}
+	}
+	return sm.dispatch(ctx, false, queued...), nil
+}
+
+func (sm *hsm[T]) reactivate(ctx context.Context, qualifiedNames []string) <-chan struct{} {
+	if sm == nil {
+		return closedChannel
+	}
+	signal := make(chan struct{})
+	go func() {
+		defer close(signal)
+		sm.processing.lock()
+		activities := []string{}
+		for qualifiedName := sm.State(); qualifiedName != "" && qualifiedName != "."; qualifiedName = path.Dir(qualifiedName) {
+			if state := get[*state](sm.model, qualifiedName); state != nil {
+				activities = append(activities, state.activities...)
+			}
+			if qualifiedName == "/" {
+				break
+			}
+		}
+		for _, qualifiedName := range qualifiedNames {
+			if !slices.Contains(activities, qualifiedName) {
+				continue
+			}
+			if active, ok := sm.active[qualifiedName]; ok {
+				if active.running() {
+					continue
+				}
+				// consume the completion signal of the previous run
+				select {
+				case <-active.channel:
+				default:
+				}
+			}
+			sm.execute(ctx, get[*behavior[T]](sm.model, qualifiedName), &reactivateEvent)
+		}
+		sm.process(ctx)
+	}()
+	return signal
+}
+
+func (sm *hsm[T]) pauseActivity(qualifiedName string, paused bool) bool {
+	if sm == nil {
+		return false
+	}
+	if activity := get[*behavior[T]](sm.model, qualifiedName); activity == nil || !kind.IsKind(activity.Kind(), kind.Concurrent) {
+		return false
+	}
+	if paused {
+		sm.paused.LoadOrStore(qualifiedName, make(chan struct{}))
+	} else if ch, ok := sm.paused.LoadAndDelete(qualifiedName); ok {
+		close(ch.(chan struct{}))
+	}
+	return true
+}
+
 func (sm *hsm[T]) wait() <-chan struct{} {
 	return sm.processing.wait()
 }
@@ -1605,7 +4207,12 @@ func (sm *hsm[T]) stop(ctx context.Context) <-chan struct{} {
 			}
 			close(signal)
 		}()
+		if instances, ok := sm.context.Value(Keys.Instances).(*sync.Map); ok && sm.children {
+			stopChildren(ctx, instances, sm)
+		}
 		sm.processing.lock()
+		sm.reason.CompareAndSwap(int32(NotTerminated), int32(Stopped))
+		sm.unschedule()
 
 		var ok bool
 		state := sm.state.Load().(elements.NamedElement)
@@ -1614,7 +4221,7 @@ func (sm *hsm[T]) stop(ctx context.Context) <-chan struct{} {
 			case <-ctx.Done():
 				return
 			default:
-				sm.exit(ctx, state, &FinalEvent)
+				sm.exit(ctx, state, &FinalEvent, "")
 				state, ok = sm.model.members[state.Owner()]
 				if ok {
 					sm.state.Store(state)
@@ -1625,15 +4232,68 @@ func (sm *hsm[T]) stop(ctx context.Context) <-chan struct{} {
 		}
 		sm.context.cancel()
 		clear(sm.active)
+		sm.subscribers.mutex.Lock()
+		for _, channels := range sm.subscribers.channels {
+			for _, ch := range channels {
+				close(ch)
+			}
+		}
+		sm.subscribers.channels = nil
+		sm.subscribers.mutex.Unlock()
 		if instances, ok := sm.context.Value(Keys.Instances).(*sync.Map); ok {
 			instances.Delete(sm.behavior.id)
 		}
+		if sm.collector != nil {
+			sm.collector.remove(sm)
+		}
 
 		sm.processing.unlock()
 	}()
 	return signal
 }
 
+// stopChildren stops the instances whose context derives from parent, leaf to root.
+func stopChildren(ctx context.Context, instances *sync.Map, parent Instance) {
+	children := []Instance{}
+	instances.Range(func(_, value any) bool {
+		if child, ok := value.(Instance); ok {
+			if owner, ok := Parent(child); ok && owner == parent {
+				children = append(children, child)
+			}
+		}
+		return true
+	})
+	sortById(children)
+	for _, child := range children {
+		stopChildren(ctx, instances, child)
+		<-child.stop(ctx)
+	}
+}
+
+func (sm *hsm[T]) drain(ctx context.Context) <-chan struct{} {
+	if sm == nil {
+		return closedChannel
+	}
+	sm.draining.Store(true)
+	signal := make(chan struct{})
+	go func() {
+		defer close(signal)
+		// wait for the current turn and process anything it left behind, this also releases the lock
+		sm.processing.lock()
+		sm.process(ctx)
+		<-sm.stop(ctx)
+	}()
+	return signal
+}
+
+// String returns "id@qualifiedName:state", e.g. for logging the instance with %s.
+func (sm *hsm[T]) String() string {
+	if sm == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%s@%s:%s", sm.behavior.id, sm.behavior.qualifiedName, sm.State())
+}
+
 func (sm *hsm[T]) Context() *active {
 	if sm == nil {
 		return nil
@@ -1648,6 +4308,17 @@ func (sm *hsm[T]) channels() *after {
 	return &sm.after
 }
 
+func (sm *hsm[T]) deterministic() bool {
+	return sm != nil && sm.sequence != nil
+}
+
+func (sm *hsm[T]) makeId() muid.MUID {
+	if sm.sequence != nil {
+		return sm.sequence.ID()
+	}
+	return muid.Make()
+}
+
 func (sm *hsm[T]) activate(ctx context.Context, element elements.NamedElement) *active {
 	if element == nil {
 		return nil
@@ -1661,6 +4332,7 @@ func (sm *hsm[T]) activate(ctx context.Context, element elements.NamedElement) *
 		sm.active[qualifiedName] = maybeActive
 	}
 	maybeActive.subcontext, maybeActive.cancel = context.WithCancel(ctx)
+	maybeActive.finished = false
 	return maybeActive
 }
 
@@ -1679,13 +4351,30 @@ func (sm *hsm[T]) enter(ctx context.Context, element elements.NamedElement, even
 	switch element.Kind() {
 	case kind.State:
 		state := element.(*state)
+		activities := state.activities
+		if state.keepOnSelf {
+			// activities kept by a self-transition were not cancelled on exit
+			activities = slices.DeleteFunc(slices.Clone(activities), func(qualifiedName string) bool {
+				active, ok := sm.active[qualifiedName]
+				return ok && active.subcontext != nil && active.Err() == nil
+			})
+		}
+		if state.activityFirst && len(activities) > 0 {
+			sm.executeAll(ctx, activities, event)
+		}
 		for _, entry := range state.entry {
 			if entry := get[*behavior[T]](sm.model, entry); entry != nil {
 				sm.execute(ctx, entry, event)
 			}
 		}
-		if len(state.activities) > 0 {
-			sm.executeAll(ctx, state.activities, event)
+		if !state.activityFirst && len(activities) > 0 {
+			sm.executeAll(ctx, activities, event)
+		}
+		for _, idle := range state.idle {
+			sm.startIdle(idle)
+		}
+		if state.completion != "" && !state.composite && sm.completed(state) {
+			sm.Dispatch(ctx, Event{Name: state.completion, Kind: kind.CompletionEvent})
 		}
 		if !defaultEntry || state.initial == "" {
 			return state
@@ -1702,24 +4391,43 @@ func (sm *hsm[T]) enter(ctx context.Context, element elements.NamedElement, even
 		vertex := element.(*vertex)
 		for _, qualifiedName := range vertex.transitions {
 			if transition := get[*transition](sm.model, qualifiedName); transition != nil {
-				if constraint := get[*constraint[T]](sm.model, transition.Guard()); constraint != nil {
-					if !sm.evaluate(ctx, constraint, event) {
-						continue
-					}
+				if !sm.evaluate(ctx, transition.Guard(), event) {
+					continue
 				}
 				return sm.transition(ctx, element, transition, event)
 			}
 		}
+		// the source states are already exited, the caller restores them
+		sm.Dispatch(ctx, ErrorEvent.WithData(fmt.Errorf("%w: %s", ErrDeadEnd, vertex.QualifiedName())))
+		return vertex
 	case kind.FinalState:
+		if final, ok := element.(*state); ok && final.autoRestart != nil {
+			go sm.restartFinished(sm.context, final.autoRestart)
+			return element
+		}
 		if element.Owner() == "/" {
+			sm.reason.CompareAndSwap(int32(NotTerminated), int32(Finished))
 			sm.context.cancel()
+		} else if owner, ok := sm.model.members[element.Owner()].(*state); ok && owner.completion != "" {
+			sm.Dispatch(ctx, Event{Name: owner.completion, Kind: kind.CompletionEvent})
 		}
 		return element
 	}
 	return nil
 }
 
-func (sm *hsm[T]) exit(ctx context.Context, element elements.NamedElement, event *Event) {
+// enterAt enters the state machine and the states from the root down to the given state, which is
+// entered with its default entry.
+func (sm *hsm[T]) enterAt(ctx context.Context, qualifiedName string, event *Event) elements.NamedElement {
+	current := sm.enter(ctx, &sm.model.state, event, false)
+	for _, name := range configuration(qualifiedName) {
+		current = sm.enter(ctx, sm.model.members[name], event, name == qualifiedName)
+	}
+	return current
+}
+
+// exit exits the element on the way to target, which is empty when the state machine stops.
+func (sm *hsm[T]) exit(ctx context.Context, element elements.NamedElement, event *Event, target string) {
 	if sm == nil || element == nil {
 		return
 	}
@@ -1727,54 +4435,304 @@ func (sm *hsm[T]) exit(ctx context.Context, element elements.NamedElement, event
 		// if len(state.activities) > 0 {
 		// 	sm.terminateAll(ctx, state.activities)
 		// }
+		if sm.slots != nil && !(state.keepOnSelf && target == state.QualifiedName()) {
+			// cancel them all before waiting for any, so that the slot freed by one is not handed to
+			// another that is about to be terminated as well
+			for _, activity := range state.activities {
+				if active, ok := sm.active[activity]; ok && active.cancel != nil {
+					active.cancel()
+				}
+			}
+		}
 		for _, activity := range state.activities {
+			if state.keepOnSelf && target == state.QualifiedName() {
+				break
+			}
 			if activity := get[*behavior[T]](sm.model, activity); activity != nil {
 				sm.terminate(ctx, activity)
 			}
 		}
+		if progress := sm.progress.Load(); progress != nil && progress.state == state.QualifiedName() && !(state.keepOnSelf && target == state.QualifiedName()) {
+			sm.progress.CompareAndSwap(progress, nil)
+		}
+		for _, idle := range state.idle {
+			sm.terminate(ctx, idle)
+			delete(sm.idle, idle.QualifiedName())
+		}
 		for _, exit := range state.exit {
 			if exit := get[*behavior[T]](sm.model, exit); exit != nil {
 				sm.execute(ctx, exit, event)
 			}
 		}
+		for _, exitTo := range state.exitTo {
+			if target == "" || !Match(target, exitTo.pattern) {
+				continue
+			}
+			if exit := get[*behavior[T]](sm.model, exitTo.behavior); exit != nil {
+				sm.execute(ctx, exit, event)
+			}
+		}
+		// occurrence counters only accumulate while their source state is active
+		for _, transition := range state.transitions {
+			delete(sm.counts, transition)
+		}
 	}
 
 }
 
-func (sm *hsm[T]) execute(ctx context.Context, element *behavior[T], event *Event) {
-	if sm == nil || element == nil {
-		return
+func (sm *hsm[T]) startIdle(idle *idle) {
+	reset := make(chan struct{}, 1)
+	if !idle.residency {
+		sm.idle[idle.QualifiedName()] = reset
+	}
+	go func(ctx *active) {
+		defer func() {
+			ctx.channel <- struct{}{}
+		}()
+		timer := time.NewTimer(idle.duration)
+		defer timer.Stop()
+		for {
+			select {
+			case <-reset:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(idle.duration)
+			case <-timer.C:
+				if idle.err != nil {
+					sm.Dispatch(ctx, ErrorEvent.WithData(idle.err))
+				} else {
+					sm.Dispatch(ctx, Event{Kind: kind.TimeEvent, Name: idle.QualifiedName()})
+				}
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}(sm.activate(sm.context, idle))
+}
+
+// around runs the behavior operation through Config.BehaviorMiddleware, if any.
+func (sm *hsm[T]) around(ctx context.Context, event Event, operation Operation[T]) {
+	if sm.middleware == nil {
+		operation(ctx, sm.instance, event)
+		return
+	}
+	sm.middleware(func(ctx context.Context, _ Instance, event Event) {
+		operation(ctx, sm.instance, event)
+	})(ctx, sm.instance, event)
+}
+
+func (sm *hsm[T]) execute(ctx context.Context, element *behavior[T], event *Event) {
+	if sm == nil || element == nil {
+		return
 	}
 	switch element.Kind() {
 	case kind.Concurrent:
-		ctx := sm.activate(sm.context, element)
-		go func(ctx *active, event Event) {
+		if element.condition != nil && !element.condition(ctx, sm.instance, *event) {
+			// forget any previous run so terminate does not wait for an activity that never started
+			delete(sm.active, element.QualifiedName())
+			return
+		}
+		owner, _ := sm.model.members[element.Owner()].(*state)
+		active := sm.activate(context.WithValue(sm.context, pausableKey, pausable{paused: &sm.paused, qualifiedName: element.QualifiedName()}), element)
+		// activate rewrites the fields of active when the state is entered again, so the activity
+		// goroutine only uses the subcontext of its own run and the channel, which never changes
+		subcontext := active.subcontext
+		activity := func(ctx context.Context, event Event) {
 			defer func() {
-				if r := recover(); r != nil {
-					go sm.Dispatch(ctx, ErrorEvent.WithData(fmt.Errorf("panic in concurrent behavior %s: %s", element.QualifiedName(), r)))
-				}
+				r := recover()
 				if ch, ok := sm.after.activities.LoadAndDelete(element.QualifiedName()); ok {
 					close(ch.(chan struct{}))
 				}
+				// signal completion even after a panic so terminate does not wait for the timeout
+				active.channel <- struct{}{}
+				if r == nil {
+					if owner != nil && owner.completion != "" && !owner.composite && !element.timer {
+						go sm.complete(active, ctx, element, owner)
+					}
+					return
+				}
+				err := fmt.Errorf("panic in concurrent behavior %s: %s", element.QualifiedName(), r)
+				switch sm.panicked(ctx, Panic{Origin: ActivityPanic, QualifiedName: element.QualifiedName(), Recovered: r, Err: err}) {
+				case RestartActivity:
+					go sm.restartActivity(active, ctx, element, event)
+				case StopInstance:
+					go sm.stop(context.WithoutCancel(ctx))
+				case IgnorePanic:
+				default:
+					go sm.Dispatch(ctx, ErrorEvent.WithData(err))
+				}
 			}()
-			element.operation(ctx, sm.instance, event)
-			ctx.channel <- struct{}{}
-		}(ctx, *event)
-	default:
+			if sm.slots != nil && ctx.Err() != nil {
+				// the state was exited while the activity waited for a slot
+				return
+			}
+			sm.around(ctx, event, element.operation)
+		}
+		spawn := func(event Event) {
+			if sm.slots == nil {
+				go activity(subcontext, event)
+				return
+			}
+			sm.slots.start(subcontext, func(ctx context.Context) {
+				activity(ctx, event)
+			})
+		}
+		lazy := sm.lazy
+		if owner != nil && owner.lazy != nil {
+			lazy = *owner.lazy
+		}
+		if lazy <= 0 {
+			active.pending = nil
+			spawn(*event)
+			return
+		}
+		// whichever of the timer and the termination of the activity comes first decides if it runs
+		var started atomic.Bool
+		event := *event
+		timer := time.AfterFunc(lazy, func() {
+			if started.CompareAndSwap(false, true) {
+				spawn(event)
+			}
+		})
+		active.pending = func() {
+			if !started.CompareAndSwap(false, true) {
+				return
+			}
+			timer.Stop()
+			if ch, ok := sm.after.activities.LoadAndDelete(element.QualifiedName()); ok {
+				close(ch.(chan struct{}))
+			}
+			active.channel <- struct{}{}
+		}
+		context.AfterFunc(subcontext, active.pending)
+	case kind.StateMachine:
 		element.operation(ctx, sm.instance, *event)
+	default:
+		sm.around(ctx, *event, element.operation)
+	}
+
+}
+
+func (sm *hsm[T]) panicked(ctx context.Context, info Panic) PanicAction {
+	if sm.onPanic == nil {
+		return DispatchError
+	}
+	return sm.onPanic(ctx, sm, info)
+}
+
+// restartActivity starts a crashed activity again, unless its state was exited or re-entered since.
+func (sm *hsm[T]) restartActivity(active *active, subcontext context.Context, element *behavior[T], event Event) {
+	sm.processing.lock()
+	if current, ok := sm.active[element.QualifiedName()]; ok && current == active && active.subcontext == subcontext && active.Err() == nil {
+		// consume the completion signal of the crashed run
+		select {
+		case <-active.channel:
+		default:
+		}
+		sm.execute(sm.context, element, &event)
+	}
+	sm.process(sm.context)
+}
+
+// complete marks a returned activity as finished and dispatches the completion event of its state
+// once all of the state's activities have, unless the state was exited or re-entered since.
+func (sm *hsm[T]) complete(active *active, subcontext context.Context, element *behavior[T], state *state) {
+	sm.processing.lock()
+	if current, ok := sm.active[element.QualifiedName()]; ok && current == active && active.subcontext == subcontext && active.Err() == nil {
+		active.finished = true
+		if sm.completed(state) {
+			sm.Dispatch(sm.context, Event{Name: state.completion, Kind: kind.CompletionEvent})
+		}
 	}
+	sm.process(sm.context)
+}
 
+// completed reports whether the activities of the state started on its last entry have all returned.
+// The timers of After, Every and When are not do-activities and are not waited for.
+func (sm *hsm[T]) completed(state *state) bool {
+	for _, qualifiedName := range state.activities {
+		if behavior := get[*behavior[T]](sm.model, qualifiedName); behavior != nil && behavior.timer {
+			continue
+		}
+		if active, ok := sm.active[qualifiedName]; ok && active.subcontext != nil && active.Err() == nil && !active.finished {
+			return false
+		}
+	}
+	return true
 }
 
-func (sm *hsm[T]) evaluate(ctx context.Context, guard *constraint[T], event *Event) bool {
-	if sm == nil || guard == nil || guard.expression == nil {
+func (sm *hsm[T]) evaluate(ctx context.Context, guard string, event *Event) bool {
+	if sm == nil || guard == "" {
 		return true
 	}
-	return guard.expression(
-		ctx,
-		sm.instance,
-		*event,
-	)
+	switch guard := sm.model.members[guard].(type) {
+	case *constraint[T]:
+		if guard.expression == nil {
+			return true
+		}
+		memo, _ := ctx.Value(pureGuardsKey).(map[string]bool)
+		if guard.pure && memo != nil {
+			if enabled, ok := memo[guard.QualifiedName()]; ok {
+				return enabled
+			}
+		}
+		var enabled bool
+		if sm.timeouts.guard > 0 {
+			enabled = sm.evaluateWithTimeout(ctx, guard, event)
+		} else {
+			// a guard skipped by the middleware does not enable the transition
+			sm.around(ctx, *event, func(ctx context.Context, hsm T, event Event) {
+				enabled = guard.expression(ctx, hsm, event)
+			})
+		}
+		if guard.pure && memo != nil {
+			memo[guard.QualifiedName()] = enabled
+		}
+		return enabled
+	case *guardExpression:
+		return truthy(guard.expression(guardScope{hsm: sm.instance, event: *event}))
+	}
+	return true
+}
+
+// evaluateWithTimeout runs the guard on its own goroutine and treats it as false if it does not
+// return within the guard timeout. The goroutine is abandoned, not stopped, when the guard times out.
+// The process context may belong to whoever dispatched first, so its cancellation is not inherited:
+// only the guard timeout makes the guard false.
+func (sm *hsm[T]) evaluateWithTimeout(ctx context.Context, guard *constraint[T], event *Event) bool {
+	type result struct {
+		enabled   bool
+		recovered any
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sm.timeouts.guard)
+	defer cancel()
+	results := make(chan result, 1)
+	go func(event Event) {
+		defer func() {
+			if r := recover(); r != nil {
+				results <- result{recovered: r}
+			}
+		}()
+		enabled := false
+		sm.around(ctx, event, func(ctx context.Context, hsm T, event Event) {
+			enabled = guard.expression(ctx, hsm, event)
+		})
+		results <- result{enabled: enabled}
+	}(*event)
+	select {
+	case result := <-results:
+		if result.recovered != nil {
+			// let process handle the panic as if the guard had run inline
+			panic(result.recovered)
+		}
+		return result.enabled
+	case <-ctx.Done():
+		sm.guardTimeouts.Add(1)
+		slog.Default().Warn("hsm: guard timed out", "guard", guard.QualifiedName(), "event", event.Name, "timeout", sm.timeouts.guard)
+		return false
+	}
 }
 
 func (sm *hsm[T]) transition(ctx context.Context, current elements.NamedElement, transition *transition, event *Event) elements.NamedElement {
@@ -1785,12 +4743,38 @@ func (sm *hsm[T]) transition(ctx context.Context, current elements.NamedElement,
 	if !ok {
 		return nil
 	}
+	for _, qualifiedName := range transition.preExit {
+		if preExit := get[*validation[T]](sm.model, qualifiedName); preExit != nil {
+			// a validation skipped by the middleware does not let the transition through
+			err := ErrNotRun
+			sm.around(ctx, *event, func(ctx context.Context, hsm T, event Event) {
+				err = preExit.validation(ctx, hsm, event)
+			})
+			if err != nil {
+				// abort the transition, the error event is queued behind the current event
+				sm.Dispatch(ctx, ErrorEvent.WithData(err))
+				if kind.IsKind(current.Kind(), kind.Pseudostate) {
+					// the source states are already exited, the caller restores them
+					return current
+				}
+				// nothing changed, the event is not handled
+				return nil
+			}
+		}
+	}
+	sm.transitions.total.Add(1)
+	count, ok := sm.transitions.counts.Load(transition.QualifiedName())
+	if !ok {
+		count, _ = sm.transitions.counts.LoadOrStore(transition.QualifiedName(), &atomic.Uint64{})
+	}
+	count.(*atomic.Uint64).Add(1)
+	sm.notify(transition.QualifiedName(), *event)
 	for _, exiting := range path.exit {
 		current, ok = sm.model.members[exiting]
 		if !ok {
 			return nil
 		}
-		sm.exit(ctx, current, event)
+		sm.exit(ctx, current, event, transition.target)
 		if ch, ok := sm.after.exited.LoadAndDelete(exiting); ok {
 			close(ch.(chan struct{}))
 		}
@@ -1824,6 +4808,31 @@ func (sm *hsm[T]) transition(ctx context.Context, current elements.NamedElement,
 	return current
 }
 
+// restore returns to the source state of a transition that dead-ended in a pseudostate, e.g. a choice
+// without an enabled branch or whose branch was aborted by PreExit. The states containing the
+// pseudostate are exited and the exited source states entered again, without default entry.
+func (sm *hsm[T]) restore(ctx context.Context, deadEnd elements.NamedElement, source elements.NamedElement, event *Event) elements.NamedElement {
+	ancestors := func(qualifiedName string) []string {
+		names := []string{}
+		for ; qualifiedName != "/" && qualifiedName != "." && qualifiedName != ""; qualifiedName = path.Dir(qualifiedName) {
+			names = append(names, qualifiedName)
+		}
+		return names
+	}
+	active, wanted := ancestors(deadEnd.Owner()), ancestors(source.QualifiedName())
+	for _, qualifiedName := range active {
+		if !slices.Contains(wanted, qualifiedName) {
+			sm.exit(ctx, sm.model.members[qualifiedName], event, source.QualifiedName())
+		}
+	}
+	for i := len(wanted) - 1; i >= 0; i-- {
+		if !slices.Contains(active, wanted[i]) {
+			sm.enter(ctx, sm.model.members[wanted[i]], event, false)
+		}
+	}
+	return source
+}
+
 func (sm *hsm[T]) terminate(ctx context.Context, element elements.NamedElement) {
 	if sm == nil || element == nil {
 		return
@@ -1836,6 +4845,12 @@ func (sm *hsm[T]) terminate(ctx context.Context, element elements.NamedElement)
 	}
 	maybeActive.cancel()
 	// sm.mutex.Unlock()
+	if maybeActive.pending != nil {
+		maybeActive.pending()
+	}
+	if ch, ok := sm.paused.LoadAndDelete(element.QualifiedName()); ok {
+		close(ch.(chan struct{}))
+	}
 	select {
 	case <-maybeActive.channel:
 	case <-time.After(sm.timeouts.activity):
@@ -1854,14 +4869,22 @@ func (sm *hsm[T]) enabled(ctx context.Context, source elements.Vertex, event *Ev
 			continue
 		}
 		for _, evt := range transition.Events() {
-			if !Match(event.Name, evt) {
+			if transition.segmented[evt] {
+				if !MatchSegments(event.Name, evt) {
+					continue
+				}
+			} else if !Match(event.Name, evt) {
 				continue
 			}
-			if guard := get[*constraint[T]](sm.model, transition.Guard()); guard != nil {
-				if !sm.evaluate(ctx, guard, event) {
-					continue
+			if transition.count > 0 {
+				sm.counts[transition.QualifiedName()]++
+				if sm.counts[transition.QualifiedName()] < transition.count {
+					break
 				}
 			}
+			if !sm.evaluate(ctx, transition.Guard(), event) {
+				continue
+			}
 			return transition
 		}
 	}
@@ -1869,24 +4892,64 @@ func (sm *hsm[T]) enabled(ctx context.Context, source elements.Vertex, event *Ev
 }
 
 func (sm *hsm[T]) process(ctx context.Context) {
+	var event Event
+	var source string
 	defer func() {
 		if r := recover(); r != nil {
-			err := fmt.Errorf("hsm: panic while processing event in state machine: %v\n\n%s", r, string(debug.Stack()))
-			go sm.Dispatch(ctx, ErrorEvent.WithData(err))
+			err := &PanicInfo{Event: event, State: source, Recovered: r, Stack: string(debug.Stack())}
+			switch sm.panicked(ctx, Panic{Origin: ProcessingPanic, Recovered: r, Err: err}) {
+			case StopInstance:
+				go sm.stop(context.WithoutCancel(ctx))
+			case IgnorePanic:
+			default:
+				go sm.Dispatch(ctx, ErrorEvent.WithData(err))
+			}
 		}
+		sm.busy.Store(0)
 		sm.processing.unlock()
 	}()
 	if sm == nil {
 		return
 	}
-	var deferred []Event
+	sm.busy.Store(time.Now().UnixNano())
+	ctx = context.WithValue(context.WithValue(ctx, processingKey, Instance(sm)), scratchKey, &sync.Map{})
+	sm.queue.flush()
+	drained := 0
+	recent := []string{}
 	event, ok := sm.queue.pop()
 	for ok {
 		if event.Id == 0 {
-			event.Id = muid.Make()
+			event.Id = sm.makeId()
 		}
+		if sm.maxCascade > 0 {
+			if drained++; drained > sm.maxCascade {
+				sm.observer.Dropped(ctx, sm, event)
+				for _, pending := range sm.queue.discard() {
+					sm.observer.Dropped(ctx, sm, pending)
+				}
+				drained = 0
+				sm.Dispatch(ctx, ErrorEvent.WithData(fmt.Errorf("%w: more than %d events processed in one turn, last %s", ErrCascadeLimit, sm.maxCascade, strings.Join(recent, ", "))))
+				recent = recent[:0]
+				sm.queue.flush()
+				event, ok = sm.queue.pop()
+				continue
+			}
+			if recent = append(recent, event.Name); len(recent) > 10 {
+				recent = recent[1:]
+			}
+		}
+		ctx := context.WithValue(ctx, pureGuardsKey, map[string]bool{})
+		for _, reset := range sm.idle {
+			select {
+			case reset <- struct{}{}:
+			default:
+			}
+		}
+		began := time.Now()
 		currentState := sm.state.Load().(elements.NamedElement)
 		qualifiedName := currentState.QualifiedName()
+		source = qualifiedName
+		handled := false
 		for qualifiedName != "" {
 			source := get[*state](sm.model, qualifiedName)
 			if source == nil {
@@ -1897,25 +4960,229 @@ func (sm *hsm[T]) process(ctx context.Context) {
 				if state == nil {
 					break
 				}
-				sm.state.Store(state)
-				if len(deferred) > 0 {
-					sm.queue.push(deferred...)
-					deferred = nil
+				if transition.count > 0 {
+					delete(sm.counts, transition.QualifiedName())
+				}
+				if !kind.IsKind(state.Kind(), kind.State) {
+					state = sm.restore(ctx, state, currentState, &event)
+				}
+				if state.QualifiedName() != currentState.QualifiedName() {
+					sm.previous.Store(currentState.QualifiedName())
 				}
+				sm.state.Store(state)
+				sm.timestamps.transitioned.Store(time.Now().UnixNano())
+				handled = true
+				sm.observer.Handled(ctx, sm, event, currentState.QualifiedName(), state.QualifiedName())
+				sm.queue.release()
 				break
 			}
 			if len(source.deferred) > 0 && Match(event.Name, source.deferred...) {
-				deferred = append(deferred, event)
+				sm.queue.deferEvent(event)
+				handled = true
+				sm.observer.Deferred(ctx, sm, event)
+				break
+			}
+			if len(source.ignored) > 0 && Match(event.Name, source.ignored...) {
+				handled = true
 				break
 			}
 			qualifiedName = source.Owner()
 		}
+		if !handled {
+			sm.observer.Dropped(ctx, sm, event)
+		}
+		if sm.collector != nil {
+			sm.collector.observe(sm, time.Since(began))
+		}
+		sm.observer.Processed(ctx, sm, event)
+		if snapshot, ok := sm.snapshots.LoadAndDelete(event.Id); ok {
+			snapshot.(chan Snapshot) <- sm.takeSnapshot()
+		}
 		if ch, ok := sm.after.processed.LoadAndDelete(event.Name); ok {
 			close(ch.(chan struct{}))
 		}
+		sm.queue.flush()
 		event, ok = sm.queue.pop()
 	}
-	sm.queue.push(deferred...)
+}
+
+// hold takes the processing lock once the queue is empty, processing any pending events first,
+// so the state cannot change until apply or release is called. It returns false, without holding
+// the lock, if the instance is draining or stopped.
+func (sm *hsm[T]) hold(ctx context.Context) bool {
+	if sm == nil {
+		return false
+	}
+	for {
+		if sm.draining.Load() || sm.termination() != NotTerminated {
+			return false
+		}
+		sm.processing.lock()
+		if sm.queue.len() == 0 {
+			return true
+		}
+		sm.process(ctx)
+	}
+}
+
+// accepts reports whether the event would fire a transition in the current state, without side
+// effects other than evaluating guards. The caller must hold the processing lock.
+func (sm *hsm[T]) accepts(ctx context.Context, event *Event) bool {
+	if sm == nil {
+		return false
+	}
+	ctx = context.WithValue(context.WithValue(ctx, processingKey, Instance(sm)), scratchKey, &sync.Map{})
+	currentState, ok := sm.state.Load().(elements.NamedElement)
+	if !ok || currentState == nil {
+		return false
+	}
+	normalized := sm.normalize(*event)
+	event = &normalized
+	for qualifiedName := currentState.QualifiedName(); qualifiedName != ""; {
+		source := get[*state](sm.model, qualifiedName)
+		if source == nil {
+			return false
+		}
+		for _, transitionQualifiedName := range source.transitions {
+			transition := get[*transition](sm.model, transitionQualifiedName)
+			if transition == nil {
+				continue
+			}
+			for _, evt := range transition.events {
+				if transition.segmented[evt] {
+					if !MatchSegments(event.Name, evt) {
+						continue
+					}
+				} else if !Match(event.Name, evt) {
+					continue
+				}
+				if transition.count > 0 && sm.counts[transition.QualifiedName()]+1 < transition.count {
+					break
+				}
+				if sm.evaluate(ctx, transition.guard, event) {
+					return true
+				}
+			}
+		}
+		if Match(event.Name, source.deferred...) || Match(event.Name, source.ignored...) {
+			return false
+		}
+		qualifiedName = source.Owner()
+	}
+	return false
+}
+
+// apply queues the events ahead of any dispatched while the lock was held and processes them,
+// releasing the processing lock. The caller must hold the processing lock.
+func (sm *hsm[T]) apply(ctx context.Context, events []Event) <-chan struct{} {
+	if sm == nil {
+		return closedChannel
+	}
+	events = slices.Clone(events)
+	for i := range events {
+		events[i] = sm.normalize(events[i])
+		sm.observer.Queued(ctx, sm, events[i])
+	}
+	sm.queue.prepend(events...)
+	sm.timestamps.dispatched.Store(time.Now().UnixNano())
+	for _, event := range events {
+		if ch, ok := sm.after.dispatched.LoadAndDelete(event.Name); ok {
+			close(ch.(chan struct{}))
+		}
+	}
+	done := sm.processing.wait()
+	go sm.process(ctx)
+	return done
+}
+
+// release gives up the processing lock taken by hold, processing any events dispatched meanwhile.
+func (sm *hsm[T]) release() {
+	if sm == nil {
+		return
+	}
+	go sm.process(sm.context)
+}
+
+func (sm *hsm[T]) nextStates(ctx context.Context, guarded bool) map[string][]string {
+	next := map[string][]string{}
+	if sm == nil {
+		return next
+	}
+	current, ok := sm.state.Load().(elements.NamedElement)
+	if !ok || current == nil {
+		return next
+	}
+	claimed := map[string]bool{}
+	for qualifiedName := current.QualifiedName(); qualifiedName != ""; {
+		source := get[*state](sm.model, qualifiedName)
+		if source == nil {
+			break
+		}
+		for _, transitionQualifiedName := range source.transitions {
+			transition := get[*transition](sm.model, transitionQualifiedName)
+			if transition == nil {
+				continue
+			}
+			for _, name := range transition.events {
+				if guarded && claimed[name] {
+					continue
+				}
+				event := Event{Name: name, Kind: kind.Event}
+				if guarded && !sm.evaluate(ctx, transition.guard, &event) {
+					continue
+				}
+				targets := sm.targets(ctx, transition, current, guarded, &event)
+				if len(targets) == 0 {
+					continue
+				}
+				claimed[name] = true
+				for _, target := range targets {
+					if !slices.Contains(next[name], target) {
+						next[name] = append(next[name], target)
+					}
+				}
+			}
+		}
+		qualifiedName = source.Owner()
+	}
+	return next
+}
+
+// targets statically resolves the states a transition can end up in, following choice pseudostates.
+func (sm *hsm[T]) targets(ctx context.Context, candidate *transition, current elements.NamedElement, guarded bool, event *Event) []string {
+	if candidate.target == "" {
+		return []string{current.QualifiedName()}
+	}
+	choice := get[*vertex](sm.model, candidate.target)
+	if choice == nil || !kind.IsKind(choice.Kind(), kind.Choice) {
+		return []string{candidate.target}
+	}
+	targets := []string{}
+	for _, qualifiedName := range choice.transitions {
+		branch := get[*transition](sm.model, qualifiedName)
+		if branch == nil {
+			continue
+		}
+		if guarded && !sm.evaluate(ctx, branch.guard, event) {
+			continue
+		}
+		targets = append(targets, sm.targets(ctx, branch, current, guarded, event)...)
+		if guarded {
+			break
+		}
+	}
+	return targets
+}
+
+func (sm *hsm[T]) processingSince() time.Time {
+	if sm == nil {
+		return time.Time{}
+	}
+	since := sm.busy.Load()
+	if since == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, since)
 }
 
 func (sm *hsm[T]) takeSnapshot() Snapshot {
@@ -1931,10 +5198,57 @@ func (sm *hsm[T]) takeSnapshot() Snapshot {
 		QualifiedName: sm.behavior.qualifiedName,
 		State:         state.QualifiedName(),
 		QueueLen:      sm.queue.len(),
+		MaxQueueLen:   int(sm.queue.maxLen.Load()),
+		Timing:        sm.timing(),
+		Transitions:   sm.transitions.total.Load(),
+		GuardTimeouts: sm.guardTimeouts.Load(),
+	}
+}
+
+func (sm *hsm[T]) dispatchAndSnapshot(ctx context.Context, event Event) (Snapshot, error) {
+	if sm == nil {
+		return Snapshot{}, ErrNotProcessed
+	}
+	if event.Id == 0 {
+		event.Id = sm.makeId()
+	}
+	snapshot := make(chan Snapshot, 1)
+	sm.snapshots.Store(event.Id, snapshot)
+	defer sm.snapshots.Delete(event.Id)
+	done := sm.Dispatch(ctx, event)
+	select {
+	case taken := <-snapshot:
+		return taken, nil
+	case <-done:
+		// the snapshot is sent before processing completes
+		select {
+		case taken := <-snapshot:
+			return taken, nil
+		default:
+			return Snapshot{}, fmt.Errorf("%w: %s", ErrNotProcessed, event.Name)
+		}
+	case <-ctx.Done():
+		return Snapshot{}, ctx.Err()
 	}
 }
 
 func (sm *hsm[T]) Dispatch(ctx context.Context, event Event) <-chan struct{} {
+	return sm.dispatch(ctx, false, event)
+}
+
+// normalize defaults the kind of the event and replaces an alias with its canonical name, so that
+// transitions only ever see the canonical name.
+func (sm *hsm[T]) normalize(event Event) Event {
+	if event.Kind == 0 {
+		event.Kind = kind.Event
+	}
+	if canonical, ok := sm.model.aliases[event.Name]; ok {
+		event.Name = canonical
+	}
+	return event
+}
+
+func (sm *hsm[T]) dispatch(ctx context.Context, inline bool, events ...Event) <-chan struct{} {
 	if sm == nil {
 		return closedChannel
 	}
@@ -1942,26 +5256,60 @@ func (sm *hsm[T]) Dispatch(ctx context.Context, event Event) <-chan struct{} {
 	if state == nil {
 		return closedChannel
 	}
-	if event.Kind == 0 {
-		event.Kind = kind.Event
+	if sm.draining.Load() {
+		for _, event := range events {
+			sm.observer.Dropped(ctx, sm, event)
+		}
+		return closedChannel
+	}
+	accepted := make([]Event, 0, len(events))
+	for _, event := range events {
+		event := sm.normalize(event)
+		if event.DedupeKey != "" && sm.dedupe != nil && sm.dedupe.duplicate(event.DedupeKey) {
+			sm.observer.Dropped(ctx, sm, event)
+			continue
+		}
+		accepted = append(accepted, event)
+	}
+	if len(accepted) == 0 {
+		return closedChannel
+	}
+	// observed before being queued so that a concurrent turn cannot report Processed before Queued
+	for _, event := range accepted {
+		sm.observer.Queued(ctx, sm, event)
+	}
+	// all events are pushed under a single queue lock so they are processed in order
+	if sm.causal && ctx.Value(processingKey) == Instance(sm) {
+		sm.queue.stage(accepted...)
+	} else {
+		sm.queue.push(accepted...)
+	}
+	sm.timestamps.dispatched.Store(time.Now().UnixNano())
+	for _, event := range accepted {
+		if ch, ok := sm.after.dispatched.LoadAndDelete(event.Name); ok {
+			close(ch.(chan struct{}))
+		}
 	}
-	sm.queue.push(event)
 	if sm.processing.tryLock() {
+		if inline {
+			sm.process(ctx)
+			return closedChannel
+		}
 		go sm.process(ctx)
 	}
-	if ch, ok := sm.after.dispatched.LoadAndDelete(event.Name); ok {
-		close(ch.(chan struct{}))
-	}
 	return sm.processing.wait()
 }
 
-// Dispatch sends an event to a specific state machine instance.
+// Dispatch sends an event to the state machine instance found in the context, i.e. the innermost
+// instance whose context ctx derives from, and does nothing if there is none.
 // Returns a channel that closes when the event has been fully processed.
+// When several instances are in scope, e.g. in a child started from a parent's context, it is easy
+// to dispatch to the wrong one. Prefer DispatchEvent, which names the target instance explicitly.
 //
 // Example:
 //
 //	sm := hsm.Start(...)
-//	done := sm.Dispatch(hsm.Event{Name: "start"})
+//	done := hsm.Dispatch(sm.Context(), hsm.Event{Name: "start"})
 //	<-done // Wait for event processing to complete
 func Dispatch[T context.Context](ctx T, event Event) <-chan struct{} {
 	// get the hsm from the context
@@ -1972,9 +5320,163 @@ func Dispatch[T context.Context](ctx T, event Event) <-chan struct{} {
 	return closedChannel
 }
 
-// DispatchAll sends an event to all state machine instances in the current context.
-// Returns a channel that closes when all instances have processed the event.
-// DispatchAll sends an event to all state machine instances in the current context.
+// DispatchEvent sends an event to the given state machine instance, using ctx only for the dispatch
+// itself, e.g. for tracing values. Unlike Dispatch, the target does not depend on which instances
+// the context carries.
+// Returns a channel that closes when the event has been fully processed.
+//
+// Example:
+//
+//	<-hsm.DispatchEvent(r.Context(), sm, hsm.Event{Name: "start"})
+func DispatchEvent(ctx context.Context, hsm Instance, event Event) <-chan struct{} {
+	return hsm.Dispatch(ctx, event)
+}
+
+// DispatchInline sends an event to a state machine instance and, if the instance is idle,
+// processes it on the calling goroutine instead of spawning one. In that case the returned
+// channel is already closed when DispatchInline returns. If the instance is busy the event is
+// queued as with Dispatch and the returned channel closes when processing completes.
+// Behaviors that dispatch to their own instance should keep using Dispatch.
+//
+// Example:
+//
+//	<-hsm.DispatchInline(ctx, sm, hsm.Event{Name: "start"})
+func DispatchInline(ctx context.Context, hsm Instance, event Event) <-chan struct{} {
+	return hsm.dispatch(ctx, true, event)
+}
+
+// DispatchSeq enqueues the events on a state machine instance in the given order and returns a
+// single channel that closes once all of them have been processed. The events are not applied
+// atomically, each is processed in its own run-to-completion step, but events dispatched
+// concurrently are never interleaved with the sequence.
+//
+// Example:
+//
+//	<-hsm.DispatchSeq(ctx, sm, hsm.Event{Name: "open"}, hsm.Event{Name: "write"}, hsm.Event{Name: "close"})
+func DispatchSeq(ctx context.Context, hsm Instance, events ...Event) <-chan struct{} {
+	return hsm.dispatch(ctx, false, events...)
+}
+
+// DispatchCallback sends an event to a state machine instance and calls callback once it has been
+// processed, with the instance's state at that time, for callback-style integrations. The callback
+// runs on its own goroutine. If ctx is done before the event has been processed, callback is called
+// with the current state and ctx.Err() instead; the event may still be processed afterwards.
+// The callback is called exactly once.
+//
+// Example:
+//
+//	hsm.DispatchCallback(ctx, sm, hsm.Event{Name: "start"}, func(state string, err error) {
+//	    if err != nil {
+//	        log.Printf("start not processed: %v", err)
+//	        return
+//	    }
+//	    log.Printf("started in %s", state)
+//	})
+func DispatchCallback(ctx context.Context, hsm Instance, event Event, callback func(state string, err error)) {
+	done := hsm.Dispatch(ctx, event)
+	go func() {
+		select {
+		case <-done:
+			callback(hsm.State(), nil)
+		case <-ctx.Done():
+			callback(hsm.State(), ctx.Err())
+		}
+	}()
+}
+
+/******* Transactions *******/
+
+// Tx stages the dispatches of a Transaction.
+type Tx struct {
+	instances []Instance
+	events    map[Instance][]Event
+}
+
+// Dispatch stages an event for the given instance. Nothing is dispatched until the transaction
+// commits, and events staged for the same instance are applied in order.
+func (tx *Tx) Dispatch(hsm Instance, event Event) {
+	if tx == nil || hsm == nil {
+		return
+	}
+	if event.Kind == 0 {
+		event.Kind = kind.Event
+	}
+	if _, ok := tx.events[hsm]; !ok {
+		tx.instances = append(tx.instances, hsm)
+	}
+	tx.events[hsm] = append(tx.events[hsm], event)
+}
+
+// Transaction dispatches events to several instances all together or not at all. The function
+// stages dispatches with tx.Dispatch; if it returns an error nothing is dispatched and the error is
+// returned. Otherwise every instance is held idle while each staged event is checked against the
+// instance's current state: the event must fire a transition whose guard passes. Only if all of them
+// do are the events dispatched, ahead of any dispatched concurrently, and Transaction returns once
+// they have been processed. If any is not accepted nothing is dispatched and Transaction returns
+// an error wrapping ErrTxRejected.
+//
+// Guards are evaluated twice, once to decide and again when the events are processed, against the
+// states the instances were in when the transaction began. Guards of events staged for the same
+// instance do not see the effect of the earlier events. Effects can still fail after the commit,
+// there is no rollback of behaviors that already ran. Behaviors of the instances involved must not
+// wait for each other while a transaction holds them.
+//
+// Example:
+//
+//	err := hsm.Transaction(ctx, func(tx *hsm.Tx) error {
+//		tx.Dispatch(from, hsm.Event{Name: "debit", Data: amount})
+//		tx.Dispatch(to, hsm.Event{Name: "credit", Data: amount})
+//		return nil
+//	})
+//	if errors.Is(err, hsm.ErrTxRejected) {
+//		// neither account changed
+//	}
+func Transaction(ctx context.Context, fn func(tx *Tx) error) error {
+	tx := &Tx{events: map[Instance][]Event{}}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	// hold instances in a consistent order so concurrent transactions cannot deadlock
+	instances := slices.Clone(tx.instances)
+	slices.SortStableFunc(instances, func(a, b Instance) int {
+		return strings.Compare(ID(a), ID(b))
+	})
+	held := make([]Instance, 0, len(instances))
+	release := func() {
+		for _, instance := range held {
+			instance.release()
+		}
+	}
+	for _, instance := range instances {
+		if !instance.hold(ctx) {
+			release()
+			return fmt.Errorf("%w: %s is not running", ErrTxRejected, ID(instance))
+		}
+		held = append(held, instance)
+	}
+	for _, instance := range instances {
+		for _, event := range tx.events[instance] {
+			if !instance.accepts(ctx, &event) {
+				release()
+				return fmt.Errorf("%w: %s does not accept %s in %s", ErrTxRejected, ID(instance), event.Name, instance.State())
+			}
+		}
+	}
+	done := make([]<-chan struct{}, 0, len(instances))
+	for _, instance := range instances {
+		done = append(done, instance.apply(ctx, tx.events[instance]))
+	}
+	for _, ch := range done {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// DispatchAll sends an event to all state machine instances in the current context.
 // Returns a channel that closes when all instances have processed the event.
 //
 // Example:
@@ -1992,17 +5494,28 @@ func DispatchTo(ctx context.Context, event Event, maybeIds ...string) <-chan str
 	if !ok || instances == nil {
 		return closedChannel
 	}
+	return dispatchTo(ctx, instances, event, maybeIds...)
+}
+
+func dispatchTo(ctx context.Context, instances *sync.Map, event Event, maybeIds ...string) <-chan struct{} {
 	signal := make(chan struct{})
 	go func(signal chan struct{}) {
 		defer close(signal)
 		signals := make(map[string]<-chan struct{})
+		targets := []Instance{}
 		instances.Range(func(key, value any) bool {
 			snapshot := value.(Instance).takeSnapshot()
 			if len(maybeIds) == 0 || Match(snapshot.ID, maybeIds...) {
-				signals[key.(string)] = value.(Instance).Dispatch(ctx, event)
+				targets = append(targets, value.(Instance))
 			}
 			return true
 		})
+		if deterministic(ctx) {
+			sortById(targets)
+		}
+		for _, target := range targets {
+			signals[ID(target)] = target.Dispatch(ctx, event)
+		}
 		for len(signals) > 0 {
 			for i, ch := range signals {
 				select {
@@ -2017,13 +5530,146 @@ func DispatchTo(ctx context.Context, event Event, maybeIds ...string) <-chan str
 	return signal
 }
 
+// Strategy chooses the single instance DispatchOne sends an event to.
+type Strategy int
+
+const (
+	// RoundRobin cycles through the candidate instances in ID order.
+	RoundRobin Strategy = iota
+	// Random picks a candidate instance uniformly at random.
+	Random
+	// LeastQueued picks the candidate instance with the fewest queued events, see Snapshot.QueueLen.
+	// Ties are broken in round-robin order.
+	LeastQueued
+)
+
+// cursorKey binds the round-robin position of DispatchOne to the context, next to the instances map
+// it belongs to, so that it is collected along with the contexts that use it.
+var cursorKey = key[*atomic.Uint64]{}
+
+// DispatchOne sends an event to a single instance in the context, chosen by strategy among those
+// whose ID matches one of the patterns, or among all of them if none are given, e.g. to hand each
+// task to one of many worker instances. DispatchTo sends it to all of them instead.
+// Returns a channel that closes when the chosen instance has processed the event, or immediately
+// if there is no candidate.
+//
+// Example:
+//
+//	<-hsm.DispatchOne(ctx, hsm.Event{Name: "task", Data: task}, hsm.LeastQueued, "worker-*")
+func DispatchOne(ctx context.Context, event Event, strategy Strategy, maybeIds ...string) <-chan struct{} {
+	instances, ok := ctx.Value(Keys.Instances).(*sync.Map)
+	if !ok || instances == nil {
+		return closedChannel
+	}
+	cursor, ok := ctx.Value(cursorKey).(*atomic.Uint64)
+	if !ok {
+		// an instances map put in the context by hand has no position, start anywhere
+		cursor = &atomic.Uint64{}
+		cursor.Store(rand.Uint64())
+	}
+	return dispatchOne(ctx, instances, cursor, event, strategy, maybeIds...)
+}
+
+func dispatchOne(ctx context.Context, instances *sync.Map, cursor *atomic.Uint64, event Event, strategy Strategy, maybeIds ...string) <-chan struct{} {
+	candidates := []Instance{}
+	instances.Range(func(key, value any) bool {
+		if instance, ok := value.(Instance); ok && (len(maybeIds) == 0 || Match(ID(instance), maybeIds...)) {
+			candidates = append(candidates, instance)
+		}
+		return true
+	})
+	if len(candidates) == 0 {
+		return closedChannel
+	}
+	sortById(candidates)
+	var target Instance
+	switch strategy {
+	case Random:
+		target = candidates[rand.Intn(len(candidates))]
+	case LeastQueued:
+		start := int((cursor.Add(1) - 1) % uint64(len(candidates)))
+		least := -1
+		for i := range candidates {
+			candidate := candidates[(start+i)%len(candidates)]
+			if queued := candidate.takeSnapshot().QueueLen; least < 0 || queued < least {
+				target, least = candidate, queued
+			}
+		}
+	default:
+		target = candidates[(cursor.Add(1)-1)%uint64(len(candidates))]
+	}
+	return target.Dispatch(ctx, event)
+}
+
+// Registry is an explicit handle on the instances map that Start registers instances in, so events
+// can be routed to instances by ID from code whose context does not derive from theirs, e.g. an
+// HTTP handler running under a request context.
+//
+// Example:
+//
+//	registry := hsm.NewRegistry()
+//	sm := hsm.Start(registry.Context(context.Background()), &Order{}, &model, hsm.Config{ID: "order-1"})
+//	// later, in a request handler
+//	<-registry.DispatchTo(r.Context(), hsm.Event{Name: "cancel"}, "order-1")
+type Registry struct {
+	instances *sync.Map
+	cursor    *atomic.Uint64 // round-robin position of DispatchOne
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{instances: &sync.Map{}, cursor: &atomic.Uint64{}}
+}
+
+// RegistryFromContext returns the registry of the instances map in the context, which is the one
+// instances started from ctx are registered in.
+func RegistryFromContext(ctx context.Context) (*Registry, bool) {
+	instances, ok := ctx.Value(Keys.Instances).(*sync.Map)
+	if !ok || instances == nil {
+		return nil, false
+	}
+	cursor, ok := ctx.Value(cursorKey).(*atomic.Uint64)
+	if !ok {
+		cursor = &atomic.Uint64{}
+	}
+	return &Registry{instances: instances, cursor: cursor}, true
+}
+
+// Context returns a copy of ctx that carries the registry, instances started from it are registered in the registry.
+func (registry *Registry) Context(ctx context.Context) context.Context {
+	return context.WithValue(context.WithValue(ctx, Keys.Instances, registry.instances), cursorKey, registry.cursor)
+}
+
+// Get returns the running instance with the given ID.
+func (registry *Registry) Get(id string) (Instance, bool) {
+	value, ok := registry.instances.Load(id)
+	if !ok {
+		return nil, false
+	}
+	instance, ok := value.(Instance)
+	return instance, ok
+}
+
+// DispatchTo sends an event to the instances of the registry whose ID matches one of the patterns,
+// or to all of them if none are given, as DispatchTo does for the instances in a context.
+// Returns a channel that closes when all targeted instances have processed the event.
+func (registry *Registry) DispatchTo(ctx context.Context, event Event, maybeIds ...string) <-chan struct{} {
+	return dispatchTo(ctx, registry.instances, event, maybeIds...)
+}
+
+// DispatchOne sends an event to a single instance of the registry chosen by strategy, as DispatchOne
+// does for the instances in a context.
+// Returns a channel that closes when the chosen instance has processed the event.
+func (registry *Registry) DispatchOne(ctx context.Context, event Event, strategy Strategy, maybeIds ...string) <-chan struct{} {
+	return dispatchOne(ctx, registry.instances, registry.cursor, event, strategy, maybeIds...)
+}
+
 func Propagate(ctx context.Context, event Event) <-chan struct{} {
 	hsm, ok := FromContext(ctx)
 	if !ok {
 		return closedChannel
 	}
-	active := hsm.Context()
-	owner, ok := FromContext(active.context)
+	owner, ok := Parent(hsm)
 	if !ok {
 		return closedChannel
 	}
@@ -2039,10 +5685,10 @@ func PropagateAll(ctx context.Context, event Event) <-chan struct{} {
 	go func() {
 		defer close(signal)
 		signals := make(map[any]<-chan struct{})
-		active, ok := FromContext(hsm.Context().context)
+		active, ok := Parent(hsm)
 		for ok {
 			signals[active] = active.Dispatch(ctx, event)
-			active, ok = FromContext(active.Context().context)
+			active, ok = Parent(active)
 		}
 		for len(signals) > 0 {
 			for i, ch := range signals {
@@ -2103,6 +5749,145 @@ func FromContext(ctx context.Context) (Instance, bool) {
 	return nil, false
 }
 
+// Parent returns the instance the state machine was started under, i.e. the one whose context was
+// passed to Start, as Propagate dispatches to. Returns false for top-level instances.
+//
+// Example:
+//
+//	child := hsm.Start(parent.Context(), &Worker{}, &workerModel)
+//	if owner, ok := hsm.Parent(child); ok {
+//	    log.Printf("started by %s", hsm.ID(owner))
+//	}
+func Parent(hsm Instance) (Instance, bool) {
+	if hsm == nil {
+		return nil, false
+	}
+	active := hsm.Context()
+	if active == nil || active.context == nil {
+		return nil, false
+	}
+	return FromContext(active.context)
+}
+
+// ActiveConfig returns the active configuration of the state machine processing the event, from the
+// outermost active state down to the current leaf state. It is meant to be called from guards and
+// behaviors with the context they receive; during a transition it reflects the configuration the
+// transition started from. Returns nil if ctx is not associated with a state machine.
+//
+// Example:
+//
+//	hsm.Guard(func(ctx context.Context, sm *MyHSM, event hsm.Event) bool {
+//	    return slices.Contains(hsm.ActiveConfig(ctx), "/operational")
+//	})
+func ActiveConfig(ctx context.Context) []string {
+	instance, ok := ctx.Value(processingKey).(Instance)
+	if !ok {
+		if instance, ok = FromContext(ctx); !ok {
+			return nil
+		}
+	}
+	return configuration(instance.State())
+}
+
+// TurnScratch returns a scratch space shared by the guards and behaviors of the current processing
+// turn, e.g. to memoize an expensive computation across a cascade of transitions without storing it
+// on the instance. A fresh, empty map is used for every turn, a turn being one run of the processing
+// loop until the queue is empty. Returns nil if ctx does not come from a processing turn.
+//
+// Example:
+//
+//	hsm.Effect(func(ctx context.Context, sm *MyHSM, event hsm.Event) {
+//	    scratch := hsm.TurnScratch(ctx)
+//	    quote, ok := scratch.Load("quote")
+//	    if !ok {
+//	        quote = sm.expensiveQuote()
+//	        scratch.Store("quote", quote)
+//	    }
+//	})
+func TurnScratch(ctx context.Context) *sync.Map {
+	scratch, _ := ctx.Value(scratchKey).(*sync.Map)
+	return scratch
+}
+
+// WasIn reports whether the state configuration the state machine was in before its last state
+// change contained a state matching the pattern, i.e. the previous leaf state or one of its
+// ancestors. Transitions that do not change the state, such as internal transitions, do not
+// count. It is meant to be called from guards and behaviors with the context they receive.
+// Wildcards are supported.
+//
+// Example:
+//
+//	hsm.Transition(
+//	    hsm.On("back"),
+//	    hsm.Target("editor"),
+//	    hsm.Guard(func(ctx context.Context, sm *MyHSM, event hsm.Event) bool {
+//	        return hsm.WasIn(ctx, "/editor")
+//	    })
+//	)
+func WasIn(ctx context.Context, pattern string) bool {
+	instance, ok := ctx.Value(processingKey).(Instance)
+	if !ok {
+		if instance, ok = FromContext(ctx); !ok {
+			return false
+		}
+	}
+	for qualifiedName := instance.previousState(); qualifiedName != "/" && qualifiedName != "." && qualifiedName != ""; qualifiedName = path.Dir(qualifiedName) {
+		if Match(qualifiedName, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// configuration returns the states from the root down to the given leaf, excluding the root.
+func configuration(leaf string) []string {
+	configuration := []string{}
+	for qualifiedName := leaf; qualifiedName != "/" && qualifiedName != "." && qualifiedName != ""; qualifiedName = path.Dir(qualifiedName) {
+		configuration = append([]string{qualifiedName}, configuration...)
+	}
+	return configuration
+}
+
+// StatesEqual reports whether two instances have the same active configuration and the same
+// pending events, e.g. to assert that replicas converged. See StateDiff.
+//
+// Example:
+//
+//	if !hsm.StatesEqual(replicas[0], replicas[1]) {
+//	    t.Fatal(hsm.StateDiff(replicas[0], replicas[1]))
+//	}
+func StatesEqual(a, b Instance) bool {
+	return StateDiff(a, b) == ""
+}
+
+// StateDiff describes how the active configurations and pending events of two instances differ,
+// for test failure messages. Pending events are compared by name in processing order.
+// It returns an empty string if they are equal. The instances are read one after the other, so
+// they should be idle, e.g. after waiting on their dispatches, for the result to be meaningful.
+//
+// Example:
+//
+//	if diff := hsm.StateDiff(leader, follower); diff != "" {
+//	    t.Fatalf("replicas diverged:\n%s", diff)
+//	}
+func StateDiff(a, b Instance) string {
+	var diff strings.Builder
+	if configurationA, configurationB := configuration(a.State()), configuration(b.State()); !slices.Equal(configurationA, configurationB) {
+		fmt.Fprintf(&diff, "active configuration: %v != %v\n", configurationA, configurationB)
+	}
+	names := func(events []Event) []string {
+		names := make([]string, len(events))
+		for i, event := range events {
+			names[i] = event.Name
+		}
+		return names
+	}
+	if queueA, queueB := names(a.pending()), names(b.pending()); !slices.Equal(queueA, queueB) {
+		fmt.Fprintf(&diff, "pending events: %v != %v\n", queueA, queueB)
+	}
+	return diff.String()
+}
+
 func InstancesFromContext(ctx context.Context) ([]Instance, bool) {
 	instancesPointer, ok := ctx.Value(Keys.Instances).(*sync.Map)
 	if !ok || instancesPointer == nil {
@@ -2113,9 +5898,103 @@ func InstancesFromContext(ctx context.Context) ([]Instance, bool) {
 		instances = append(instances, value.(Instance))
 		return true
 	})
+	if deterministic(ctx) {
+		sortById(instances)
+	}
 	return instances, true
 }
 
+// InstanceCount returns the number of running instances registered in the instances map of the
+// context, or of the instance processing the event when called from a guard or behavior. The count
+// includes the instance itself. It is cheap enough for guards, e.g. to scale up only while under
+// capacity.
+//
+// Example:
+//
+//	hsm.Transition(hsm.On("spawn"), hsm.Guard(func(ctx context.Context, sm *Supervisor, event hsm.Event) bool {
+//	    return hsm.InstanceCount(ctx) < sm.capacity
+//	}), hsm.Effect(spawnWorker))
+func InstanceCount(ctx context.Context) int {
+	instances, ok := registry(ctx)
+	if !ok {
+		return 0
+	}
+	count := 0
+	instances.Range(func(key, value any) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// SnapshotOf returns a snapshot of the instance with the given ID registered in the instances map
+// of the context, or of the instance processing the event when called from a guard or behavior,
+// e.g. for a guard that only lets a follower proceed while its leader is active. The snapshot is a
+// point-in-time read of an instance processing events concurrently, so the state may have changed
+// by the time it is used; guards should treat it as advisory. Returns false if no such instance is
+// registered.
+//
+// Example:
+//
+//	hsm.Guard(func(ctx context.Context, sm *Follower, event hsm.Event) bool {
+//	    leader, ok := hsm.SnapshotOf(ctx, sm.leaderID)
+//	    return ok && leader.State == "/active"
+//	})
+func SnapshotOf(ctx context.Context, id string) (Snapshot, bool) {
+	instances, ok := registry(ctx)
+	if !ok {
+		return Snapshot{}, false
+	}
+	value, ok := instances.Load(id)
+	if !ok {
+		return Snapshot{}, false
+	}
+	instance, ok := value.(Instance)
+	if !ok {
+		return Snapshot{}, false
+	}
+	return instance.takeSnapshot(), true
+}
+
+// registry returns the instances map of the context, falling back to the one of the instance
+// processing the event, since behaviors receive the dispatcher's context.
+func registry(ctx context.Context) (*sync.Map, bool) {
+	instances, ok := ctx.Value(Keys.Instances).(*sync.Map)
+	if !ok {
+		if instance, processing := ctx.Value(processingKey).(Instance); processing {
+			instances, ok = instance.Context().Value(Keys.Instances).(*sync.Map)
+		}
+	}
+	return instances, ok && instances != nil
+}
+
+// InstancesOfModel returns the instances registered in the context that were started from the given model,
+// for processes hosting several distinct state machine definitions.
+//
+// Example:
+//
+//	for _, order := range hsm.InstancesOfModel(ctx, &orderModel) {
+//	    order.Dispatch(ctx, hsm.Event{Name: "cancel"})
+//	}
+func InstancesOfModel(ctx context.Context, model *Model) []Instance {
+	instances, _ := InstancesFromContext(ctx)
+	return slices.DeleteFunc(instances, func(instance Instance) bool {
+		return instance.definition() != model
+	})
+}
+
+// deterministic reports whether the instance bound to ctx was started with Config.Deterministic.
+func deterministic(ctx context.Context) bool {
+	instance, ok := FromContext(ctx)
+	return ok && instance.deterministic()
+}
+
+func sortById(instances []Instance) {
+	slices.SortFunc(instances, func(a, b Instance) int {
+		return strings.Compare(ID(a), ID(b))
+	})
+}
+
 // Stop gracefully stops a state machine instance.
 // It cancels any running activities and prevents further event processing.
 //
@@ -2128,25 +6007,1311 @@ func Stop(ctx context.Context, hsm Instance) <-chan struct{} {
 	return hsm.stop(ctx)
 }
 
-func Restart(ctx context.Context, hsm Instance, maybeData ...any) <-chan struct{} {
-	return hsm.restart(ctx, maybeData...)
+// Closer returns an io.Closer whose Close stops the instance as with Stop and waits for it, so that
+// instances can be stopped with defer like other resources. Close always returns nil.
+//
+// Example:
+//
+//	sm := hsm.Start(ctx, &MyHSM{}, &model)
+//	defer hsm.Closer(sm).Close()
+func Closer(hsm Instance) io.Closer {
+	return closer{instance: hsm}
 }
 
-func ID(hsm Instance) string {
-	snapshot := hsm.takeSnapshot()
-	return snapshot.ID
+type closer struct {
+	instance Instance
 }
 
-func QualifiedName(hsm Instance) string {
-	snapshot := hsm.takeSnapshot()
-	return snapshot.QualifiedName
+func (closer closer) Close() error {
+	<-closer.instance.stop(context.Background())
+	return nil
 }
 
-func Name(hsm Instance) string {
-	snapshot := hsm.takeSnapshot()
-	return path.Base(snapshot.QualifiedName)
+// Drain gracefully stops a state machine instance. New events are rejected immediately,
+// events that are already queued are processed, and then the instance is stopped as with Stop.
+// Returns a channel that closes once the instance has stopped.
+//
+// Example:
+//
+//	<-hsm.Drain(ctx, sm) // let in-flight work complete before a deploy
+func Drain(ctx context.Context, hsm Instance) <-chan struct{} {
+	return hsm.drain(ctx)
 }
 
-func TakeSnapshot(ctx context.Context, hsm Instance) Snapshot {
-	return hsm.takeSnapshot()
+// Timing returns the lifecycle timestamps of a state machine instance.
+//
+// Example:
+//
+//	if time.Since(hsm.Timing(sm).LastActivityAt()) > time.Hour {
+//	    <-hsm.Stop(ctx, sm) // reap abandoned sessions
+//	}
+func Timing(hsm Instance) InstanceTiming {
+	return hsm.timing()
+}
+
+// TransitionCounts returns how many times each transition was taken since the instance was started
+// or restarted, keyed by the transition's qualified name. Transitions that were never taken are absent.
+// A count climbing quickly while the state barely changes hints at a transition loop.
+//
+// Example:
+//
+//	for name, count := range hsm.TransitionCounts(sm) {
+//	    log.Printf("%s: %d", name, count)
+//	}
+func TransitionCounts(hsm Instance) map[string]uint64 {
+	return hsm.transitionCounts()
+}
+
+// OnTransitionNamed returns a channel that receives the triggering event every time the transition
+// with the given qualified name is taken, e.g. to let external systems react to a business event
+// without watching state changes. Events are dropped rather than blocking the state machine if the
+// receiver falls more than a few events behind. The channel is closed when the instance stops.
+//
+// Example:
+//
+//	captured := hsm.OnTransitionNamed(sm, "/authorized/payment_captured")
+//	for event := range captured {
+//	    ledger.Record(event.Data)
+//	}
+func OnTransitionNamed(hsm Instance, qualifiedName string) <-chan Event {
+	return hsm.subscribe(qualifiedName)
+}
+
+// DeferredEvents returns the events the instance currently holds because its active states defer
+// them, in the order they were deferred. They are queued again on the next transition. An event
+// missing from the queue and from the handled events may be here, e.g. when debugging why an
+// event is not handled.
+//
+// Example:
+//
+//	for _, event := range hsm.DeferredEvents(sm) {
+//	    log.Printf("%s is deferred in %s", event.Name, sm.State())
+//	}
+func DeferredEvents(hsm Instance) []Event {
+	return hsm.deferredEvents()
+}
+
+// Termination reports why a state machine instance stopped, or NotTerminated while it is running.
+//
+// Example:
+//
+//	if hsm.Termination(sm) == hsm.DeadlineExceeded {
+//	    log.Println("session expired")
+//	}
+func Termination(hsm Instance) TerminationReason {
+	return hsm.termination()
+}
+
+// Restart stops a state machine instance and starts it again from its initial state, passing the
+// optional data to the initial transition as the initial event's data. Restart resets the current
+// state, the instance context, active activities and timers, pending event counters, the queue
+// high-water mark and the termination reason. It does not reset the fields of the user struct,
+// which is reused as is; use RestartClean for a clean slate.
+// Returns a channel that closes once the initial transition has completed.
+//
+// Example:
+//
+//	<-hsm.Restart(ctx, sm)
+func Restart(ctx context.Context, hsm Instance, maybeData ...any) <-chan struct{} {
+	return hsm.restart(ctx, false, "", maybeData...)
+}
+
+// RestartAt restarts a state machine instance like Restart, but enters the state with the given
+// qualified name, and its default descendants, instead of taking the initial transition, e.g. to
+// resume a crashed job at a known checkpoint. Entry actions and activities run for every state from
+// the root down to it, with the optional data as the initial event's data.
+// Returns a channel that closes once the state has been entered, or an error wrapping
+// ErrInvalidState, leaving the instance untouched, if the model has no such state.
+//
+// Example:
+//
+//	done, err := hsm.RestartAt(ctx, job, "/running/uploading", checkpoint)
+func RestartAt(ctx context.Context, hsm Instance, qualifiedName string, maybeData ...any) (<-chan struct{}, error) {
+	if get[*state](hsm.definition(), qualifiedName) == nil || qualifiedName == "/" {
+		return closedChannel, fmt.Errorf("%w: %s", ErrInvalidState, qualifiedName)
+	}
+	return hsm.restart(ctx, false, qualifiedName, maybeData...), nil
+}
+
+// Resettable can be implemented by a state machine's user struct to reset its own fields.
+// Reset is called by RestartClean after the instance has stopped and before it starts again.
+type Resettable interface {
+	Reset()
+}
+
+// RestartClean restarts a state machine instance like Restart, but first calls Reset on the user
+// struct if it implements Resettable, so no field values carry over. The optional fresh data is
+// passed to the initial transition as the initial event's data, where entry actions or effects
+// can use it to repopulate the struct.
+//
+// Example:
+//
+//	func (sm *Order) Reset() { sm.items = nil; sm.total = 0 }
+//
+//	<-hsm.RestartClean(ctx, order, freshOrder)
+func RestartClean(ctx context.Context, hsm Instance, maybeData ...any) <-chan struct{} {
+	return hsm.restart(ctx, true, "", maybeData...)
+}
+
+// RestartActivities terminates and re-executes the activities of the current state in place,
+// without exiting or re-entering the state, so no exit or entry actions run.
+// Restarted activities receive an event named "hsm_restart_activities".
+// Returns a channel that closes once the activities have been restarted.
+//
+// Example:
+//
+//	<-hsm.RestartActivities(ctx, sm) // e.g. reconnect websocket activities
+func RestartActivities(ctx context.Context, hsm Instance) <-chan struct{} {
+	return hsm.restartActivities(ctx)
+}
+
+// ActiveContexts returns the sorted qualified names of the activities that are currently running,
+// e.g. to persist them alongside the current state. It waits for the current processing turn to
+// finish, so it must not be called from the instance's own behaviors.
+//
+// Example:
+//
+//	saved := hsm.ActiveContexts(sm)
+func ActiveContexts(hsm Instance) []string {
+	return hsm.activeContexts()
+}
+
+// ReactivateContexts starts the given activities again, typically names saved with ActiveContexts,
+// when restoring an instance whose states have long-running activities that must resume.
+// An activity is only started if it belongs to a state of the current active configuration and is
+// not already running; other names are ignored. Entry actions do not run again, and the activities
+// receive an event named "hsm_reactivate".
+// Returns a channel that closes once the activities have been started.
+//
+// Example:
+//
+//	<-hsm.ReactivateContexts(ctx, sm, saved...)
+func ReactivateContexts(ctx context.Context, hsm Instance, qualifiedNames ...string) <-chan struct{} {
+	return hsm.reactivate(ctx, qualifiedNames)
+}
+
+// DispatchCompletion signals that the current state of the instance is done by dispatching its
+// completion event, which fires the state's OnCompletion transitions. Completion events are queued
+// ahead of regular events. If the state changed by the time the event is processed, or the state
+// has no completion transition, the event is dropped.
+// It is meant for activities and code outside the instance, entry actions run before their state
+// becomes current and would signal the completion of the previous state.
+// Returns a channel that closes when the event has been processed.
+//
+// Example:
+//
+//	hsm.Activity(func(ctx context.Context, job *Job, event hsm.Event) {
+//	    job.run(ctx)
+//	    hsm.DispatchCompletion(ctx, job)
+//	})
+func DispatchCompletion(ctx context.Context, hsm Instance) <-chan struct{} {
+	return hsm.Dispatch(ctx, Event{
+		Name: path.Join(hsm.State(), completion),
+		Kind: kind.CompletionEvent,
+	})
+}
+
+// Replay dispatches recorded events to an instance, honoring their original inter-arrival times
+// scaled by speed: 1 replays in real time, 0.5 twice as fast and 0 as fast as possible.
+// Time, completion and error events are skipped since the instance generates them itself. Timers of
+// After, Every and Idle run on the wall clock and are not scaled, so compressed replays fire them
+// relatively later than in the recording.
+// Returns a channel that closes once the last event has been processed or ctx is done.
+//
+// Example:
+//
+//	replica := hsm.Start(ctx, &Session{}, &model)
+//	<-hsm.Replay(ctx, replica, recorder.Records(), 0.1)
+func Replay(ctx context.Context, hsm Instance, records []Record, speed float64) <-chan struct{} {
+	signal := make(chan struct{})
+	go func() {
+		defer close(signal)
+		var done <-chan struct{} = closedChannel
+		var previous time.Time
+		for _, record := range records {
+			if kind.IsKind(record.Event.Kind, kind.TimeEvent, kind.CompletionEvent, kind.ErrorEvent) {
+				continue
+			}
+			if !previous.IsZero() && speed > 0 {
+				timer := time.NewTimer(time.Duration(float64(record.At.Sub(previous)) * speed))
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				}
+			}
+			previous = record.At
+			event := record.Event
+			// the instance assigns new IDs
+			event.Id = 0
+			done = hsm.Dispatch(ctx, event)
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}()
+	return signal
+}
+
+/******* Metrics *******/
+
+// MetricType is the type of a Metric, named after the Prometheus metric types.
+type MetricType int
+
+const (
+	CounterMetric MetricType = iota
+	GaugeMetric
+)
+
+// Metric is a sample reported by Collector, shaped after a Prometheus sample so that it converts
+// directly, e.g. with prometheus.MustNewConstMetric.
+type Metric struct {
+	Name   string
+	Help   string
+	Type   MetricType
+	Labels map[string]string
+	Value  float64
+}
+
+// Collector gathers the metrics of the instances started with it as Config.Collector:
+//
+//   - hsm_transitions_total{instance, transition}: counter of transitions taken.
+//   - hsm_state{instance, state}: gauge set to 1 for the current state of each instance.
+//   - hsm_queue_depth{instance}: gauge of queued events.
+//   - hsm_processing_seconds_sum{instance} and hsm_processing_seconds_count{instance}: counters of the
+//     time spent processing events and of the events processed.
+//
+// The instance label is the instance ID. Instances are removed from the collector when they stop.
+// It does not depend on a metrics library, Collect feeds any exporter, e.g. a prometheus.Collector
+// adapter.
+//
+// Example:
+//
+//	collector := hsm.NewCollector()
+//	sm := hsm.Start(ctx, &Order{}, &model, hsm.Config{Collector: collector})
+//
+//	// in an adapter implementing prometheus.Collector
+//	func (adapter *adapter) Collect(ch chan<- prometheus.Metric) {
+//	    adapter.collector.Collect(func(metric hsm.Metric) {
+//	        ch <- toPrometheus(metric)
+//	    })
+//	}
+type Collector struct {
+	mutex     sync.Mutex
+	instances map[string]Instance
+	durations map[string]*processingDurations
+}
+
+type processingDurations struct {
+	count uint64
+	sum   time.Duration
+}
+
+// NewCollector creates a collector without instances.
+func NewCollector() *Collector {
+	return &Collector{
+		instances: map[string]Instance{},
+		durations: map[string]*processingDurations{},
+	}
+}
+
+func (collector *Collector) add(instance Instance) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	collector.instances[ID(instance)] = instance
+	collector.durations[ID(instance)] = &processingDurations{}
+}
+
+func (collector *Collector) remove(instance Instance) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	delete(collector.instances, ID(instance))
+	delete(collector.durations, ID(instance))
+}
+
+func (collector *Collector) observe(instance Instance, elapsed time.Duration) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	if durations, ok := collector.durations[ID(instance)]; ok {
+		durations.count++
+		durations.sum += elapsed
+	}
+}
+
+// Collect calls emit with the current metrics of every instance, ordered by instance ID.
+func (collector *Collector) Collect(emit func(Metric)) {
+	collector.mutex.Lock()
+	instances := make([]Instance, 0, len(collector.instances))
+	for _, instance := range collector.instances {
+		instances = append(instances, instance)
+	}
+	durations := make(map[string]processingDurations, len(collector.durations))
+	for id, observed := range collector.durations {
+		durations[id] = *observed
+	}
+	collector.mutex.Unlock()
+	sortById(instances)
+	for _, instance := range instances {
+		id := ID(instance)
+		counts := instance.transitionCounts()
+		transitions := make([]string, 0, len(counts))
+		for transition := range counts {
+			transitions = append(transitions, transition)
+		}
+		slices.Sort(transitions)
+		for _, transition := range transitions {
+			emit(Metric{Name: "hsm_transitions_total", Help: "Transitions taken.", Type: CounterMetric, Labels: map[string]string{"instance": id, "transition": transition}, Value: float64(counts[transition])})
+		}
+		snapshot := instance.takeSnapshot()
+		emit(Metric{Name: "hsm_state", Help: "Current state.", Type: GaugeMetric, Labels: map[string]string{"instance": id, "state": snapshot.State}, Value: 1})
+		emit(Metric{Name: "hsm_queue_depth", Help: "Queued events.", Type: GaugeMetric, Labels: map[string]string{"instance": id}, Value: float64(snapshot.QueueLen)})
+		emit(Metric{Name: "hsm_processing_seconds_sum", Help: "Time spent processing events.", Type: CounterMetric, Labels: map[string]string{"instance": id}, Value: durations[id].sum.Seconds()})
+		emit(Metric{Name: "hsm_processing_seconds_count", Help: "Events processed.", Type: CounterMetric, Labels: map[string]string{"instance": id}, Value: float64(durations[id].count)})
+	}
+}
+
+// Metrics returns the current metrics of every instance, as passed to Collect.
+func (collector *Collector) Metrics() []Metric {
+	metrics := []Metric{}
+	collector.Collect(func(metric Metric) {
+		metrics = append(metrics, metric)
+	})
+	return metrics
+}
+
+/******* Tracing *******/
+
+// Tracer is an EventObserver that records a timeline of the events processed by the instances it
+// observes: the event, the state it was processed in, the state it left the instance in, how it was
+// handled and how long processing took. WriteTo writes the timeline in the Chrome trace event
+// format, which chrome://tracing and Perfetto open as one track per instance, so a trace is a
+// self-contained artifact to attach to a bug report. It is safe for concurrent use.
+//
+// The tracer keeps the most recent MaxTraceSpans spans in memory and discards older ones, so it can
+// observe long-running instances; TraceToFile streams every span to a file instead.
+//
+// Example:
+//
+//	tracer := hsm.NewTracer()
+//	sm := hsm.Start(ctx, &Order{}, &model, hsm.Config{EventObserver: tracer})
+//	...
+//	tracer.WriteTo(file)
+type Tracer struct {
+	mutex   sync.Mutex
+	began   time.Time
+	threads map[string]int // instance ID -> track
+	turns   map[string]*traceTurn
+	spans   []traceSpan // ring of the most recent spans, oldest at next once full
+	next    int
+	// stream receives the spans instead of the ring, and the tracks as they are first seen
+	stream func(event traceEvent)
+}
+
+// MaxTraceSpans is the number of spans a Tracer keeps in memory.
+const MaxTraceSpans = 1 << 16
+
+// traceTurn is what is known so far about the event an instance is processing.
+type traceTurn struct {
+	began    time.Time
+	from, to string
+	outcome  string
+}
+
+type traceSpan struct {
+	thread   int
+	event    Event
+	began    time.Time
+	duration time.Duration
+	from, to string
+	outcome  string // handled, deferred, ignored or dropped
+}
+
+// NewTracer creates a tracer whose timeline starts now.
+func NewTracer() *Tracer {
+	return &Tracer{
+		began:   time.Now(),
+		threads: map[string]int{},
+		turns:   map[string]*traceTurn{},
+	}
+}
+
+// turn returns the event being processed by the instance. The caller must hold the mutex.
+func (tracer *Tracer) turn(hsm Instance) *traceTurn {
+	id := ID(hsm)
+	turn, ok := tracer.turns[id]
+	if !ok {
+		turn = &traceTurn{}
+		tracer.turns[id] = turn
+	}
+	return turn
+}
+
+// Queued starts timing an event queued while the instance is idle. Events queued while it is busy
+// are processed one after the other, so their processing starts when the previous one's ends.
+func (tracer *Tracer) Queued(_ context.Context, hsm Instance, _ Event) {
+	if IsProcessing(hsm) {
+		return
+	}
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	tracer.turn(hsm).began = time.Now()
+}
+
+func (tracer *Tracer) Handled(_ context.Context, hsm Instance, _ Event, from, to string) {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	turn := tracer.turn(hsm)
+	turn.outcome, turn.from, turn.to = "handled", from, to
+}
+
+func (tracer *Tracer) Deferred(_ context.Context, hsm Instance, _ Event) {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	tracer.turn(hsm).outcome = "deferred"
+}
+
+func (tracer *Tracer) Dropped(ctx context.Context, hsm Instance, _ Event) {
+	// events rejected by Dispatch are never processed
+	if ctx.Value(processingKey) != hsm {
+		return
+	}
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	tracer.turn(hsm).outcome = "dropped"
+}
+
+// Processed records the span of the event, events neither handled, deferred nor dropped were ignored.
+func (tracer *Tracer) Processed(_ context.Context, hsm Instance, event Event) {
+	now := time.Now()
+	state := hsm.State()
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	id := ID(hsm)
+	thread, ok := tracer.threads[id]
+	if !ok {
+		thread = len(tracer.threads) + 1
+		tracer.threads[id] = thread
+		if tracer.stream != nil {
+			tracer.stream(traceThread(id, thread))
+		}
+	}
+	turn := tracer.turn(hsm)
+	span := traceSpan{thread: thread, event: event, began: turn.began, from: turn.from, to: turn.to, outcome: turn.outcome}
+	if span.began.IsZero() {
+		span.began = now
+	}
+	span.duration = now.Sub(span.began)
+	if span.outcome == "" {
+		span.outcome = "ignored"
+	}
+	if span.outcome != "handled" {
+		span.from, span.to = state, state
+	}
+	switch {
+	case tracer.stream != nil:
+		tracer.stream(tracer.event(span))
+	case len(tracer.spans) < MaxTraceSpans:
+		tracer.spans = append(tracer.spans, span)
+	default:
+		tracer.spans[tracer.next] = span
+		tracer.next = (tracer.next + 1) % MaxTraceSpans
+	}
+	// the next queued event is processed right away
+	*turn = traceTurn{began: now}
+}
+
+type traceEvent struct {
+	Name      string         `json:"name"`
+	Category  string         `json:"cat,omitempty"`
+	Phase     string         `json:"ph"`
+	Timestamp float64        `json:"ts"`
+	Duration  float64        `json:"dur,omitempty"`
+	Process   int            `json:"pid"`
+	Thread    int            `json:"tid"`
+	Args      map[string]any `json:"args,omitempty"`
+}
+
+// traceThread names the track of an instance.
+func traceThread(id string, thread int) traceEvent {
+	return traceEvent{Name: "thread_name", Phase: "M", Process: 1, Thread: thread, Args: map[string]any{"name": id}}
+}
+
+// event converts a span to a complete event, with timestamps in microseconds since the tracer was created.
+func (tracer *Tracer) event(span traceSpan) traceEvent {
+	return traceEvent{
+		Name:      span.event.Name,
+		Category:  span.outcome,
+		Phase:     "X",
+		Timestamp: float64(span.began.Sub(tracer.began).Nanoseconds()) / 1e3,
+		Duration:  float64(span.duration.Nanoseconds()) / 1e3,
+		Process:   1,
+		Thread:    span.thread,
+		Args: map[string]any{
+			"id":      span.event.Id.String(),
+			"from":    span.from,
+			"to":      span.to,
+			"outcome": span.outcome,
+		},
+	}
+}
+
+// WriteTo writes the timeline recorded so far as Chrome trace event JSON, with timestamps in
+// microseconds since the tracer was created.
+func (tracer *Tracer) WriteTo(writer io.Writer) (int64, error) {
+	tracer.mutex.Lock()
+	events := make([]traceEvent, 0, len(tracer.threads)+len(tracer.spans))
+	for id, thread := range tracer.threads {
+		events = append(events, traceThread(id, thread))
+	}
+	slices.SortFunc(events, func(a, b traceEvent) int {
+		return a.Thread - b.Thread
+	})
+	for i := range tracer.spans {
+		events = append(events, tracer.event(tracer.spans[(tracer.next+i)%len(tracer.spans)]))
+	}
+	tracer.mutex.Unlock()
+	data, err := json.Marshal(struct {
+		TraceEvents     []traceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}{events, "ms"})
+	if err != nil {
+		return 0, err
+	}
+	n, err := writer.Write(data)
+	return int64(n), err
+}
+
+// TraceFile is a Tracer that streams its timeline to a file, see TraceToFile.
+type TraceFile struct {
+	*Tracer
+	file   *os.File
+	writer *bufio.Writer
+	first  bool
+	closed bool
+	err    error
+}
+
+// TraceToFile returns a Tracer that streams each span to the named file as it is recorded, rather
+// than keeping them in memory, and completes the file when closed. The file is created immediately
+// so an unwritable path is reported up front.
+//
+// Instances are observed through Config.EventObserver, which holds a single observer set when the
+// instance is started: the trace must be passed to Start and takes the place of any other observer,
+// it cannot be attached to an instance that is already running.
+//
+// Example:
+//
+//	trace, err := hsm.TraceToFile("order.trace.json")
+//	if err != nil {
+//	    return err
+//	}
+//	defer trace.Close()
+//	sm := hsm.Start(ctx, &Order{}, &model, hsm.Config{EventObserver: trace})
+func TraceToFile(filename string) (*TraceFile, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	trace := &TraceFile{Tracer: NewTracer(), file: file, writer: bufio.NewWriter(file), first: true}
+	_, trace.err = trace.writer.WriteString(`{"displayTimeUnit":"ms","traceEvents":[`)
+	trace.stream = trace.write
+	return trace, nil
+}
+
+// write appends an event to the file. The caller must hold the mutex.
+func (trace *TraceFile) write(event traceEvent) {
+	if trace.closed || trace.err != nil {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		trace.err = err
+		return
+	}
+	if !trace.first {
+		trace.writer.WriteByte(',')
+	}
+	trace.first = false
+	_, trace.err = trace.writer.Write(data)
+}
+
+// Close completes the file and closes it. Events observed afterwards are not written.
+func (trace *TraceFile) Close() error {
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	if trace.closed {
+		return trace.err
+	}
+	trace.closed = true
+	if trace.err == nil {
+		_, trace.err = trace.writer.WriteString("]}")
+	}
+	if trace.err == nil {
+		trace.err = trace.writer.Flush()
+	}
+	if err := trace.file.Close(); trace.err == nil {
+		trace.err = err
+	}
+	return trace.err
+}
+
+/******* Persistence *******/
+
+// Codec serializes the Data of events for ExportEvents and ImportEvents, see Config.Codec.
+// Decode must return a value of the type that was encoded for behaviors to keep working with it.
+type Codec interface {
+	Encode(value any) ([]byte, error)
+	Decode(data []byte) (any, error)
+}
+
+// DefaultCodec is the codec of instances whose Config.Codec is nil.
+var DefaultCodec = NewJSONCodec()
+
+// JSONCodec encodes event data as JSON tagged with the name of its registered type, so that it is
+// decoded back to the same Go type. Values of types that were not registered are decoded as
+// generic JSON values, e.g. map[string]any or float64.
+type JSONCodec struct {
+	mutex sync.RWMutex
+	names map[reflect.Type]string
+	types map[string]reflect.Type
+}
+
+// NewJSONCodec returns a JSONCodec with no registered types.
+func NewJSONCodec() *JSONCodec {
+	return &JSONCodec{names: map[reflect.Type]string{}, types: map[string]reflect.Type{}}
+}
+
+// Register records the type of sample under name. Events exported with the codec are only
+// imported correctly by a codec that registered the same names.
+//
+// Example:
+//
+//	hsm.DefaultCodec.Register("order", Order{})
+func (codec *JSONCodec) Register(name string, sample any) {
+	codec.mutex.Lock()
+	defer codec.mutex.Unlock()
+	codec.names[reflect.TypeOf(sample)] = name
+	codec.types[name] = reflect.TypeOf(sample)
+}
+
+type jsonEnvelope struct {
+	Type  string          `json:"type,omitempty"`
+	Value json.RawMessage `json:"value"`
+}
+
+func (codec *JSONCodec) Encode(value any) ([]byte, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	codec.mutex.RLock()
+	name := codec.names[reflect.TypeOf(value)]
+	codec.mutex.RUnlock()
+	return json.Marshal(jsonEnvelope{Type: name, Value: raw})
+}
+
+func (codec *JSONCodec) Decode(data []byte) (any, error) {
+	var envelope jsonEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	if envelope.Type == "" {
+		var value any
+		err := json.Unmarshal(envelope.Value, &value)
+		return value, err
+	}
+	codec.mutex.RLock()
+	typ, ok := codec.types[envelope.Type]
+	codec.mutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("hsm: unregistered event data type %q", envelope.Type)
+	}
+	value := reflect.New(typ)
+	if err := json.Unmarshal(envelope.Value, value.Interface()); err != nil {
+		return nil, err
+	}
+	return value.Elem().Interface(), nil
+}
+
+type exportedEvent struct {
+	Kind      uint64    `json:"kind"`
+	Name      string    `json:"name"`
+	Id        muid.MUID `json:"id"`
+	DedupeKey string    `json:"dedupe_key,omitempty"`
+	Data      []byte    `json:"data,omitempty"`
+}
+
+// ExportEvents serializes the events pending on the instance, including deferred events, in
+// processing order, using the instance's Config.Codec for their data. It waits for the current
+// processing turn to finish, so it must not be called from the instance's own behaviors.
+//
+// Example:
+//
+//	hsm.DefaultCodec.Register("order", Order{})
+//	saved, err := hsm.ExportEvents(sm)
+func ExportEvents(hsm Instance) ([]byte, error) {
+	return hsm.exportEvents()
+}
+
+// ImportEvents dispatches events serialized with ExportEvents, in order, decoding their data with
+// the instance's Config.Codec, e.g. to restore an instance along with the events it had pending.
+// Returns a channel that closes once the events have been processed.
+//
+// Example:
+//
+//	done, err := hsm.ImportEvents(ctx, restored, saved)
+func ImportEvents(ctx context.Context, hsm Instance, data []byte) (<-chan struct{}, error) {
+	return hsm.importEvents(ctx, data)
+}
+
+// Reparent moves a running instance under ctx, e.g. to let an instance started while handling a
+// request outlive the request under a long-lived background context. The instance keeps its
+// current state and is registered in the same instances map, but its context now derives from ctx
+// and the previous one is cancelled, including for instances that were started from it.
+// States are not exited or entered again. Running activities and idle timers cannot switch
+// contexts, so they are cancelled and started again under the new context, receiving an event
+// named "hsm_reparent"; activities that already finished are not started again and idle timers
+// start over. Pauses set with PauseActivity are kept.
+// Returns a channel that closes once the instance has been moved.
+//
+// Example:
+//
+//	sm := hsm.Start(r.Context(), &Job{}, &model)
+//	<-hsm.Reparent(sm, context.Background())
+func Reparent(hsm Instance, ctx context.Context) <-chan struct{} {
+	return hsm.reparent(ctx)
+}
+
+// PauseActivity marks the activity with the given qualified name as paused while its state stays active.
+// Pausing is cooperative: the activity blocks the next time it calls WaitIfPaused.
+// The pause is cleared when the activity is terminated, e.g. when its state is exited.
+// Returns false if the model has no activity with that name.
+//
+// Example:
+//
+//	hsm.PauseActivity(sm, "/connected/poll")
+func PauseActivity(hsm Instance, qualifiedName string) bool {
+	return hsm.pauseActivity(qualifiedName, true)
+}
+
+// ResumeActivity resumes an activity paused with PauseActivity, releasing it from WaitIfPaused.
+// Returns false if the model has no activity with that name.
+//
+// Example:
+//
+//	hsm.ResumeActivity(sm, "/connected/poll")
+func ResumeActivity(hsm Instance, qualifiedName string) bool {
+	return hsm.pauseActivity(qualifiedName, false)
+}
+
+// WaitIfPaused blocks while the calling activity is paused with PauseActivity and returns nil once it
+// is resumed, or the context's error if the activity is cancelled first. Activities call it at the top
+// of their loop; outside an activity it returns immediately.
+//
+// Example:
+//
+//	hsm.Activity(func(ctx context.Context, sm *MyHSM, event hsm.Event) {
+//	    for hsm.WaitIfPaused(ctx) == nil {
+//	        poll(ctx)
+//	    }
+//	})
+func WaitIfPaused(ctx context.Context) error {
+	activity, ok := ctx.Value(pausableKey).(pausable)
+	if !ok {
+		return ctx.Err()
+	}
+	ch, ok := activity.paused.Load(activity.qualifiedName)
+	if !ok {
+		return ctx.Err()
+	}
+	select {
+	case <-ch.(chan struct{}):
+		return ctx.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Schedule dispatches the event to the state machine processing the current event, or the one
+// bound to ctx, once delay has passed, e.g. for a one-shot reminder from an effect without modeling
+// an After transition. Unlike After, the timer is not tied to a state: it keeps running across
+// transitions until it fires, it is cancelled with the returned function, e.g. from an exit action,
+// or the instance is stopped or restarted. Outside a state machine it does nothing.
+//
+// Example:
+//
+//	hsm.Effect(func(ctx context.Context, sm *Order, event hsm.Event) {
+//	    sm.cancelReminder = hsm.Schedule(ctx, hsm.Event{Name: "remind"}, 5*time.Minute)
+//	})
+func Schedule(ctx context.Context, event Event, delay time.Duration) (cancel func()) {
+	instance, ok := ctx.Value(processingKey).(Instance)
+	if !ok {
+		if instance, ok = FromContext(ctx); !ok {
+			return func() {}
+		}
+	}
+	return instance.schedule(event, delay)
+}
+
+// SetProgress publishes the progress of the calling activity, e.g. the fraction of a file uploaded
+// so far, for status endpoints to read with Progress without the activity dispatching events. The
+// progress is cleared when the activity's state is exited. Outside an activity, or once the activity
+// is cancelled, it does nothing.
+//
+// Example:
+//
+//	hsm.Activity(func(ctx context.Context, sm *Uploader, event hsm.Event) {
+//	    for sent := 0; sent < sm.size; sent += chunk {
+//	        upload(ctx, chunk)
+//	        hsm.SetProgress(ctx, float64(sent)/float64(sm.size), "uploading")
+//	    }
+//	})
+func SetProgress(ctx context.Context, value float64, detail string) {
+	activity, ok := ctx.Value(pausableKey).(pausable)
+	if !ok || ctx.Err() != nil {
+		return
+	}
+	if instance, ok := FromContext(ctx); ok {
+		instance.setProgress(ctx, &progress{value: value, detail: detail, state: path.Dir(activity.qualifiedName)})
+	}
+}
+
+// Progress returns the latest progress published with SetProgress by an activity of the instance's
+// active states, or zero and an empty detail if there is none.
+//
+// Example:
+//
+//	value, detail := hsm.Progress(sm)
+//	fmt.Fprintf(w, "%s: %.0f%%", detail, value*100)
+func Progress(hsm Instance) (float64, string) {
+	if progress := hsm.currentProgress(); progress != nil {
+		return progress.value, progress.detail
+	}
+	return 0, ""
+}
+
+func ID(hsm Instance) string {
+	snapshot := hsm.takeSnapshot()
+	return snapshot.ID
+}
+
+func QualifiedName(hsm Instance) string {
+	snapshot := hsm.takeSnapshot()
+	return snapshot.QualifiedName
+}
+
+func Name(hsm Instance) string {
+	snapshot := hsm.takeSnapshot()
+	return path.Base(snapshot.QualifiedName)
+}
+
+// Diagram returns a PlantUML state diagram of the instance's model with the current state and its
+// ancestors highlighted, e.g. for a debugging endpoint.
+//
+// Example:
+//
+//	http.HandleFunc("/debug/diagram", func(w http.ResponseWriter, r *http.Request) {
+//	    io.WriteString(w, hsm.Diagram(sm))
+//	})
+func Diagram(hsm Instance) string {
+	model := hsm.definition()
+	if model == nil {
+		return ""
+	}
+	active := []string{}
+	for qualifiedName := hsm.State(); qualifiedName != "/" && qualifiedName != "." && qualifiedName != ""; qualifiedName = path.Dir(qualifiedName) {
+		active = append(active, qualifiedName)
+	}
+	var builder strings.Builder
+	if err := plantuml.Generate(&builder, model, active...); err != nil {
+		return ""
+	}
+	return builder.String()
+}
+
+// DispatchAndSnapshot dispatches an event and returns the snapshot of the instance taken right after
+// the event was processed, before any other event is, so that it reflects exactly the state the event
+// left the instance in. Waiting on Dispatch and then calling TakeSnapshot can observe events
+// dispatched concurrently in between. Returns ctx.Err() if ctx is done first, or an error wrapping
+// ErrNotProcessed if the event was dropped before being queued, e.g. by a draining instance.
+//
+// Example:
+//
+//	snapshot, err := hsm.DispatchAndSnapshot(r.Context(), sm, hsm.Event{Name: "approve"})
+//	if err != nil {
+//	    return err
+//	}
+//	json.NewEncoder(w).Encode(snapshot)
+func DispatchAndSnapshot(ctx context.Context, hsm Instance, event Event) (Snapshot, error) {
+	return hsm.dispatchAndSnapshot(ctx, event)
+}
+
+func TakeSnapshot(ctx context.Context, hsm Instance) Snapshot {
+	return hsm.takeSnapshot()
+}
+
+// IsProcessing reports whether the state machine is currently draining its event queue.
+// Unlike waiting on the channel returned by Dispatch, it does not report start, stop or
+// restart as processing.
+func IsProcessing(hsm Instance) bool {
+	return !hsm.processingSince().IsZero()
+}
+
+// ProcessingSince returns when the current processing turn started, or the zero time if the
+// state machine is idle. Useful to flag instances that have been stuck processing for too long.
+func ProcessingSince(hsm Instance) time.Time {
+	return hsm.processingSince()
+}
+
+// NextStates returns, for each event that has a transition from the current state or one of its
+// ancestors, the states that transition could lead to. Guards are ignored and choice pseudostates
+// are expanded into all of their branches. Internal transitions report the current state.
+//
+// Example:
+//
+//	for event, targets := range hsm.NextStates(sm) {
+//	    log.Printf("%s -> %v", event, targets)
+//	}
+func NextStates(hsm Instance) map[string][]string {
+	return hsm.nextStates(context.Background(), false)
+}
+
+// NextStatesNow is like NextStates but evaluates guards against the instance's current data,
+// reporting only the transition that would be taken for each event and the choice branch it would follow.
+// Guards are called outside of event processing, so they must be safe to run concurrently with it.
+func NextStatesNow(ctx context.Context, hsm Instance) map[string][]string {
+	return hsm.nextStates(ctx, true)
+}
+
+/******* Guard expressions *******/
+
+type guardScope struct {
+	hsm   any
+	event Event
+}
+
+type guardNode func(scope guardScope) any
+
+type guardExpression struct {
+	element
+	source     string
+	expression guardNode
+}
+
+type guardToken struct {
+	kind  string // one of "ident", "number", "string" or the operator itself
+	text  string
+	value any
+}
+
+func tokenizeGuardExpression(expr string) ([]guardToken, error) {
+	tokens := []guardToken{}
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(expr[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			text := expr[i+1 : i+1+end]
+			tokens = append(tokens, guardToken{kind: "string", text: text, value: text})
+			i += end + 2
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(expr) && (expr[i] >= '0' && expr[i] <= '9' || expr[i] == '.') {
+				i++
+			}
+			value, err := strconv.ParseFloat(expr[start:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at offset %d", expr[start:i], start)
+			}
+			tokens = append(tokens, guardToken{kind: "number", text: expr[start:i], value: value})
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(expr) && (expr[i] == '_' || expr[i] == '.' || expr[i] >= 'a' && expr[i] <= 'z' || expr[i] >= 'A' && expr[i] <= 'Z' || expr[i] >= '0' && expr[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, guardToken{kind: "ident", text: expr[start:i]})
+		default:
+			operator := ""
+			for _, candidate := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")"} {
+				if strings.HasPrefix(expr[i:], candidate) {
+					operator = candidate
+					break
+				}
+			}
+			if operator == "" {
+				return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+			}
+			tokens = append(tokens, guardToken{kind: operator, text: operator})
+			i += len(operator)
+		}
+	}
+	return tokens, nil
+}
+
+type guardParser struct {
+	tokens   []guardToken
+	position int
+}
+
+func parseGuardExpression(expr string) (guardNode, error) {
+	tokens, err := tokenizeGuardExpression(expr)
+	if err != nil {
+		return nil, err
+	}
+	parser := &guardParser{tokens: tokens}
+	node, err := parser.or()
+	if err != nil {
+		return nil, err
+	}
+	if parser.position < len(parser.tokens) {
+		return nil, fmt.Errorf("unexpected %q", parser.tokens[parser.position].text)
+	}
+	return node, nil
+}
+
+func (parser *guardParser) peek() string {
+	if parser.position < len(parser.tokens) {
+		return parser.tokens[parser.position].kind
+	}
+	return ""
+}
+
+func (parser *guardParser) or() (guardNode, error) {
+	left, err := parser.and()
+	for err == nil && parser.peek() == "||" {
+		parser.position++
+		var right guardNode
+		if right, err = parser.and(); err == nil {
+			left = func(left, right guardNode) guardNode {
+				return func(scope guardScope) any {
+					return truthy(left(scope)) || truthy(right(scope))
+				}
+			}(left, right)
+		}
+	}
+	return left, err
+}
+
+func (parser *guardParser) and() (guardNode, error) {
+	left, err := parser.unary()
+	for err == nil && parser.peek() == "&&" {
+		parser.position++
+		var right guardNode
+		if right, err = parser.unary(); err == nil {
+			left = func(left, right guardNode) guardNode {
+				return func(scope guardScope) any {
+					return truthy(left(scope)) && truthy(right(scope))
+				}
+			}(left, right)
+		}
+	}
+	return left, err
+}
+
+func (parser *guardParser) unary() (guardNode, error) {
+	if parser.peek() == "!" {
+		parser.position++
+		operand, err := parser.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(scope guardScope) any {
+			return !truthy(operand(scope))
+		}, nil
+	}
+	return parser.comparison()
+}
+
+func (parser *guardParser) comparison() (guardNode, error) {
+	left, err := parser.primary()
+	if err != nil {
+		return nil, err
+	}
+	operator := parser.peek()
+	switch operator {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return left, nil
+	}
+	parser.position++
+	right, err := parser.primary()
+	if err != nil {
+		return nil, err
+	}
+	return func(scope guardScope) any {
+		return compare(operator, left(scope), right(scope))
+	}, nil
+}
+
+func (parser *guardParser) primary() (guardNode, error) {
+	if parser.position >= len(parser.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	token := parser.tokens[parser.position]
+	parser.position++
+	switch token.kind {
+	case "(":
+		node, err := parser.or()
+		if err != nil {
+			return nil, err
+		}
+		if parser.peek() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		parser.position++
+		return node, nil
+	case "number", "string":
+		return func(guardScope) any { return token.value }, nil
+	case "ident":
+		switch token.text {
+		case "true", "false":
+			value := token.text == "true"
+			return func(guardScope) any { return value }, nil
+		case "nil":
+			return func(guardScope) any { return nil }, nil
+		}
+		segments := strings.Split(token.text, ".")
+		for _, segment := range segments {
+			if segment == "" {
+				return nil, fmt.Errorf("invalid path %q", token.text)
+			}
+		}
+		root, segments := segments[0], segments[1:]
+		switch root {
+		case "event":
+			return func(scope guardScope) any {
+				value := reflect.ValueOf(scope.event)
+				if len(segments) > 0 && !value.FieldByNameFunc(fold(segments[0])).IsValid() {
+					// not an event field, look it up in the event data
+					value = reflect.ValueOf(scope.event.Data)
+				}
+				return lookup(value, segments)
+			}, nil
+		case "data":
+			return func(scope guardScope) any {
+				return lookup(reflect.ValueOf(scope.event.Data), segments)
+			}, nil
+		case "hsm":
+			return func(scope guardScope) any {
+				return lookup(reflect.ValueOf(scope.hsm), segments)
+			}, nil
+		}
+		return nil, fmt.Errorf("unknown identifier %q, paths must start with event, data or hsm", token.text)
+	}
+	return nil, fmt.Errorf("unexpected %q", token.text)
+}
+
+func fold(name string) func(string) bool {
+	return func(field string) bool {
+		return strings.EqualFold(field, name)
+	}
+}
+
+// lookup walks a dotted path through struct fields and string keyed maps and returns the
+// value as nil, bool, float64, string or, for other types, the value itself when accessible.
+func lookup(value reflect.Value, segments []string) any {
+	for _, segment := range segments {
+		for value.Kind() == reflect.Pointer || value.Kind() == reflect.Interface {
+			if value.IsNil() {
+				return nil
+			}
+			value = value.Elem()
+		}
+		switch value.Kind() {
+		case reflect.Struct:
+			value = value.FieldByNameFunc(fold(segment))
+		case reflect.Map:
+			if value.Type().Key().Kind() != reflect.String {
+				return nil
+			}
+			value = value.MapIndex(reflect.ValueOf(segment).Convert(value.Type().Key()))
+		default:
+			return nil
+		}
+		if !value.IsValid() {
+			return nil
+		}
+	}
+	for value.Kind() == reflect.Pointer || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+	switch value.Kind() {
+	case reflect.Invalid:
+		return nil
+	case reflect.Bool:
+		return value.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		return value.Float()
+	case reflect.String:
+		return value.String()
+	}
+	if value.CanInterface() {
+		return value.Interface()
+	}
+	return nil
+}
+
+func compare(operator string, left, right any) bool {
+	switch operator {
+	case "==":
+		return reflect.DeepEqual(left, right)
+	case "!=":
+		return !reflect.DeepEqual(left, right)
+	}
+	var order int
+	switch left := left.(type) {
+	case float64:
+		right, ok := right.(float64)
+		if !ok {
+			return false
+		}
+		order = cmp.Compare(left, right)
+	case string:
+		right, ok := right.(string)
+		if !ok {
+			return false
+		}
+		order = strings.Compare(left, right)
+	default:
+		return false
+	}
+	switch operator {
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	case ">=":
+		return order >= 0
+	}
+	return false
+}
+
+func truthy(value any) bool {
+	switch value := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return value
+	case float64:
+		return value != 0
+	case string:
+		return value != ""
+	}
+	return true
 }
@@ -1,16 +1,26 @@
 package hsm_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
+	"math/rand"
 	"os"
+	"path"
+	"reflect"
+	"runtime"
 	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/runpod/hsm/v2"
+	"github.com/runpod/hsm/v2/elements"
 	"github.com/runpod/hsm/v2/pkg/plantuml"
 )
 
@@ -695,6 +705,62 @@ func TestLCA(t *testing.T) {
 	if hsm.LCA("/foo/bar/baz/qux", "") != "/foo/bar/baz/qux" {
 		t.Fatal("LCA is not correct", "LCA", hsm.LCA("/foo/bar/baz/qux", ""))
 	}
+	if hsm.LCA("/foo", "/bar") != "/" {
+		t.Fatal("LCA is not correct", "LCA", hsm.LCA("/foo", "/bar"))
+	}
+	if hsm.LCA("/foo/bar", "/baz") != "/" {
+		t.Fatal("LCA is not correct", "LCA", hsm.LCA("/foo/bar", "/baz"))
+	}
+	if hsm.LCA("/", "/") != "/" {
+		t.Fatal("LCA is not correct", "LCA", hsm.LCA("/", "/"))
+	}
+	if hsm.LCA("/foo/bar", "/") != "/" {
+		t.Fatal("LCA is not correct", "LCA", hsm.LCA("/foo/bar", "/"))
+	}
+}
+
+func TestTopLevelTransitions(t *testing.T) {
+	trace := []string{}
+	model := hsm.Define(
+		"TestTopLevelTransitionsHSM",
+		hsm.Initial(hsm.Target("foo")),
+		hsm.State("foo",
+			hsm.Entry(func(ctx context.Context, sm *THSM, event hsm.Event) { trace = append(trace, "enter foo") }),
+			hsm.Exit(func(ctx context.Context, sm *THSM, event hsm.Event) { trace = append(trace, "exit foo") }),
+			hsm.Transition(hsm.On("next"), hsm.Target("../foobar")),
+		),
+		// shares a name prefix with foo, so a prefix match would treat it as nested in foo
+		hsm.State("foobar",
+			hsm.Entry(func(ctx context.Context, sm *THSM, event hsm.Event) { trace = append(trace, "enter foobar") }),
+			hsm.Exit(func(ctx context.Context, sm *THSM, event hsm.Event) { trace = append(trace, "exit foobar") }),
+			hsm.State("child",
+				hsm.Entry(func(ctx context.Context, sm *THSM, event hsm.Event) { trace = append(trace, "enter child") }),
+				hsm.Exit(func(ctx context.Context, sm *THSM, event hsm.Event) { trace = append(trace, "exit child") }),
+			),
+			hsm.Initial(hsm.Target("child")),
+			hsm.Transition(hsm.On("next"), hsm.Target("../foo")),
+		),
+	)
+	for _, member := range model.Members() {
+		transition, ok := member.(elements.Transition)
+		if !ok || transition.Source() != "/foo" {
+			continue
+		}
+		if transition.TransitionKind() != hsm.ExternalKind {
+			t.Fatalf("expected an external transition between top-level states, got %s", hsm.KindName(transition.TransitionKind()))
+		}
+	}
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	trace = nil
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "next"})
+	if sm.State() != "/foobar/child" || !slices.Equal(trace, []string{"exit foo", "enter foobar", "enter child"}) {
+		t.Fatalf("expected to exit foo and enter foobar, got %s after %v", sm.State(), trace)
+	}
+	trace = nil
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "next"})
+	if sm.State() != "/foo" || !slices.Equal(trace, []string{"exit child", "exit foobar", "enter foo"}) {
+		t.Fatalf("expected to exit foobar and enter foo, got %s after %v", sm.State(), trace)
+	}
 }
 
 // }
@@ -1310,3 +1376,3910 @@ func BenchmarkModel(b *testing.B) {
 		)
 	}
 }
+
+func TestDeterministic(t *testing.T) {
+	run := func() []string {
+		ids := []string{}
+		model := hsm.Define(
+			"TestDeterministicHSM",
+			hsm.Initial(hsm.Target("foo")),
+			hsm.State("foo"),
+			hsm.State("bar"),
+			hsm.Transition(hsm.On("foo"), hsm.Source("foo"), hsm.Target("bar"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				ids = append(ids, event.Id.String())
+			})),
+			hsm.Transition(hsm.On("bar"), hsm.Source("bar"), hsm.Target("foo"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				ids = append(ids, event.Id.String())
+			})),
+		)
+		sm := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{
+			Deterministic: true,
+			Seed:          7,
+		})
+		ids = append(ids, hsm.ID(sm))
+		for range 3 {
+			<-sm.Dispatch(context.Background(), hsm.Event{Name: "foo"})
+			<-sm.Dispatch(context.Background(), hsm.Event{Name: "bar"})
+		}
+		<-hsm.Stop(context.Background(), sm)
+		return ids
+	}
+	first := run()
+	second := run()
+	if !slices.Equal(first, second) {
+		t.Fatalf("expected identical ids across runs, got %v and %v", first, second)
+	}
+}
+
+func TestDeterministicInstancesOrder(t *testing.T) {
+	sm := hsm.Start(context.Background(), &THSM{}, &benchModel, hsm.Config{ID: "c", Deterministic: true})
+	hsm.Start(sm.Context(), &THSM{}, &benchModel, hsm.Config{ID: "a", Deterministic: true})
+	hsm.Start(sm.Context(), &THSM{}, &benchModel, hsm.Config{ID: "b", Deterministic: true})
+	instances, ok := hsm.InstancesFromContext(sm.Context())
+	if !ok {
+		t.Fatalf("expected instances in context")
+	}
+	ids := []string{}
+	for _, instance := range instances {
+		ids = append(ids, hsm.ID(instance))
+	}
+	if !slices.Equal(ids, []string{"a", "b", "c"}) {
+		t.Fatalf("expected instances in sorted id order, got %v", ids)
+	}
+}
+
+func TestRelativeTarget(t *testing.T) {
+	model := hsm.Define(
+		"TestRelativeTargetHSM",
+		hsm.Initial(hsm.Target("a/b/c")),
+		hsm.State("a",
+			hsm.State("b",
+				hsm.State("c",
+					hsm.Transition(hsm.On("up"), hsm.Target("../../../d")),
+				),
+			),
+		),
+		hsm.State("d"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	if sm.State() != "/a/b/c" {
+		t.Fatalf("expected state \"/a/b/c\" got \"%s\"", sm.State())
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "up"})
+	if sm.State() != "/d" {
+		t.Fatalf("expected state \"/d\" got \"%s\"", sm.State())
+	}
+	func() {
+		defer func() {
+			r := recover()
+			if r == nil {
+				t.Fatal("expected a target escaping the root to panic")
+			}
+			if !strings.Contains(fmt.Sprint(r), "escapes the state machine root") {
+				t.Fatalf("unexpected panic: %v", r)
+			}
+		}()
+		hsm.Define(
+			"TestRelativeTargetEscapeHSM",
+			hsm.Initial(hsm.Target("a")),
+			hsm.State("a", hsm.Transition(hsm.On("up"), hsm.Target("../../d"))),
+			hsm.State("d"),
+		)
+	}()
+	func() {
+		defer func() {
+			r := recover()
+			if r == nil || !strings.Contains(fmt.Sprint(r), "resolved to \"/a/e\"") {
+				t.Fatalf("expected a missing target panic naming the resolved path, got: %v", r)
+			}
+		}()
+		hsm.Define(
+			"TestRelativeTargetMissingHSM",
+			hsm.Initial(hsm.Target("a")),
+			hsm.State("a", hsm.State("b", hsm.Transition(hsm.On("up"), hsm.Target("../e")))),
+		)
+	}()
+}
+
+func TestMerge(t *testing.T) {
+	base := hsm.Define(
+		"TestMergeHSM",
+		hsm.Initial(hsm.Target("foo")),
+		hsm.State("foo"),
+		hsm.State("bar"),
+		hsm.Transition(hsm.On("foo"), hsm.Source("foo"), hsm.Target("bar")),
+	)
+	merged := hsm.Merge(&base,
+		hsm.State("bar",
+			hsm.State("baz"),
+			hsm.Transition(hsm.On("baz"), hsm.Target("baz")),
+		),
+		hsm.State("qux"),
+		hsm.Transition(hsm.On("qux"), hsm.Source("bar/baz"), hsm.Target("qux")),
+	)
+	if _, ok := base.Members()["/qux"]; ok {
+		t.Fatal("expected base model to be left untouched")
+	}
+	sm := hsm.Start(context.Background(), &THSM{}, &merged)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "foo"})
+	if sm.State() != "/bar" {
+		t.Fatalf("expected state \"/bar\" got \"%s\"", sm.State())
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "baz"})
+	if sm.State() != "/bar/baz" {
+		t.Fatalf("expected state \"/bar/baz\" got \"%s\"", sm.State())
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "qux"})
+	if sm.State() != "/qux" {
+		t.Fatalf("expected state \"/qux\" got \"%s\"", sm.State())
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected merge with a missing target to panic")
+			}
+		}()
+		hsm.Merge(&base, hsm.Transition(hsm.On("missing"), hsm.Source("foo"), hsm.Target("missing")))
+	}()
+	// outside of Merge a state defined again replaces the earlier one
+	redefined := hsm.Define(
+		"TestMergeRedefinedHSM",
+		hsm.Initial(hsm.Target("foo")),
+		hsm.State("foo", hsm.Entry(func(ctx context.Context, sm *THSM, event hsm.Event) {
+			sm.foo++
+		})),
+		hsm.State("foo"),
+	)
+	if sm := hsm.Start(context.Background(), &THSM{}, &redefined); sm.foo != 0 {
+		t.Fatalf("expected the redefined state to replace the earlier one, got %d entries", sm.foo)
+	}
+}
+
+func TestNextStates(t *testing.T) {
+	model := hsm.Define(
+		"TestNextStatesHSM",
+		hsm.Initial(hsm.Target("foo/inner")),
+		hsm.State("foo",
+			hsm.State("inner",
+				hsm.Transition(hsm.On("go"), hsm.Target("/bar"), hsm.Guard(func(ctx context.Context, sm *THSM, event hsm.Event) bool {
+					return sm.foo > 0
+				})),
+			),
+			hsm.Transition(hsm.On("go"), hsm.Target("/baz")),
+			hsm.Transition(hsm.On("pick"), hsm.Source("."), hsm.Target(hsm.Choice(
+				hsm.Transition(hsm.Target("/bar"), hsm.Guard(func(ctx context.Context, sm *THSM, event hsm.Event) bool {
+					return sm.foo > 0
+				})),
+				hsm.Transition(hsm.Target("/baz")),
+			))),
+		),
+		hsm.State("bar"),
+		hsm.State("baz"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	next := hsm.NextStates(sm)
+	if !slices.Equal(next["go"], []string{"/bar", "/baz"}) {
+		t.Fatalf("expected go to lead to /bar or /baz, got %v", next["go"])
+	}
+	if !slices.Equal(next["pick"], []string{"/bar", "/baz"}) {
+		t.Fatalf("expected pick to lead to /bar or /baz, got %v", next["pick"])
+	}
+	now := hsm.NextStatesNow(context.Background(), sm)
+	if !slices.Equal(now["go"], []string{"/baz"}) {
+		t.Fatalf("expected go to lead to /baz, got %v", now["go"])
+	}
+	if !slices.Equal(now["pick"], []string{"/baz"}) {
+		t.Fatalf("expected pick to lead to /baz, got %v", now["pick"])
+	}
+}
+
+func TestRestartActivities(t *testing.T) {
+	var entries, exits, starts atomic.Int32
+	model := hsm.Define(
+		"TestRestartActivitiesHSM",
+		hsm.Initial(hsm.Target("connected")),
+		hsm.State("connected",
+			hsm.Entry(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				entries.Add(1)
+			}),
+			hsm.Exit(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				exits.Add(1)
+			}),
+			hsm.Activity(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				starts.Add(1)
+				<-ctx.Done()
+			}),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	<-hsm.RestartActivities(context.Background(), sm)
+	for deadline := time.Now().Add(time.Second); starts.Load() < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if starts.Load() != 2 {
+		t.Fatalf("expected activity to be started twice, got %d", starts.Load())
+	}
+	if entries.Load() != 1 || exits.Load() != 0 {
+		t.Fatalf("expected no entry or exit actions on restart, got %d entries and %d exits", entries.Load(), exits.Load())
+	}
+	if sm.State() != "/connected" {
+		t.Fatalf("expected state \"/connected\" got \"%s\"", sm.State())
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	var count atomic.Int32
+	model := hsm.Define(
+		"TestDedupeHSM",
+		hsm.Initial(hsm.Target("foo")),
+		hsm.State("foo",
+			hsm.Transition(hsm.On("charge"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				count.Add(1)
+			})),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{
+		DedupeWindow: 50 * time.Millisecond,
+	})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "charge", DedupeKey: "a"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "charge", DedupeKey: "a"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "charge", DedupeKey: "b"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "charge"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "charge"})
+	if count.Load() != 4 {
+		t.Fatalf("expected 4 charges, got %d", count.Load())
+	}
+	time.Sleep(60 * time.Millisecond)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "charge", DedupeKey: "a"})
+	if count.Load() != 5 {
+		t.Fatalf("expected key to be accepted again after the window, got %d charges", count.Load())
+	}
+}
+
+func TestActiveConfig(t *testing.T) {
+	var configuration atomic.Value
+	model := hsm.Define(
+		"TestActiveConfigHSM",
+		hsm.Initial(hsm.Target("a/b")),
+		hsm.State("a",
+			hsm.State("b",
+				hsm.Transition(hsm.On("check"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+					configuration.Store(hsm.ActiveConfig(ctx))
+				})),
+			),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "check"})
+	if !slices.Equal(configuration.Load().([]string), []string{"/a", "/a/b"}) {
+		t.Fatalf("expected active configuration [/a /a/b], got %v", configuration.Load())
+	}
+	if hsm.ActiveConfig(context.Background()) != nil {
+		t.Fatal("expected no active configuration outside of a state machine")
+	}
+}
+
+func TestOnCount(t *testing.T) {
+	model := hsm.Define(
+		"TestOnCountHSM",
+		hsm.Initial(hsm.Target("playing")),
+		hsm.State("playing",
+			hsm.Transition(hsm.OnCount("strike", 3), hsm.Target("../out")),
+			hsm.Transition(hsm.On("timeout"), hsm.Target("../bench")),
+		),
+		hsm.State("bench", hsm.Transition(hsm.On("resume"), hsm.Target("../playing"))),
+		hsm.State("out"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	strike := hsm.Event{Name: "strike"}
+	<-sm.Dispatch(context.Background(), strike)
+	<-sm.Dispatch(context.Background(), strike)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "timeout"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "resume"})
+	<-sm.Dispatch(context.Background(), strike)
+	<-sm.Dispatch(context.Background(), strike)
+	if sm.State() != "/playing" {
+		t.Fatalf("expected counter to reset on exit and state to be \"/playing\", got \"%s\"", sm.State())
+	}
+	<-sm.Dispatch(context.Background(), strike)
+	if sm.State() != "/out" {
+		t.Fatalf("expected state \"/out\" on the third strike, got \"%s\"", sm.State())
+	}
+}
+
+func TestStateTree(t *testing.T) {
+	model := hsm.Define(
+		"TestStateTreeHSM",
+		hsm.Initial(hsm.Target("foo")),
+		hsm.State("foo",
+			hsm.State("bar"),
+			hsm.Initial(hsm.Target("bar")),
+			hsm.Transition(hsm.On("done"), hsm.Target("/done")),
+		),
+		hsm.Final("done"),
+	)
+	root := hsm.StateTree(&model)
+	if root.QualifiedName != "/" {
+		t.Fatalf("expected root node \"/\", got \"%s\"", root.QualifiedName)
+	}
+	names := []string{}
+	for _, child := range root.Children {
+		names = append(names, child.QualifiedName)
+	}
+	if !slices.Equal(names, []string{"/.initial", "/done", "/foo"}) {
+		t.Fatalf("unexpected root children %v", names)
+	}
+	foo := root.Children[2]
+	if len(foo.Children) != 2 || foo.Children[0].Kind != hsm.Kinds.Initial || foo.Children[1].QualifiedName != "/foo/bar" {
+		t.Fatalf("unexpected children of /foo: %+v", foo.Children)
+	}
+	if len(foo.Transitions) != 1 {
+		t.Fatalf("expected /foo to have one transition, got %v", foo.Transitions)
+	}
+	if root.Children[1].Kind != hsm.Kinds.FinalState {
+		t.Fatalf("expected /done to be a final state")
+	}
+}
+
+func TestDispatchInline(t *testing.T) {
+	model := hsm.Define(
+		"TestDispatchInlineHSM",
+		hsm.Initial(hsm.Target("foo")),
+		hsm.State("foo"),
+		hsm.State("bar"),
+		hsm.Transition(hsm.On("foo"), hsm.Source("foo"), hsm.Target("bar")),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	done := hsm.DispatchInline(context.Background(), sm, hsm.Event{Name: "foo"})
+	select {
+	case <-done:
+	default:
+		t.Fatal("expected an idle instance to process the event inline")
+	}
+	if sm.State() != "/bar" {
+		t.Fatalf("expected state \"/bar\" got \"%s\"", sm.State())
+	}
+}
+
+func BenchmarkDispatchInline(b *testing.B) {
+	ctx := context.Background()
+	instance := hsm.Start(ctx, &THSM{}, &benchModel)
+	fooEvent := hsm.Event{Name: "foo"}
+	barEvent := hsm.Event{Name: "bar"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		<-hsm.DispatchInline(ctx, instance, fooEvent)
+		<-hsm.DispatchInline(ctx, instance, barEvent)
+	}
+	<-hsm.Stop(ctx, instance)
+}
+
+func TestDefaultEntryExit(t *testing.T) {
+	trace := []string{}
+	model := hsm.Define(
+		"TestDefaultEntryExitHSM",
+		hsm.DefaultEntry(func(ctx context.Context, sm *THSM, event hsm.Event) {
+			trace = append(trace, "default.entry")
+		}),
+		hsm.DefaultExit(func(ctx context.Context, sm *THSM, event hsm.Event) {
+			trace = append(trace, "default.exit")
+		}),
+		hsm.Initial(hsm.Target("foo")),
+		hsm.State("foo",
+			hsm.Exit(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				trace = append(trace, "foo.exit")
+			}),
+		),
+		hsm.State("bar",
+			hsm.Entry(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				trace = append(trace, "bar.entry")
+			}),
+		),
+		hsm.Transition(hsm.On("foo"), hsm.Source("foo"), hsm.Target("bar")),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "foo"})
+	expected := []string{"default.entry", "default.exit", "foo.exit", "default.entry", "bar.entry"}
+	if !slices.Equal(trace, expected) {
+		t.Fatalf("expected trace %v, got %v", expected, trace)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected DefaultEntry within a State to panic")
+			}
+		}()
+		hsm.Define(
+			"TestDefaultEntryNestedHSM",
+			hsm.Initial(hsm.Target("foo")),
+			hsm.State("foo", hsm.DefaultEntry(noBehavior)),
+		)
+	}()
+}
+
+func TestIsProcessing(t *testing.T) {
+	release := make(chan struct{})
+	entered := make(chan struct{})
+	model := hsm.Define(
+		"TestIsProcessingHSM",
+		hsm.Initial(hsm.Target("foo")),
+		hsm.State("foo",
+			hsm.Transition(hsm.On("block"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				close(entered)
+				<-release
+			})),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	if hsm.IsProcessing(sm) {
+		t.Fatal("expected an idle instance not to be processing")
+	}
+	done := sm.Dispatch(context.Background(), hsm.Event{Name: "block"})
+	<-entered
+	if !hsm.IsProcessing(sm) || hsm.ProcessingSince(sm).IsZero() {
+		t.Fatal("expected instance to be processing")
+	}
+	close(release)
+	<-done
+	if hsm.IsProcessing(sm) {
+		t.Fatal("expected instance to be idle after processing")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	var count atomic.Int32
+	release := make(chan struct{})
+	model := hsm.Define(
+		"TestDrainHSM",
+		hsm.Initial(hsm.Target("foo")),
+		hsm.State("foo",
+			hsm.Transition(hsm.On("work"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				<-release
+				count.Add(1)
+			})),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	for range 3 {
+		sm.Dispatch(context.Background(), hsm.Event{Name: "work"})
+	}
+	drained := hsm.Drain(context.Background(), sm)
+	sm.Dispatch(context.Background(), hsm.Event{Name: "work"})
+	close(release)
+	<-drained
+	if count.Load() != 3 {
+		t.Fatalf("expected the 3 queued events to be processed, got %d", count.Load())
+	}
+	select {
+	case <-sm.Context().Done():
+	default:
+		t.Fatal("expected state machine to be stopped after draining")
+	}
+}
+
+func TestTag(t *testing.T) {
+	model := hsm.Define(
+		"TestTagHSM",
+		hsm.Initial(hsm.Target("foo")),
+		hsm.State("foo"),
+		hsm.State("bar"),
+		hsm.Transition("delete", hsm.On("delete"), hsm.Source("foo"), hsm.Target("bar"), hsm.Tag("audit", "dangerous")),
+		hsm.Transition("update", hsm.On("update"), hsm.Source("bar"), hsm.Target("foo"), hsm.Tag("audit")),
+	)
+	if tagged := hsm.TransitionsByTag(&model, "audit"); !slices.Equal(tagged, []string{"/delete", "/update"}) {
+		t.Fatalf("expected audit transitions [/delete /update], got %v", tagged)
+	}
+	if tagged := hsm.TransitionsByTag(&model, "dangerous"); !slices.Equal(tagged, []string{"/delete"}) {
+		t.Fatalf("expected dangerous transitions [/delete], got %v", tagged)
+	}
+	if tagged := hsm.TransitionsByTag(&model, "missing"); len(tagged) != 0 {
+		t.Fatalf("expected no transitions, got %v", tagged)
+	}
+}
+
+func TestOverlaps(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected bool
+	}{
+		{"foo", "foo", true},
+		{"foo", "bar", false},
+		{"foo*", "foobar", true},
+		{"foo*", "bar*", false},
+		{"*bar", "foo*", true},
+		{"a*c", "ab*", true},
+		{"a*c", "*d", false},
+		{"*", "", true},
+		{"", "a", false},
+	}
+	for _, c := range cases {
+		if hsm.Overlaps(c.a, c.b) != c.expected || hsm.Overlaps(c.b, c.a) != c.expected {
+			t.Fatalf("expected Overlaps(%q, %q) to be %v", c.a, c.b, c.expected)
+		}
+	}
+}
+
+func TestCheckDeterminism(t *testing.T) {
+	model := hsm.Define(
+		"TestCheckDeterminismHSM",
+		hsm.Initial(hsm.Target("foo")),
+		hsm.State("foo",
+			hsm.Transition("exact", hsm.On("foobar"), hsm.Target("../bar")),
+			hsm.Transition("wildcard", hsm.On("foo*"), hsm.Target("../baz")),
+			hsm.Transition("guarded", hsm.On("foobar"), hsm.Target("../baz"), hsm.Guard(noGuard)),
+			hsm.Transition("other", hsm.On("other"), hsm.Target("../baz")),
+		),
+		hsm.State("bar"),
+		hsm.State("baz"),
+	)
+	conflicts := hsm.CheckDeterminism(&model)
+	if len(conflicts) != 3 {
+		t.Fatalf("expected 3 conflicts, got %+v", conflicts)
+	}
+	for _, conflict := range conflicts {
+		if conflict.State != "/foo" {
+			t.Fatalf("expected conflicts on /foo, got %+v", conflict)
+		}
+	}
+	conflicts = hsm.CheckDeterminism(&model, hsm.DeterminismOptions{AllowGuarded: true})
+	if len(conflicts) != 1 || conflicts[0].Transitions != [2]string{"/foo/exact", "/foo/wildcard"} {
+		t.Fatalf("expected only exact/wildcard to conflict, got %+v", conflicts)
+	}
+	if conflicts := hsm.CheckDeterminism(&benchModel); len(conflicts) != 0 {
+		t.Fatalf("expected no conflicts, got %+v", conflicts)
+	}
+}
+
+func TestPauseActivity(t *testing.T) {
+	var ticks atomic.Int32
+	model := hsm.Define(
+		"TestPauseActivityHSM",
+		hsm.Initial(hsm.Target("polling")),
+		hsm.State("polling",
+			hsm.Activity(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				for hsm.WaitIfPaused(ctx) == nil {
+					ticks.Add(1)
+					time.Sleep(time.Millisecond)
+				}
+			}),
+		),
+	)
+	activity := model.Members()["/polling"].(interface{ Activities() []string }).Activities()[0]
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	waitFor := func(condition func() bool) bool {
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if condition() {
+				return true
+			}
+		}
+		return false
+	}
+	if !waitFor(func() bool { return ticks.Load() > 0 }) {
+		t.Fatal("expected activity to run")
+	}
+	if hsm.PauseActivity(sm, "/polling/missing") {
+		t.Fatal("expected pausing an unknown activity to fail")
+	}
+	if !hsm.PauseActivity(sm, activity) {
+		t.Fatalf("expected to pause %s", activity)
+	}
+	time.Sleep(5 * time.Millisecond)
+	paused := ticks.Load()
+	time.Sleep(20 * time.Millisecond)
+	if ticks.Load() != paused {
+		t.Fatalf("expected paused activity to stop ticking, got %d then %d", paused, ticks.Load())
+	}
+	if sm.State() != "/polling" {
+		t.Fatalf("expected state \"/polling\" got \"%s\"", sm.State())
+	}
+	if !hsm.ResumeActivity(sm, activity) {
+		t.Fatalf("expected to resume %s", activity)
+	}
+	if !waitFor(func() bool { return ticks.Load() > paused }) {
+		t.Fatal("expected resumed activity to tick again")
+	}
+	hsm.PauseActivity(sm, activity)
+	select {
+	case <-hsm.Stop(context.Background(), sm):
+	case <-time.After(time.Second):
+		t.Fatal("expected paused activity to be cancelled on stop")
+	}
+}
+
+func TestDispatchSeq(t *testing.T) {
+	var mutex sync.Mutex
+	names := []string{}
+	record := func(ctx context.Context, sm *THSM, event hsm.Event) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		names = append(names, event.Name)
+	}
+	model := hsm.Define(
+		"TestDispatchSeqHSM",
+		hsm.Initial(hsm.Target("closed")),
+		hsm.State("closed",
+			hsm.Transition(hsm.On("open"), hsm.Target("../opened"), hsm.Effect(record)),
+		),
+		hsm.State("opened",
+			hsm.Transition(hsm.On("write"), hsm.Effect(record)),
+			hsm.Transition(hsm.On("close"), hsm.Target("../closed"), hsm.Effect(record)),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	<-hsm.DispatchSeq(context.Background(), sm,
+		hsm.Event{Name: "open"},
+		hsm.Event{Name: "write"},
+		hsm.Event{Name: "write"},
+		hsm.Event{Name: "close"},
+	)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if strings.Join(names, ",") != "open,write,write,close" {
+		t.Fatalf("expected events to be processed in order, got %v", names)
+	}
+	if sm.State() != "/closed" {
+		t.Fatalf("expected state \"/closed\" got \"%s\"", sm.State())
+	}
+	select {
+	case <-hsm.DispatchSeq(context.Background(), sm):
+	default:
+		t.Fatal("expected an empty sequence to return a closed channel")
+	}
+}
+
+func TestNilBehaviors(t *testing.T) {
+	var behavior func(ctx context.Context, sm *THSM, event hsm.Event)
+	var guard func(ctx context.Context, sm *THSM, event hsm.Event) bool
+	cases := map[string]hsm.RedefinableElement{
+		"guard function for \"/foo/t\"":  hsm.State("foo", hsm.Transition("t", hsm.On("a"), hsm.Guard(guard))),
+		"effect function for \"/foo/t\"": hsm.State("foo", hsm.Transition("t", hsm.On("a"), hsm.Effect(behavior))),
+		"entry function for \"/foo\"":    hsm.State("foo", hsm.Entry(behavior)),
+		"exit function for \"/foo\"":     hsm.State("foo", hsm.Exit(behavior)),
+		"activity function for \"/foo\"": hsm.State("foo", hsm.Activity(behavior)),
+	}
+	for expected, element := range cases {
+		func() {
+			defer func() {
+				r := recover()
+				if r == nil || !strings.Contains(fmt.Sprint(r), expected+" cannot be nil") {
+					t.Fatalf("expected a panic containing %q, got: %v", expected, r)
+				}
+			}()
+			hsm.Define("TestNilBehaviorsHSM", hsm.Initial(hsm.Target("foo")), element)
+		}()
+	}
+}
+
+func TestMaxQueueLen(t *testing.T) {
+	blocking, release := make(chan struct{}), make(chan struct{})
+	model := hsm.Define(
+		"TestMaxQueueLenHSM",
+		hsm.Initial(hsm.Target("foo")),
+		hsm.State("foo",
+			hsm.Transition(hsm.On("block"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				close(blocking)
+				<-release
+			})),
+			hsm.Transition(hsm.On("tick"), hsm.Effect(noBehavior)),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	blocked := sm.Dispatch(context.Background(), hsm.Event{Name: "block"})
+	<-blocking
+	for range 3 {
+		sm.Dispatch(context.Background(), hsm.Event{Name: "tick"})
+	}
+	close(release)
+	<-blocked
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "tick"})
+	snapshot := hsm.TakeSnapshot(context.Background(), sm)
+	if snapshot.QueueLen != 0 || snapshot.MaxQueueLen != 3 {
+		t.Fatalf("expected an empty queue with a high-water mark of 3, got %d and %d", snapshot.QueueLen, snapshot.MaxQueueLen)
+	}
+	<-hsm.Restart(context.Background(), sm)
+	if snapshot := hsm.TakeSnapshot(context.Background(), sm); snapshot.MaxQueueLen > 1 {
+		t.Fatalf("expected high-water mark to be reset on restart, got %d", snapshot.MaxQueueLen)
+	}
+}
+
+func TestOnErrorLocal(t *testing.T) {
+	var caught atomic.Value
+	model := hsm.Define(
+		"TestOnErrorLocalHSM",
+		hsm.Initial(hsm.Target("s/s2/inner")),
+		hsm.State("s",
+			hsm.OnErrorLocal("../s_failed"),
+			hsm.State("s2",
+				hsm.OnErrorLocal("../s2_failed", hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+					caught.Store(event.Data)
+				})),
+				hsm.State("inner",
+					hsm.Transition(hsm.On("crash"), hsm.Target("../crashing")),
+				),
+				hsm.State("crashing",
+					hsm.Activity(func(ctx context.Context, sm *THSM, event hsm.Event) {
+						panic("boom")
+					}),
+				),
+			),
+			hsm.State("s2_failed",
+				hsm.Transition(hsm.On("next"), hsm.Target("../other")),
+			),
+			hsm.State("other"),
+		),
+		hsm.State("s_failed"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "crash"})
+	for deadline := time.Now().Add(time.Second); sm.State() != "/s/s2_failed" && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if sm.State() != "/s/s2_failed" {
+		t.Fatalf("expected error to be caught by the nearest handler in \"/s/s2\", got \"%s\"", sm.State())
+	}
+	if err, ok := caught.Load().(error); !ok || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("expected effect to receive the error, got %v", caught.Load())
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "next"})
+	<-sm.Dispatch(context.Background(), hsm.ErrorEvent.WithData(fmt.Errorf("failed")))
+	if sm.State() != "/s_failed" {
+		t.Fatalf("expected error to bubble up to \"/s\", got \"%s\"", sm.State())
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected OnErrorLocal outside a State to panic")
+			}
+		}()
+		hsm.Define("TestOnErrorLocalRootHSM", hsm.Initial(hsm.Target("s")), hsm.State("s"), hsm.OnErrorLocal("s"))
+	}()
+}
+
+// A panicking activity still signals that it returned, so leaving its state does not wait for the
+// ActivityTimeout and dispatch a terminate timeout error.
+func TestActivityPanicTermination(t *testing.T) {
+	var errs atomic.Int32
+	model := hsm.Define(
+		"TestActivityPanicTerminationHSM",
+		hsm.Initial(hsm.Target("running")),
+		hsm.State("running",
+			hsm.Activity(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				panic("boom")
+			}),
+			hsm.Transition(hsm.On("stop"), hsm.Target("../stopped")),
+		),
+		hsm.State("stopped",
+			hsm.Transition(hsm.On(hsm.ErrorEvent), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				errs.Add(1)
+			})),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{
+		ActivityTimeout: time.Second,
+		OnPanic: func(ctx context.Context, _ hsm.Instance, info hsm.Panic) hsm.PanicAction {
+			return hsm.IgnorePanic
+		},
+	})
+	time.Sleep(10 * time.Millisecond)
+	began := time.Now()
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "stop"})
+	if elapsed := time.Since(began); elapsed > 500*time.Millisecond {
+		t.Fatalf("expected the panicked activity to be terminated right away, took %s", elapsed)
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "noop"})
+	if errs.Load() != 0 {
+		t.Fatal("expected no terminate timeout error")
+	}
+}
+
+type ResettableHSM struct {
+	hsm.HSM
+	count int
+	data  any
+}
+
+func (sm *ResettableHSM) Reset() {
+	sm.count = 0
+	sm.data = nil
+}
+
+func TestRestartClean(t *testing.T) {
+	model := hsm.Define(
+		"TestRestartCleanHSM",
+		hsm.Initial(hsm.Target("foo"), hsm.Effect(func(ctx context.Context, sm *ResettableHSM, event hsm.Event) {
+			if event.Data != nil {
+				sm.data = event.Data
+			}
+		})),
+		hsm.State("foo",
+			hsm.Transition(hsm.On("add"), hsm.Effect(func(ctx context.Context, sm *ResettableHSM, event hsm.Event) {
+				sm.count++
+			})),
+		),
+	)
+	sm := hsm.Start(context.Background(), &ResettableHSM{}, &model)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "add"})
+	<-hsm.Restart(context.Background(), sm, "stale")
+	if sm.count != 1 || sm.data != "stale" {
+		t.Fatalf("expected Restart to keep user fields, got count %d and data %v", sm.count, sm.data)
+	}
+	<-hsm.RestartClean(context.Background(), sm)
+	if sm.count != 0 || sm.data != nil {
+		t.Fatalf("expected RestartClean to reset user fields, got count %d and data %v", sm.count, sm.data)
+	}
+	<-hsm.RestartClean(context.Background(), sm, "fresh")
+	if sm.data != "fresh" || sm.State() != "/foo" {
+		t.Fatalf("expected fresh data in state \"/foo\", got %v in \"%s\"", sm.data, sm.State())
+	}
+}
+
+func TestPreExit(t *testing.T) {
+	var exits atomic.Int32
+	var caught atomic.Value
+	errNotFlushed := fmt.Errorf("not flushed")
+	model := hsm.Define(
+		"TestPreExitHSM",
+		hsm.Initial(hsm.Target("connected")),
+		hsm.State("connected",
+			hsm.Exit(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				exits.Add(1)
+			}),
+			hsm.Transition(hsm.On("flush"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				sm.foo = 1
+			})),
+			hsm.Transition(hsm.On("disconnect"), hsm.Target("../idle"), hsm.PreExit(func(ctx context.Context, sm *THSM, event hsm.Event) error {
+				if sm.foo == 0 {
+					return errNotFlushed
+				}
+				return nil
+			})),
+			hsm.Transition(hsm.On(hsm.ErrorEvent), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				caught.Store(event.Data)
+			})),
+		),
+		hsm.State("idle"),
+	)
+	observer := &recordingObserver{}
+	sm := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{EventObserver: observer})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "disconnect"})
+	if sm.State() != "/connected" || exits.Load() != 0 {
+		t.Fatalf("expected vetoed transition to leave state unchanged, got \"%s\" with %d exits", sm.State(), exits.Load())
+	}
+	observer.mutex.Lock()
+	vetoed := slices.Contains(observer.steps, "dropped disconnect") && !slices.ContainsFunc(observer.steps, func(step string) bool {
+		return strings.HasPrefix(step, "handled disconnect")
+	})
+	observer.mutex.Unlock()
+	if !vetoed {
+		t.Fatalf("expected the vetoed event to be reported as dropped, got %v", observer.steps)
+	}
+	if err, ok := caught.Load().(error); !ok || !errors.Is(err, errNotFlushed) {
+		t.Fatalf("expected an error event carrying the pre exit error, got %v", caught.Load())
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "flush"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "disconnect"})
+	if sm.State() != "/idle" || exits.Load() != 1 {
+		t.Fatalf("expected transition to \"/idle\" once validated, got \"%s\" with %d exits", sm.State(), exits.Load())
+	}
+	// a vetoed transition is not taken, so its occurrences keep counting
+	var allow atomic.Bool
+	counted := hsm.Define(
+		"TestPreExitCountHSM",
+		hsm.Initial(hsm.Target("playing")),
+		hsm.State("playing",
+			hsm.Transition(hsm.OnCount("strike", 2), hsm.Target("../out"), hsm.PreExit(func(ctx context.Context, sm *THSM, event hsm.Event) error {
+				if !allow.Load() {
+					return errNotFlushed
+				}
+				return nil
+			})),
+		),
+		hsm.State("out"),
+	)
+	sm = hsm.Start(context.Background(), &THSM{}, &counted)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "strike"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "strike"})
+	allow.Store(true)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "strike"})
+	if sm.State() != "/out" {
+		t.Fatalf("expected the occurrence counter to survive the veto, got %s", sm.State())
+	}
+}
+
+func TestInstancesOfModel(t *testing.T) {
+	other := hsm.Define(
+		"TestInstancesOfModelHSM",
+		hsm.Initial(hsm.Target("foo")),
+		hsm.State("foo"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &benchModel, hsm.Config{ID: "a", Deterministic: true})
+	hsm.Start(sm.Context(), &THSM{}, &other, hsm.Config{ID: "b", Deterministic: true})
+	hsm.Start(sm.Context(), &THSM{}, &other, hsm.Config{ID: "c", Deterministic: true})
+	ids := []string{}
+	for _, instance := range hsm.InstancesOfModel(sm.Context(), &other) {
+		ids = append(ids, hsm.ID(instance))
+	}
+	if !slices.Equal(ids, []string{"b", "c"}) {
+		t.Fatalf("expected only instances of the other model, got %v", ids)
+	}
+	if instances := hsm.InstancesOfModel(context.Background(), &other); len(instances) != 0 {
+		t.Fatalf("expected no instances without a registry, got %d", len(instances))
+	}
+}
+
+func TestIdle(t *testing.T) {
+	model := hsm.Define(
+		"TestIdleHSM",
+		hsm.Initial(hsm.Target("typing")),
+		hsm.State("typing",
+			hsm.Transition(hsm.On("keypress"), hsm.Effect(noBehavior)),
+			hsm.Idle(50*time.Millisecond, "../searching"),
+		),
+		hsm.State("searching",
+			hsm.Transition(hsm.On("keypress"), hsm.Target("../typing")),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	for range 5 {
+		time.Sleep(20 * time.Millisecond)
+		<-sm.Dispatch(context.Background(), hsm.Event{Name: "keypress"})
+	}
+	if sm.State() != "/typing" {
+		t.Fatalf("expected idle timer to be reset by each event, got \"%s\"", sm.State())
+	}
+	for deadline := time.Now().Add(time.Second); sm.State() != "/searching" && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if sm.State() != "/searching" {
+		t.Fatalf("expected state \"/searching\" after going idle, got \"%s\"", sm.State())
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "keypress"})
+	if sm.State() != "/typing" {
+		t.Fatalf("expected state \"/typing\" got \"%s\"", sm.State())
+	}
+	<-hsm.Stop(context.Background(), sm)
+}
+
+func TestDiagram(t *testing.T) {
+	model := hsm.Define(
+		"TestDiagramHSM",
+		hsm.Initial(hsm.Target("a/b")),
+		hsm.State("a",
+			hsm.State("b",
+				hsm.Transition(hsm.On("next"), hsm.Target("../../c")),
+			),
+		),
+		hsm.State("c"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	diagram := hsm.Diagram(sm)
+	if !strings.HasPrefix(diagram, "@startuml") || !strings.Contains(diagram, "state a #palegreen{") || !strings.Contains(diagram, "state a.b #palegreen\n") {
+		t.Fatalf("expected active states a and a.b to be highlighted, got:\n%s", diagram)
+	}
+	if strings.Contains(diagram, "state c #palegreen") {
+		t.Fatalf("expected inactive state c not to be highlighted, got:\n%s", diagram)
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "next"})
+	diagram = hsm.Diagram(sm)
+	if !strings.Contains(diagram, "state c #palegreen\n") || strings.Contains(diagram, "state a #palegreen") {
+		t.Fatalf("expected only state c to be highlighted, got:\n%s", diagram)
+	}
+}
+
+func TestActivityIf(t *testing.T) {
+	var starts atomic.Int32
+	model := hsm.Define(
+		"TestActivityIfHSM",
+		hsm.Initial(hsm.Target("polling")),
+		hsm.State("polling",
+			hsm.ActivityIf(
+				func(ctx context.Context, sm *THSM, event hsm.Event) bool {
+					return sm.foo == 1
+				},
+				func(ctx context.Context, sm *THSM, event hsm.Event) {
+					starts.Add(1)
+					<-ctx.Done()
+				},
+			),
+			hsm.Transition(hsm.On("stop"), hsm.Target("../stopped")),
+		),
+		hsm.State("stopped",
+			hsm.Transition(hsm.On("enable"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				sm.foo = 1
+			})),
+			hsm.Transition(hsm.On("start"), hsm.Target("../polling")),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	started := time.Now()
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "stop"})
+	if elapsed := time.Since(started); elapsed > 100*time.Millisecond {
+		t.Fatalf("expected exit not to wait for an activity that never started, took %s", elapsed)
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "start"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "stop"})
+	if starts.Load() != 0 {
+		t.Fatalf("expected activity not to start while the predicate is false, got %d starts", starts.Load())
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "enable"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "start"})
+	for deadline := time.Now().Add(time.Second); starts.Load() == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if starts.Load() != 1 {
+		t.Fatalf("expected activity to start once the predicate holds, got %d starts", starts.Load())
+	}
+}
+
+type recordingObserver struct {
+	mutex sync.Mutex
+	steps []string
+}
+
+func (observer *recordingObserver) record(step string) {
+	observer.mutex.Lock()
+	defer observer.mutex.Unlock()
+	observer.steps = append(observer.steps, step)
+}
+
+func (observer *recordingObserver) Queued(ctx context.Context, sm hsm.Instance, event hsm.Event) {
+	observer.record("queued " + event.Name)
+}
+
+func (observer *recordingObserver) Processed(ctx context.Context, sm hsm.Instance, event hsm.Event) {
+	observer.record("processed " + event.Name)
+}
+
+func (observer *recordingObserver) Deferred(ctx context.Context, sm hsm.Instance, event hsm.Event) {
+	observer.record("deferred " + event.Name)
+}
+
+func (observer *recordingObserver) Dropped(ctx context.Context, sm hsm.Instance, event hsm.Event) {
+	observer.record("dropped " + event.Name)
+}
+
+func (observer *recordingObserver) Handled(ctx context.Context, sm hsm.Instance, event hsm.Event, from, to string) {
+	observer.record(fmt.Sprintf("handled %s %s->%s", event.Name, from, to))
+}
+
+func TestEventObserver(t *testing.T) {
+	model := hsm.Define(
+		"TestEventObserverHSM",
+		hsm.Initial(hsm.Target("foo")),
+		hsm.State("foo",
+			hsm.Defer("later"),
+			hsm.Transition(hsm.On("go"), hsm.Target("../bar")),
+		),
+		hsm.State("bar"),
+	)
+	observer := &recordingObserver{}
+	sm := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{
+		EventObserver: observer,
+		DedupeWindow:  time.Minute,
+	})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "later"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "go", DedupeKey: "a"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "go", DedupeKey: "a"})
+	observer.mutex.Lock()
+	defer observer.mutex.Unlock()
+	expected := []string{
+		"queued later",
+		"deferred later",
+		"processed later",
+		"queued go",
+		"handled go /foo->/bar",
+		"processed go",
+		"dropped later",
+		"processed later",
+		"dropped go",
+	}
+	if !slices.Equal(observer.steps, expected) {
+		t.Fatalf("expected steps %v, got %v", expected, observer.steps)
+	}
+}
+
+func TestEventObserverQueuedFirst(t *testing.T) {
+	model := hsm.Define(
+		"TestEventObserverQueuedFirstHSM",
+		hsm.Initial(hsm.Target("foo")),
+		hsm.State("foo"),
+	)
+	observer := &recordingObserver{}
+	sm := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{EventObserver: observer})
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-sm.Dispatch(context.Background(), hsm.Event{Name: fmt.Sprintf("e%d", i)})
+		}()
+	}
+	wg.Wait()
+	observer.mutex.Lock()
+	defer observer.mutex.Unlock()
+	queued := map[string]bool{}
+	for _, step := range observer.steps {
+		if name, ok := strings.CutPrefix(step, "queued "); ok {
+			queued[name] = true
+		} else if name, ok := strings.CutPrefix(step, "processed "); ok && !queued[name] {
+			t.Fatalf("expected %s to be observed as queued before processed", name)
+		}
+	}
+}
+
+func TestGuardExpr(t *testing.T) {
+	type Customer struct {
+		Tier string
+	}
+	type Order struct {
+		Amount   int
+		Customer *Customer
+	}
+	model := hsm.Define(
+		"TestGuardExprHSM",
+		hsm.Initial(hsm.Target("pending")),
+		hsm.State("pending",
+			hsm.Transition(hsm.On("charge"), hsm.Target("../approved"), hsm.GuardExpr("event.amount > 100 && data.customer.tier == 'gold'")),
+			hsm.Transition(hsm.On("charge"), hsm.Target("../review"), hsm.GuardExpr(`!(hsm.foo >= 3) || event.name != "charge"`)),
+			hsm.Transition(hsm.On("charge"), hsm.Target("../rejected")),
+		),
+		hsm.State("approved"),
+		hsm.State("review"),
+		hsm.State("rejected"),
+	)
+	cases := []struct {
+		foo      int
+		data     any
+		expected string
+	}{
+		{0, &Order{Amount: 150, Customer: &Customer{Tier: "gold"}}, "/approved"},
+		{0, map[string]any{"amount": 150.5, "customer": map[string]string{"tier": "gold"}}, "/approved"},
+		{0, &Order{Amount: 150, Customer: &Customer{Tier: "silver"}}, "/review"},
+		{0, &Order{Amount: 50}, "/review"},
+		{3, nil, "/rejected"},
+	}
+	for _, c := range cases {
+		sm := hsm.Start(context.Background(), &THSM{foo: c.foo}, &model)
+		<-sm.Dispatch(context.Background(), hsm.Event{Name: "charge", Data: c.data})
+		if sm.State() != c.expected {
+			t.Fatalf("expected state \"%s\" for %+v, got \"%s\"", c.expected, c.data, sm.State())
+		}
+	}
+	for _, expr := range []string{"event.amount >", "(true", "amount > 1", "'open", "a # b", "event..amount"} {
+		func() {
+			defer func() {
+				r := recover()
+				if r == nil || !strings.Contains(fmt.Sprint(r), "invalid guard expression") {
+					t.Fatalf("expected %q to fail at Define time, got: %v", expr, r)
+				}
+			}()
+			hsm.Define("TestGuardExprInvalidHSM",
+				hsm.Initial(hsm.Target("foo")),
+				hsm.State("foo", hsm.Transition(hsm.On("a"), hsm.Target("."), hsm.GuardExpr(expr))),
+			)
+		}()
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	var exits atomic.Int32
+	model := hsm.Define(
+		"TestDeadlineHSM",
+		hsm.Initial(hsm.Target("session")),
+		hsm.State("session",
+			hsm.Exit(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				exits.Add(1)
+			}),
+			hsm.Transition(hsm.On("end"), hsm.Target("../done")),
+		),
+		hsm.Final("done"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{
+		Deadline: time.Now().Add(20 * time.Millisecond),
+	})
+	if hsm.Termination(sm) != hsm.NotTerminated {
+		t.Fatalf("expected a running instance, got %s", hsm.Termination(sm))
+	}
+	select {
+	case <-sm.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the instance context to expire at the deadline")
+	}
+	for deadline := time.Now().Add(time.Second); exits.Load() == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if hsm.Termination(sm) != hsm.DeadlineExceeded || exits.Load() != 1 {
+		t.Fatalf("expected teardown with reason deadline_exceeded, got %s with %d exits", hsm.Termination(sm), exits.Load())
+	}
+
+	sm = hsm.Start(context.Background(), &THSM{}, &model)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "end"})
+	if hsm.Termination(sm) != hsm.Finished {
+		t.Fatalf("expected reason finished, got %s", hsm.Termination(sm))
+	}
+	<-hsm.Restart(context.Background(), sm)
+	if hsm.Termination(sm) != hsm.NotTerminated {
+		t.Fatalf("expected restart to reset the reason, got %s", hsm.Termination(sm))
+	}
+	<-hsm.Stop(context.Background(), sm)
+	if hsm.Termination(sm) != hsm.Stopped {
+		t.Fatalf("expected reason stopped, got %s", hsm.Termination(sm))
+	}
+}
+
+func TestTurnScratch(t *testing.T) {
+	var computations atomic.Int32
+	var missing atomic.Bool
+	quote := func(ctx context.Context) any {
+		if value, ok := hsm.TurnScratch(ctx).Load("quote"); ok {
+			return value
+		}
+		value := fmt.Sprint(computations.Add(1))
+		hsm.TurnScratch(ctx).Store("quote", value)
+		return value
+	}
+	var first, second atomic.Value
+	model := hsm.Define(
+		"TestTurnScratchHSM",
+		hsm.Initial(hsm.Target("a")),
+		hsm.State("a",
+			hsm.Entry(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				missing.Store(hsm.TurnScratch(ctx) == nil)
+			}),
+			hsm.Transition(hsm.On("go"), hsm.Target("../b"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				first.Store(quote(ctx))
+				sm.Dispatch(ctx, hsm.Event{Name: "next"})
+			})),
+		),
+		hsm.State("b",
+			hsm.Transition(hsm.On("next"), hsm.Target("../a"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				second.Store(quote(ctx))
+			})),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "go"})
+	if first.Load() != "1" || second.Load() != "1" {
+		t.Fatalf("expected effects in the same turn to share the scratch space, got %v and %v", first.Load(), second.Load())
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "go"})
+	if first.Load() != "2" || missing.Load() {
+		t.Fatalf("expected a fresh scratch space for a new turn, got %v", first.Load())
+	}
+	if hsm.TurnScratch(context.Background()) != nil {
+		t.Fatal("expected no scratch space outside a processing turn")
+	}
+}
+
+func TestStopChildren(t *testing.T) {
+	var mutex sync.Mutex
+	order := []string{}
+	define := func(name string) hsm.Model {
+		return hsm.Define(
+			name,
+			hsm.Initial(hsm.Target("running")),
+			hsm.State("running",
+				hsm.Exit(func(ctx context.Context, sm *THSM, event hsm.Event) {
+					mutex.Lock()
+					defer mutex.Unlock()
+					order = append(order, hsm.ID(sm))
+				}),
+			),
+		)
+	}
+	parentModel, childModel := define("TestStopChildrenParentHSM"), define("TestStopChildrenChildHSM")
+	parent := hsm.Start(context.Background(), &THSM{}, &parentModel, hsm.Config{ID: "parent", StopChildren: true})
+	a := hsm.Start(parent.Context(), &THSM{}, &childModel, hsm.Config{ID: "a"})
+	hsm.Start(a.Context(), &THSM{}, &childModel, hsm.Config{ID: "a.1"})
+	hsm.Start(parent.Context(), &THSM{}, &childModel, hsm.Config{ID: "b"})
+	<-hsm.Stop(context.Background(), parent)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !slices.Equal(order, []string{"a.1", "a", "b", "parent"}) {
+		t.Fatalf("expected children to stop leaf to root before the parent, got %v", order)
+	}
+	if instances, _ := hsm.InstancesFromContext(parent.Context()); len(instances) != 0 {
+		t.Fatalf("expected no instances left, got %d", len(instances))
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	var bubbled atomic.Int32
+	model := hsm.Define(
+		"TestIgnoreHSM",
+		hsm.Initial(hsm.Target("parent/child")),
+		hsm.State("parent",
+			hsm.Transition(hsm.On("heartbeat"), hsm.On("metrics.cpu"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				bubbled.Add(1)
+			})),
+			hsm.State("child",
+				hsm.Ignore("heartbeat", "metrics.*"),
+				hsm.Transition(hsm.On("metrics.reset"), hsm.Target("../other")),
+			),
+			hsm.State("other"),
+		),
+	)
+	observer := &recordingObserver{}
+	sm := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{EventObserver: observer})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "heartbeat"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "metrics.cpu"})
+	if bubbled.Load() != 0 {
+		t.Fatalf("expected ignored events not to bubble up, got %d", bubbled.Load())
+	}
+	observer.mutex.Lock()
+	if slices.ContainsFunc(observer.steps, func(step string) bool { return strings.HasPrefix(step, "dropped") }) {
+		t.Fatalf("expected ignored events not to be reported as dropped, got %v", observer.steps)
+	}
+	observer.mutex.Unlock()
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "metrics.reset"})
+	if sm.State() != "/parent/other" {
+		t.Fatalf("expected transitions to take precedence over ignored events, got \"%s\"", sm.State())
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "heartbeat"})
+	if bubbled.Load() != 1 {
+		t.Fatalf("expected events to bubble up once the ignoring state is exited, got %d", bubbled.Load())
+	}
+}
+
+func TestTiming(t *testing.T) {
+	model := hsm.Define(
+		"TestTimingHSM",
+		hsm.Initial(hsm.Target("foo")),
+		hsm.State("foo",
+			hsm.Transition(hsm.On("next"), hsm.Target("../bar")),
+		),
+		hsm.State("bar"),
+	)
+	before := time.Now()
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	timing := hsm.Timing(sm)
+	if timing.StartedAt.Before(before) || !timing.LastTransitionAt.IsZero() || !timing.LastDispatchAt.IsZero() {
+		t.Fatalf("expected only a start timestamp, got %+v", timing)
+	}
+	time.Sleep(2 * time.Millisecond)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "unknown"})
+	timing = hsm.Timing(sm)
+	if !timing.LastDispatchAt.After(timing.StartedAt) || !timing.LastTransitionAt.IsZero() {
+		t.Fatalf("expected a dispatch without a transition, got %+v", timing)
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "next"})
+	timing = hsm.TakeSnapshot(context.Background(), sm).Timing
+	if timing.LastTransitionAt.Before(timing.LastDispatchAt) || timing.LastActivityAt() != timing.LastTransitionAt {
+		t.Fatalf("expected the transition to be the last activity, got %+v", timing)
+	}
+	if timing.Uptime() < 2*time.Millisecond {
+		t.Fatalf("expected an uptime of at least 2ms, got %s", timing.Uptime())
+	}
+	<-hsm.Restart(context.Background(), sm)
+	if restarted := hsm.Timing(sm); !restarted.StartedAt.After(timing.StartedAt) || !restarted.LastDispatchAt.IsZero() {
+		t.Fatalf("expected restart to reset the timestamps, got %+v", restarted)
+	}
+}
+
+func TestWasIn(t *testing.T) {
+	wasInEditor := func(ctx context.Context, sm *THSM, event hsm.Event) bool {
+		return hsm.WasIn(ctx, "/editor")
+	}
+	model := hsm.Define(
+		"TestWasInHSM",
+		hsm.Initial(hsm.Target("home")),
+		hsm.State("home",
+			hsm.Transition(hsm.On("edit"), hsm.Target("../editor/text")),
+			hsm.Transition(hsm.On("settings"), hsm.Target("../settings")),
+		),
+		hsm.State("editor",
+			hsm.State("text"),
+			hsm.Transition(hsm.On("settings"), hsm.Target("../settings")),
+		),
+		hsm.State("settings",
+			hsm.Transition(hsm.On("noop"), hsm.Effect(noBehavior)),
+			hsm.Transition(hsm.On("back"), hsm.Target("../editor/text"), hsm.Guard(wasInEditor)),
+			hsm.Transition(hsm.On("back"), hsm.Target("../home")),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "settings"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "back"})
+	if sm.State() != "/home" {
+		t.Fatalf("expected to return home when not coming from the editor, got \"%s\"", sm.State())
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "edit"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "settings"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "noop"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "back"})
+	if sm.State() != "/editor/text" {
+		t.Fatalf("expected to return to the editor, got \"%s\"", sm.State())
+	}
+	if !hsm.WasIn(sm.Context(), "/set*") || hsm.WasIn(sm.Context(), "/home") {
+		t.Fatal("expected the previous configuration to be the settings state")
+	}
+}
+
+func TestOnPanic(t *testing.T) {
+	var starts atomic.Int32
+	var origins sync.Map
+	model := hsm.Define(
+		"TestOnPanicHSM",
+		hsm.Initial(hsm.Target("running")),
+		hsm.State("running",
+			hsm.Activity(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				if starts.Add(1) == 1 {
+					panic("activity crashed")
+				}
+				<-ctx.Done()
+			}),
+			hsm.Transition(hsm.On("crash"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				panic("effect crashed")
+			})),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{
+		OnPanic: func(ctx context.Context, sm hsm.Instance, info hsm.Panic) hsm.PanicAction {
+			origins.Store(info.Origin, info.QualifiedName)
+			if info.Origin == hsm.ActivityPanic {
+				return hsm.RestartActivity
+			}
+			return hsm.StopInstance
+		},
+	})
+	for deadline := time.Now().Add(time.Second); starts.Load() < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if starts.Load() != 2 {
+		t.Fatalf("expected the crashed activity to be restarted, got %d starts", starts.Load())
+	}
+	if name, ok := origins.Load(hsm.ActivityPanic); !ok || !strings.HasPrefix(name.(string), "/running/") {
+		t.Fatalf("expected an activity panic naming the activity, got %v", name)
+	}
+	if sm.State() != "/running" {
+		t.Fatalf("expected state \"/running\" got \"%s\"", sm.State())
+	}
+	sm.Dispatch(context.Background(), hsm.Event{Name: "crash"})
+	for deadline := time.Now().Add(time.Second); hsm.Termination(sm) != hsm.Stopped && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if hsm.Termination(sm) != hsm.Stopped {
+		t.Fatalf("expected an effect panic to stop the instance, got %s", hsm.Termination(sm))
+	}
+	if _, ok := origins.Load(hsm.ProcessingPanic); !ok {
+		t.Fatal("expected a processing panic")
+	}
+}
+
+func TestActiveContexts(t *testing.T) {
+	var polls, syncs atomic.Int32
+	poll := func(ctx context.Context, sm *THSM, event hsm.Event) {
+		polls.Add(1)
+		<-ctx.Done()
+	}
+	sync := func(ctx context.Context, sm *THSM, event hsm.Event) {
+		syncs.Add(1)
+	}
+	model := hsm.Define(
+		"TestActiveContextsHSM",
+		hsm.Initial(hsm.Target("connected")),
+		hsm.State("connected",
+			hsm.Activity(poll, sync),
+			hsm.Transition(hsm.On("disconnect"), hsm.Target("../idle")),
+		),
+		hsm.State("idle",
+			hsm.Transition(hsm.On("connect"), hsm.Target("../connected")),
+		),
+	)
+	activities := model.Members()["/connected"].(interface{ Activities() []string }).Activities()
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	for deadline := time.Now().Add(time.Second); (polls.Load() == 0 || syncs.Load() == 0) && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	var running []string
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if running = hsm.ActiveContexts(sm); slices.Equal(running, []string{activities[0]}) {
+			break
+		}
+	}
+	if !slices.Equal(running, []string{activities[0]}) {
+		t.Fatalf("expected only %s to be running, got %v", activities[0], running)
+	}
+	<-hsm.ReactivateContexts(context.Background(), sm, activities...)
+	for deadline := time.Now().Add(time.Second); syncs.Load() < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if polls.Load() != 1 || syncs.Load() != 2 {
+		t.Fatalf("expected only the finished activity to be reactivated, got %d polls and %d syncs", polls.Load(), syncs.Load())
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "disconnect"})
+	if running := hsm.ActiveContexts(sm); len(running) != 0 {
+		t.Fatalf("expected no running activities, got %v", running)
+	}
+	<-hsm.ReactivateContexts(context.Background(), sm, activities...)
+	if polls.Load() != 1 {
+		t.Fatalf("expected activities of inactive states not to be reactivated, got %d polls", polls.Load())
+	}
+}
+
+func TestQueueCapacity(t *testing.T) {
+	var order []int
+	var sm *THSM
+	model := hsm.Define(
+		"TestQueueCapacityHSM",
+		hsm.Initial(hsm.Target("counting")),
+		hsm.State("counting",
+			hsm.Transition(hsm.On("tick"), hsm.Effect(func(ctx context.Context, _ *THSM, event hsm.Event) {
+				n := event.Data.(int)
+				order = append(order, n)
+				// keep two events pending so the ring buffer wraps around without growing
+				if n+2 < 50 {
+					sm.Dispatch(ctx, hsm.Event{Name: "tick", Data: n + 2})
+				}
+			})),
+		),
+	)
+	sm = hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{QueueCapacity: 2})
+	<-hsm.DispatchSeq(context.Background(), sm, hsm.Event{Name: "tick", Data: 0}, hsm.Event{Name: "tick", Data: 1})
+	for deadline := time.Now().Add(time.Second); hsm.TakeSnapshot(context.Background(), sm).QueueLen > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if len(order) != 50 {
+		t.Fatalf("expected 50 events to be processed, got %d", len(order))
+	}
+	for i, n := range order {
+		if n != i {
+			t.Fatalf("expected events in dispatch order, got %v", order)
+		}
+	}
+	if max := hsm.TakeSnapshot(context.Background(), sm).MaxQueueLen; max != 2 {
+		t.Fatalf("expected at most 2 pending events, got %d", max)
+	}
+}
+
+func BenchmarkQueueCapacity(b *testing.B) {
+	ctx := context.Background()
+	instance := hsm.Start(ctx, &THSM{}, &benchModel, hsm.Config{QueueCapacity: 64})
+	fooEvent := hsm.Event{Name: "foo"}
+	barEvent := hsm.Event{Name: "bar"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		<-instance.Dispatch(ctx, fooEvent)
+		<-instance.Dispatch(ctx, barEvent)
+	}
+	b.StopTimer()
+	<-hsm.Stop(ctx, instance)
+}
+
+func TestOnSegments(t *testing.T) {
+	if hsm.EventPath("order", "item", "added") != "order.item.added" {
+		t.Fatalf("unexpected event path %q", hsm.EventPath("order", "item", "added"))
+	}
+	for _, c := range []struct {
+		value, pattern string
+		match          bool
+	}{
+		{"order.created", "order.*", true},
+		{"ordering", "order.*", false},
+		{"order.item.added", "order.*", false},
+		{"order.item.added", "order.*.added", true},
+		{"order.item.added", "*.*.*", true},
+		{"order.created", "order.cre*", true},
+		{"K.P.A", "*.P.*", true},
+		{"K.X.A", "*.P.*", false},
+	} {
+		if hsm.MatchSegments(c.value, c.pattern) != c.match {
+			t.Errorf("expected MatchSegments(%q, %q) to be %v", c.value, c.pattern, c.match)
+		}
+	}
+	model := hsm.Define(
+		"TestOnSegmentsHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle",
+			hsm.Transition(hsm.OnSegments(hsm.EventPath("order", "*")), hsm.Target("../processing")),
+		),
+		hsm.State("processing",
+			hsm.Transition(hsm.On("order*"), hsm.Target("../idle")),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "ordering"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "order.item.added"})
+	if sm.State() != "/idle" {
+		t.Fatalf("expected segment pattern not to match, got state %s", sm.State())
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "order.created"})
+	if sm.State() != "/processing" {
+		t.Fatalf("expected segment pattern to match, got state %s", sm.State())
+	}
+	// character globs are unaffected
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "ordering"})
+	if sm.State() != "/idle" {
+		t.Fatalf("expected character glob to match, got state %s", sm.State())
+	}
+}
+
+type reparentMarker struct{}
+
+func TestReparent(t *testing.T) {
+	var polls atomic.Int32
+	var done, marked atomic.Value
+	poll := func(ctx context.Context, sm *THSM, event hsm.Event) {
+		polls.Add(1)
+		marked.Store(ctx.Value(reparentMarker{}) == true)
+		done.Store(ctx.Done())
+		<-ctx.Done()
+	}
+	model := hsm.Define(
+		"TestReparentHSM",
+		hsm.Initial(hsm.Target("running")),
+		hsm.State("running",
+			hsm.Entry(noBehavior),
+			hsm.Activity(poll),
+			hsm.Transition(hsm.On("done"), hsm.Target("../finished")),
+		),
+		hsm.State("finished"),
+	)
+	request, cancel := context.WithCancel(context.Background())
+	sm := hsm.Start(request, &THSM{}, &model)
+	for deadline := time.Now().Add(time.Second); polls.Load() == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	previous := done.Load().(<-chan struct{})
+	<-hsm.Reparent(sm, context.WithValue(context.Background(), reparentMarker{}, true))
+	select {
+	case <-previous:
+	default:
+		t.Fatal("expected the activity context derived from the request to be cancelled")
+	}
+	for deadline := time.Now().Add(time.Second); polls.Load() < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if polls.Load() != 2 {
+		t.Fatalf("expected the activity to be started again once, got %d runs", polls.Load())
+	}
+	migrated := done.Load().(<-chan struct{})
+	if !marked.Load().(bool) {
+		t.Fatal("expected the activity context to derive from the new context")
+	}
+	if sm.State() != "/running" {
+		t.Fatalf("expected the state to be kept, got %s", sm.State())
+	}
+	cancel()
+	select {
+	case <-migrated:
+		t.Fatal("expected the activity to outlive the request context")
+	default:
+	}
+	if sm.Context().Err() != nil {
+		t.Fatal("expected the instance to outlive the request context")
+	}
+	if _, ok := hsm.InstancesFromContext(sm.Context()); !ok {
+		t.Fatal("expected the instances map to be kept")
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "done"})
+	if sm.State() != "/finished" {
+		t.Fatalf("expected the instance to keep processing events, got %s", sm.State())
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	model := hsm.Define(
+		"TestRegistryHSM",
+		hsm.Initial(hsm.Target("pending")),
+		hsm.State("pending",
+			hsm.Transition(hsm.On("cancel"), hsm.Target("../cancelled")),
+		),
+		hsm.State("cancelled"),
+	)
+	registry := hsm.NewRegistry()
+	ctx := registry.Context(context.Background())
+	first := hsm.Start(ctx, &THSM{}, &model, hsm.Config{ID: "order-1"})
+	second := hsm.Start(ctx, &THSM{}, &model, hsm.Config{ID: "order-2"})
+	if instance, ok := registry.Get("order-1"); !ok || hsm.ID(instance) != hsm.ID(first) {
+		t.Fatal("expected to get the first instance")
+	}
+	if _, ok := registry.Get("order-3"); ok {
+		t.Fatal("expected no instance for an unknown ID")
+	}
+	if fromContext, ok := hsm.RegistryFromContext(second.Context()); !ok {
+		t.Fatal("expected the registry in the instance context")
+	} else if instance, ok := fromContext.Get("order-2"); !ok || hsm.ID(instance) != hsm.ID(second) {
+		t.Fatal("expected to get the second instance")
+	}
+	// a request context shares nothing with the instances
+	request, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	<-registry.DispatchTo(request, hsm.Event{Name: "cancel"}, "order-1")
+	if first.State() != "/cancelled" || second.State() != "/pending" {
+		t.Fatalf("expected only the first instance to be cancelled, got %s and %s", first.State(), second.State())
+	}
+	<-hsm.Stop(context.Background(), first)
+	if _, ok := registry.Get("order-1"); ok {
+		t.Fatal("expected stopped instances to be removed from the registry")
+	}
+}
+
+func TestTransitionCounts(t *testing.T) {
+	model := hsm.Define(
+		"TestTransitionCountsHSM",
+		hsm.Initial(hsm.Target("off")),
+		hsm.State("off",
+			hsm.Transition("switchOn", hsm.On("toggle"), hsm.Target("../on")),
+		),
+		hsm.State("on",
+			hsm.Transition("switchOff", hsm.On("toggle"), hsm.Target("../off")),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	initial := hsm.TakeSnapshot(context.Background(), sm).Transitions
+	for range 3 {
+		<-sm.Dispatch(context.Background(), hsm.Event{Name: "toggle"})
+	}
+	if transitions := hsm.TakeSnapshot(context.Background(), sm).Transitions; transitions != initial+3 {
+		t.Fatalf("expected %d transitions, got %d", initial+3, transitions)
+	}
+	counts := hsm.TransitionCounts(sm)
+	if counts["/off/switchOn"] != 2 || counts["/on/switchOff"] != 1 {
+		t.Fatalf("unexpected transition counts %v", counts)
+	}
+	hsm.Restart(context.Background(), sm)
+	if counts := hsm.TransitionCounts(sm); counts["/off/switchOn"] != 0 || counts["/on/switchOff"] != 0 {
+		t.Fatalf("expected counts to be reset on restart, got %v", counts)
+	}
+}
+
+func TestDispatchCompletion(t *testing.T) {
+	var order []string
+	release := make(chan struct{})
+	record := func(name string) func(ctx context.Context, sm *THSM, event hsm.Event) {
+		return func(ctx context.Context, sm *THSM, event hsm.Event) {
+			order = append(order, name)
+			if name == "hold" {
+				<-release
+			}
+		}
+	}
+	model := hsm.Define(
+		"TestDispatchCompletionHSM",
+		hsm.Initial(hsm.Target("working")),
+		hsm.State("working",
+			hsm.State("step"),
+			hsm.Initial(hsm.Target("step")),
+			hsm.Transition(hsm.On("leave"), hsm.Source("step"), hsm.Target("/working")),
+			hsm.Transition(hsm.OnCompletion(), hsm.Target("../done"), hsm.Effect(record("completed"))),
+			hsm.Transition(hsm.On("hold"), hsm.Effect(record("hold"))),
+			hsm.Transition(hsm.On("next"), hsm.Effect(record("next"))),
+		),
+		hsm.State("done"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	// completing the nested state does not complete its parent
+	<-hsm.DispatchCompletion(context.Background(), sm)
+	if sm.State() != "/working/step" || len(order) != 0 {
+		t.Fatalf("expected the completion of step to be dropped, got %s and %v", sm.State(), order)
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "leave"})
+	if sm.State() != "/working" {
+		t.Fatalf("expected working to be the current state, got %s", sm.State())
+	}
+	held := sm.Dispatch(context.Background(), hsm.Event{Name: "hold"})
+	for deadline := time.Now().Add(time.Second); !hsm.IsProcessing(sm) && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	sm.Dispatch(context.Background(), hsm.Event{Name: "next"})
+	completed := hsm.DispatchCompletion(context.Background(), sm)
+	close(release)
+	<-held
+	<-completed
+	if sm.State() != "/done" {
+		t.Fatalf("expected working to complete, got %s", sm.State())
+	}
+	// the completion event is processed ahead of the regular event queued before it
+	if !slices.Equal(order, []string{"hold", "completed"}) {
+		t.Fatalf("unexpected order %v", order)
+	}
+}
+
+func TestGuardTimeout(t *testing.T) {
+	blocked := make(chan struct{})
+	defer close(blocked)
+	model := hsm.Define(
+		"TestGuardTimeoutHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle",
+			hsm.Transition(hsm.On("go"), hsm.Target("../slow"), hsm.Guard(func(ctx context.Context, sm *THSM, event hsm.Event) bool {
+				// a guard that is not cancellation-aware
+				<-blocked
+				return true
+			})),
+			hsm.Transition(hsm.On("go"), hsm.Target("../fallback")),
+			hsm.Transition(hsm.On("quick"), hsm.Target("../quick"), hsm.Guard(func(ctx context.Context, sm *THSM, event hsm.Event) bool {
+				return true
+			})),
+		),
+		hsm.State("slow"),
+		hsm.State("quick"),
+		hsm.State("fallback",
+			hsm.Transition(hsm.On("reset"), hsm.Target("../idle")),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{GuardTimeout: 10 * time.Millisecond})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "go"})
+	if sm.State() != "/fallback" {
+		t.Fatalf("expected the timed out guard to be treated as false, got %s", sm.State())
+	}
+	if timeouts := hsm.TakeSnapshot(context.Background(), sm).GuardTimeouts; timeouts != 1 {
+		t.Fatalf("expected 1 guard timeout, got %d", timeouts)
+	}
+	// only the guard timeout makes a guard false, not the cancellation of the dispatcher's context
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "reset"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	<-sm.Dispatch(ctx, hsm.Event{Name: "quick"})
+	if sm.State() != "/quick" {
+		t.Fatalf("expected the guard to pass with a cancelled dispatch context, got %s", sm.State())
+	}
+	if timeouts := hsm.TakeSnapshot(context.Background(), sm).GuardTimeouts; timeouts != 1 {
+		t.Fatalf("expected the cancellation not to count as a guard timeout, got %d timeouts", timeouts)
+	}
+}
+
+func TestCheckEventCoverage(t *testing.T) {
+	model := hsm.Define(
+		"TestCheckEventCoverageHSM",
+		hsm.Initial(hsm.Target("processing")),
+		hsm.State("processing",
+			hsm.Handles("stateChanged", "cancel", "metrics.*"),
+			hsm.Ignore("metrics.*"),
+			hsm.Transition("changed", hsm.On("stateChagned"), hsm.Target("../done")),
+			hsm.Transition(hsm.After(func(ctx context.Context, sm *THSM, event hsm.Event) time.Duration {
+				return time.Second
+			}), hsm.Target("../done")),
+		),
+		hsm.State("done",
+			hsm.Handles("restart"),
+			hsm.Transition("restart", hsm.On("restart"), hsm.Target("../processing")),
+		),
+		hsm.Transition("cancel", hsm.On("cancel"), hsm.Source("processing"), hsm.Target("done")),
+	)
+	coverage := hsm.CheckEventCoverage(&model)
+	if !reflect.DeepEqual(coverage.Undeclared, map[string][]string{"/processing/changed": {"stateChagned"}}) {
+		t.Fatalf("unexpected undeclared events %v", coverage.Undeclared)
+	}
+	if !reflect.DeepEqual(coverage.Unhandled, map[string][]string{"/processing": {"stateChanged"}}) {
+		t.Fatalf("unexpected unhandled events %v", coverage.Unhandled)
+	}
+	undeclared := hsm.Define(
+		"TestCheckEventCoverageUndeclaredHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle", hsm.Transition(hsm.On("anything"), hsm.Target("."))),
+	)
+	if coverage := hsm.CheckEventCoverage(&undeclared); len(coverage.Undeclared) != 0 || len(coverage.Unhandled) != 0 {
+		t.Fatalf("expected models without Handles to be fully covered, got %+v", coverage)
+	}
+}
+
+func TestStatesEqual(t *testing.T) {
+	release := make(chan struct{})
+	model := hsm.Define(
+		"TestStatesEqualHSM",
+		hsm.Initial(hsm.Target("follower")),
+		hsm.State("follower",
+			hsm.Transition(hsm.On("elect"), hsm.Target("../leader")),
+		),
+		hsm.State("leader",
+			hsm.State("active"),
+			hsm.Initial(hsm.Target("active")),
+			hsm.Transition(hsm.On("hold"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				<-release
+			})),
+		),
+	)
+	a := hsm.Start(context.Background(), &THSM{}, &model)
+	b := hsm.Start(context.Background(), &THSM{}, &model)
+	<-a.Dispatch(context.Background(), hsm.Event{Name: "elect"})
+	if hsm.StatesEqual(a, b) {
+		t.Fatal("expected replicas in different states not to be equal")
+	}
+	if diff := hsm.StateDiff(a, b); !strings.Contains(diff, "[/leader /leader/active] != [/follower]") {
+		t.Fatalf("unexpected diff %q", diff)
+	}
+	<-b.Dispatch(context.Background(), hsm.Event{Name: "elect"})
+	if diff := hsm.StateDiff(a, b); diff != "" {
+		t.Fatalf("expected converged replicas to be equal, got %q", diff)
+	}
+	held := a.Dispatch(context.Background(), hsm.Event{Name: "hold"})
+	for deadline := time.Now().Add(time.Second); !hsm.IsProcessing(a) && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	a.Dispatch(context.Background(), hsm.Event{Name: "elect"})
+	if diff := hsm.StateDiff(a, b); !strings.Contains(diff, "pending events: [elect] != []") {
+		t.Fatalf("unexpected diff %q", diff)
+	}
+	close(release)
+	<-held
+	if !hsm.StatesEqual(a, b) {
+		t.Fatalf("expected replicas to be equal once idle, got %q", hsm.StateDiff(a, b))
+	}
+}
+
+func TestReplay(t *testing.T) {
+	model := hsm.Define(
+		"TestReplayHSM",
+		hsm.Initial(hsm.Target("off")),
+		hsm.State("off",
+			hsm.Transition(hsm.On("toggle"), hsm.Target("../on")),
+		),
+		hsm.State("on",
+			// dispatched by the instance itself, so generated again rather than replayed
+			hsm.Entry(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				sm.Dispatch(ctx, hsm.Event{Name: "lit"})
+			}),
+			hsm.Transition(hsm.On("lit"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				sm.foo++
+			})),
+			hsm.Transition(hsm.On("toggle"), hsm.Target("../off")),
+		),
+	)
+	recorder := &hsm.Recorder{}
+	original := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{EventObserver: recorder})
+	for range 3 {
+		<-original.Dispatch(context.Background(), hsm.Event{Name: "toggle"})
+		time.Sleep(20 * time.Millisecond)
+	}
+	records := recorder.Records()
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(records))
+	}
+	recorded := records[2].At.Sub(records[0].At)
+	replica := hsm.Start(context.Background(), &THSM{}, &model)
+	start := time.Now()
+	<-hsm.Replay(context.Background(), replica, records, 0.5)
+	elapsed := time.Since(start)
+	if replica.State() != original.State() || replica.foo != original.foo {
+		t.Fatalf("expected the replica to reach %s with foo %d, got %s with foo %d", original.State(), original.foo, replica.State(), replica.foo)
+	}
+	if elapsed < recorded/2 || elapsed >= recorded {
+		t.Fatalf("expected the replay to take about %v, took %v", recorded/2, elapsed)
+	}
+	fast := hsm.Start(context.Background(), &THSM{}, &model)
+	start = time.Now()
+	<-hsm.Replay(context.Background(), fast, records, 0)
+	if elapsed := time.Since(start); elapsed >= recorded/2 || fast.State() != original.State() {
+		t.Fatalf("expected an immediate replay to %s, took %v and got %s", original.State(), elapsed, fast.State())
+	}
+}
+
+func TestMaxResidency(t *testing.T) {
+	var errs atomic.Value
+	model := hsm.Define(
+		"TestMaxResidencyHSM",
+		hsm.Initial(hsm.Target("provisioning")),
+		hsm.State("provisioning",
+			hsm.MaxResidency(30*time.Millisecond, "../failed"),
+			hsm.Transition(hsm.On("progress"), hsm.Effect(noBehavior)),
+			hsm.Transition(hsm.On("stall"), hsm.Target("../stalled")),
+		),
+		hsm.State("stalled",
+			hsm.MaxResidency(10*time.Millisecond, ""),
+		),
+		hsm.State("failed"),
+		hsm.Transition(hsm.On(hsm.ErrorEvent), hsm.Source("stalled"), hsm.Target("failed"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+			errs.Store(event.Data)
+		})),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	// unlike Idle, events do not extend the residency
+	for range 5 {
+		<-sm.Dispatch(context.Background(), hsm.Event{Name: "progress"})
+		time.Sleep(10 * time.Millisecond)
+	}
+	for deadline := time.Now().Add(time.Second); sm.State() != "/failed" && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if sm.State() != "/failed" {
+		t.Fatalf("expected the residency timeout to fire, got %s", sm.State())
+	}
+	other := hsm.Start(context.Background(), &THSM{}, &model)
+	<-other.Dispatch(context.Background(), hsm.Event{Name: "stall"})
+	for deadline := time.Now().Add(time.Second); other.State() != "/failed" && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if err, _ := errs.Load().(error); !errors.Is(err, hsm.ErrMaxResidency) {
+		t.Fatalf("expected an ErrMaxResidency error, got %v", errs.Load())
+	}
+}
+
+func TestKindName(t *testing.T) {
+	model := hsm.Define(
+		"TestKindNameHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle",
+			hsm.Transition("start", hsm.On("start"), hsm.Target("../done")),
+		),
+		hsm.Final("done"),
+	)
+	members := model.Members()
+	for name, expected := range map[string]string{"/idle": "State", "/done": "FinalState", "/idle/start": "External"} {
+		if kindName := hsm.KindName(members[name].Kind()); kindName != expected {
+			t.Errorf("expected %s to be a %s, got %s", name, expected, kindName)
+		}
+	}
+	if !hsm.IsKind(members["/done"].Kind(), hsm.StateKind) || hsm.IsKind(members["/idle"].Kind(), hsm.TransitionKind) {
+		t.Error("unexpected kind hierarchy")
+	}
+	if !hsm.IsKind(members["/idle/start"].Kind(), hsm.TransitionKind) {
+		t.Error("expected transitions to be a TransitionKind")
+	}
+}
+
+type methodHandlers struct {
+	name  string
+	calls *[]string
+}
+
+func (handlers *methodHandlers) onEntry(ctx context.Context, sm *THSM, event hsm.Event) {
+	*handlers.calls = append(*handlers.calls, handlers.name)
+}
+
+func TestMethodValueNames(t *testing.T) {
+	calls := []string{}
+	first := &methodHandlers{name: "first", calls: &calls}
+	second := &methodHandlers{name: "second", calls: &calls}
+	model := hsm.Define(
+		"TestMethodValueNamesHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle",
+			hsm.Entry(first.onEntry, second.onEntry),
+		),
+	)
+	entry := model.Members()["/idle"].(interface{ Entry() []string }).Entry()
+	if len(entry) != 2 || !strings.HasSuffix(entry[0], "_test.methodHandlers.onEntry") || entry[1] != entry[0]+"-2" {
+		t.Fatalf("unexpected entry names %v", entry)
+	}
+	hsm.Start(context.Background(), &THSM{}, &model)
+	if !slices.Equal(calls, []string{"first", "second"}) {
+		t.Fatalf("expected both receivers to be called, got %v", calls)
+	}
+}
+
+func TestOnTransitionNamed(t *testing.T) {
+	model := hsm.Define(
+		"TestOnTransitionNamedHSM",
+		hsm.Initial(hsm.Target("authorized")),
+		hsm.State("authorized",
+			hsm.Transition("payment_captured", hsm.On("capture"), hsm.Target("../captured")),
+			hsm.Transition("voided", hsm.On("void"), hsm.Target("../voided")),
+		),
+		hsm.State("captured",
+			hsm.Transition("refunded", hsm.On("refund"), hsm.Target("../authorized")),
+		),
+		hsm.State("voided"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	captured := hsm.OnTransitionNamed(sm, "/authorized/payment_captured")
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "capture", Data: 1})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "refund"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "capture", Data: 2})
+	for _, expected := range []int{1, 2} {
+		select {
+		case event := <-captured:
+			if event.Name != "capture" || event.Data != expected {
+				t.Fatalf("unexpected event %+v", event)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected the transition to be notified")
+		}
+	}
+	select {
+	case event := <-captured:
+		t.Fatalf("expected no notification for other transitions, got %+v", event)
+	default:
+	}
+	<-hsm.Stop(context.Background(), sm)
+	if _, ok := <-captured; ok {
+		t.Fatal("expected the channel to be closed when the instance stops")
+	}
+}
+
+func TestActivityFirst(t *testing.T) {
+	serving := make(chan struct{}, 2)
+	var sawServing []bool
+	serve := func(ctx context.Context, sm *THSM, event hsm.Event) {
+		serving <- struct{}{}
+		<-ctx.Done()
+	}
+	waitUntilServing := func(ctx context.Context, sm *THSM, event hsm.Event) {
+		select {
+		case <-serving:
+			sawServing = append(sawServing, true)
+		case <-time.After(50 * time.Millisecond):
+			sawServing = append(sawServing, false)
+		}
+	}
+	model := hsm.Define(
+		"TestActivityFirstHSM",
+		hsm.Initial(hsm.Target("first")),
+		hsm.State("first",
+			hsm.ActivityFirst(),
+			hsm.Activity(serve),
+			hsm.Entry(waitUntilServing),
+			hsm.Transition(hsm.On("next"), hsm.Target("../second")),
+		),
+		hsm.State("second",
+			hsm.Activity(serve),
+			hsm.Entry(waitUntilServing),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "next"})
+	if !slices.Equal(sawServing, []bool{true, false}) {
+		t.Fatalf("expected only the activity first state to run its activity before entry, got %v", sawServing)
+	}
+}
+
+func TestDispatchEvent(t *testing.T) {
+	model := hsm.Define(
+		"TestDispatchEventHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle",
+			hsm.Transition(hsm.On("start"), hsm.Target("../running")),
+		),
+		hsm.State("running"),
+	)
+	parent := hsm.Start(context.Background(), &THSM{}, &model)
+	child := hsm.Start(parent.Context(), &THSM{}, &model)
+	// the child's context resolves to the child, the explicit form targets the parent regardless
+	<-hsm.DispatchEvent(child.Context(), parent, hsm.Event{Name: "start"})
+	if parent.State() != "/running" || child.State() != "/idle" {
+		t.Fatalf("expected only the parent to start, got %s and %s", parent.State(), child.State())
+	}
+}
+
+func TestExitTo(t *testing.T) {
+	var calls []string
+	record := func(name string) func(ctx context.Context, sm *THSM, event hsm.Event) {
+		return func(ctx context.Context, sm *THSM, event hsm.Event) {
+			calls = append(calls, name)
+		}
+	}
+	model := hsm.Define(
+		"TestExitToHSM",
+		hsm.Initial(hsm.Target("uploading")),
+		hsm.State("uploading",
+			hsm.Exit(record("exit")),
+			hsm.ExitTo("../cancelled", record("cleanup")),
+			hsm.ExitTo("/done*", record("commit")),
+			hsm.Transition(hsm.On("cancel"), hsm.Target("../cancelled")),
+			hsm.Transition(hsm.On("finish"), hsm.Target("../done")),
+		),
+		hsm.State("cancelled",
+			hsm.Transition(hsm.On("retry"), hsm.Target("../uploading")),
+		),
+		hsm.State("done"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "cancel"})
+	if !slices.Equal(calls, []string{"exit", "cleanup"}) {
+		t.Fatalf("expected the cancel cleanup after the exit action, got %v", calls)
+	}
+	calls = nil
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "retry"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "finish"})
+	if !slices.Equal(calls, []string{"exit", "commit"}) {
+		t.Fatalf("expected the commit after the exit action, got %v", calls)
+	}
+	calls = nil
+	restarted := hsm.Start(context.Background(), &THSM{}, &model)
+	<-hsm.Stop(context.Background(), restarted)
+	if !slices.Equal(calls, []string{"exit"}) {
+		t.Fatalf("expected only the exit action when stopping, got %v", calls)
+	}
+}
+
+func TestCausalOrdering(t *testing.T) {
+	cascade := func(name string, completion string) func(ctx context.Context, sm *THSM, event hsm.Event) {
+		return func(ctx context.Context, sm *THSM, event hsm.Event) {
+			sm.Dispatch(ctx, hsm.Event{Name: name})
+			sm.Dispatch(ctx, hsm.Event{Name: completion, Kind: hsm.Kinds.CompletionEvent})
+		}
+	}
+	model := hsm.Define(
+		"TestCausalOrderingHSM",
+		hsm.Initial(hsm.Target("a")),
+		hsm.State("a", hsm.Transition(hsm.On("b"), hsm.Target("../b"))),
+		hsm.State("b",
+			hsm.Entry(cascade("e", "c")),
+			hsm.Transition(hsm.On("c"), hsm.Target("../c")),
+		),
+		hsm.State("c",
+			hsm.Entry(cascade("e", "d")),
+			hsm.Transition(hsm.On("d"), hsm.Target("../d")),
+		),
+		hsm.State("d"),
+	)
+	processed := func(config hsm.Config) []string {
+		observer := &recordingObserver{}
+		config.EventObserver = observer
+		sm := hsm.Start(context.Background(), &THSM{}, &model, config)
+		<-sm.Dispatch(context.Background(), hsm.Event{Name: "b"})
+		if sm.State() != "/d" {
+			t.Fatalf("expected state \"/d\" got \"%s\"", sm.State())
+		}
+		observer.mutex.Lock()
+		defer observer.mutex.Unlock()
+		events := []string{}
+		for _, step := range observer.steps {
+			if name, ok := strings.CutPrefix(step, "processed "); ok {
+				events = append(events, name)
+			}
+		}
+		return events
+	}
+	if events := processed(hsm.Config{}); !slices.Equal(events, []string{"b", "c", "d", "e", "e"}) {
+		t.Fatalf("unexpected default order %v", events)
+	}
+	if events := processed(hsm.Config{CausalOrdering: true}); !slices.Equal(events, []string{"b", "e", "c", "e", "d"}) {
+		t.Fatalf("unexpected causal order %v", events)
+	}
+}
+
+func TestStateBehaviors(t *testing.T) {
+	model := hsm.Define(
+		"TestStateBehaviorsHSM",
+		hsm.Initial(hsm.Target("connected")),
+		hsm.State("connected",
+			hsm.Entry(noBehavior),
+			hsm.Activity(noBehavior, noBehavior),
+		),
+	)
+	behaviors := hsm.StateBehaviors(&model, "/connected")
+	if len(behaviors.Entry) != 1 || len(behaviors.Exit) != 0 || len(behaviors.Activities) != 2 {
+		t.Fatalf("unexpected behaviors %+v", behaviors)
+	}
+	for _, name := range append(behaviors.Entry, behaviors.Activities...) {
+		if _, ok := model.Members()[name]; !ok || !strings.HasPrefix(name, "/connected/") {
+			t.Fatalf("expected %s to be a member of /connected", name)
+		}
+	}
+	if missing := hsm.StateBehaviors(&model, "/missing"); len(missing.Entry)+len(missing.Exit)+len(missing.Activities) != 0 {
+		t.Fatalf("expected no behaviors for a missing state, got %+v", missing)
+	}
+}
+
+type account struct {
+	hsm.HSM
+	balance int
+}
+
+func TestTransaction(t *testing.T) {
+	model := hsm.Define(
+		"TestTransactionHSM",
+		hsm.Initial(hsm.Target("open")),
+		hsm.State("open",
+			hsm.Transition(hsm.On("debit"),
+				hsm.Guard(func(ctx context.Context, sm *account, event hsm.Event) bool {
+					return sm.balance >= event.Data.(int)
+				}),
+				hsm.Effect(func(ctx context.Context, sm *account, event hsm.Event) {
+					sm.balance -= event.Data.(int)
+				}),
+			),
+			hsm.Transition(hsm.On("credit"),
+				hsm.Effect(func(ctx context.Context, sm *account, event hsm.Event) {
+					sm.balance += event.Data.(int)
+				}),
+			),
+		),
+	)
+	from := hsm.Start(context.Background(), &account{balance: 10}, &model)
+	to := hsm.Start(context.Background(), &account{}, &model)
+	transfer := func(amount int) error {
+		return hsm.Transaction(context.Background(), func(tx *hsm.Tx) error {
+			tx.Dispatch(from, hsm.Event{Name: "debit", Data: amount})
+			tx.Dispatch(to, hsm.Event{Name: "credit", Data: amount})
+			return nil
+		})
+	}
+	if err := transfer(7); err != nil {
+		t.Fatalf("expected the transfer to commit, got %v", err)
+	}
+	if from.balance != 3 || to.balance != 7 {
+		t.Fatalf("expected balances 3 and 7, got %d and %d", from.balance, to.balance)
+	}
+	if err := transfer(5); !errors.Is(err, hsm.ErrTxRejected) {
+		t.Fatalf("expected the overdraft to be rejected, got %v", err)
+	}
+	if from.balance != 3 || to.balance != 7 {
+		t.Fatalf("expected a rejected transfer to change nothing, got %d and %d", from.balance, to.balance)
+	}
+	abort := errors.New("abort")
+	err := hsm.Transaction(context.Background(), func(tx *hsm.Tx) error {
+		tx.Dispatch(to, hsm.Event{Name: "credit", Data: 1})
+		return abort
+	})
+	if err != abort || to.balance != 7 {
+		t.Fatalf("expected an aborted transaction to dispatch nothing, got %v and %d", err, to.balance)
+	}
+	// the instances keep processing events normally afterwards
+	<-from.Dispatch(context.Background(), hsm.Event{Name: "credit", Data: 2})
+	if from.balance != 5 {
+		t.Fatalf("expected balance 5, got %d", from.balance)
+	}
+}
+
+func TestTransactionReleaseContext(t *testing.T) {
+	found := make(chan bool, 1)
+	model := hsm.Define(
+		"TestTransactionReleaseContextHSM",
+		hsm.Initial(hsm.Target("open")),
+		hsm.State("open",
+			hsm.Transition(hsm.On("debit"), hsm.Guard(func(ctx context.Context, sm *account, event hsm.Event) bool {
+				// queued while the transaction holds the instance
+				sm.Dispatch(context.Background(), hsm.Event{Name: "probe"})
+				return false
+			}), hsm.Effect(noBehavior)),
+			hsm.Transition(hsm.On("probe"), hsm.Effect(func(ctx context.Context, sm *account, event hsm.Event) {
+				instance, ok := hsm.FromContext(ctx)
+				found <- ok && hsm.ID(instance) == hsm.ID(sm)
+			})),
+		),
+	)
+	sm := hsm.Start(context.Background(), &account{}, &model)
+	err := hsm.Transaction(context.Background(), func(tx *hsm.Tx) error {
+		tx.Dispatch(sm, hsm.Event{Name: "debit", Data: 1})
+		return nil
+	})
+	if !errors.Is(err, hsm.ErrTxRejected) {
+		t.Fatalf("expected the transaction to be rejected, got %v", err)
+	}
+	select {
+	case ok := <-found:
+		if !ok {
+			t.Fatal("expected events queued during the transaction to be processed with the instance context")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the queued event to be processed once released")
+	}
+}
+
+type exportedOrder struct {
+	Item     string
+	Quantity int
+}
+
+func TestExportEvents(t *testing.T) {
+	codec := hsm.NewJSONCodec()
+	codec.Register("order", exportedOrder{})
+	var received []any
+	model := hsm.Define(
+		"TestExportEventsHSM",
+		hsm.Initial(hsm.Target("busy")),
+		hsm.State("busy",
+			hsm.Defer("order"),
+			hsm.Transition(hsm.On("ready"), hsm.Target("../ready")),
+		),
+		hsm.State("ready",
+			hsm.Transition(hsm.On("order"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				received = append(received, event.Data)
+			})),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{Codec: codec})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "order", Data: exportedOrder{Item: "tea", Quantity: 2}})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "order", Data: map[string]any{"item": "milk"}})
+	saved, err := hsm.ExportEvents(sm)
+	if err != nil {
+		t.Fatalf("unexpected export error: %v", err)
+	}
+	restored := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{Codec: codec})
+	<-restored.Dispatch(context.Background(), hsm.Event{Name: "ready"})
+	done, err := hsm.ImportEvents(context.Background(), restored, saved)
+	if err != nil {
+		t.Fatalf("unexpected import error: %v", err)
+	}
+	<-done
+	expected := []any{exportedOrder{Item: "tea", Quantity: 2}, map[string]any{"item": "milk"}}
+	if !reflect.DeepEqual(received, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, received)
+	}
+}
+
+func TestExportEventsCompletionOrder(t *testing.T) {
+	var received []string
+	model := hsm.Define(
+		"TestExportEventsCompletionOrderHSM",
+		hsm.Initial(hsm.Target("busy")),
+		hsm.State("busy",
+			hsm.Defer("step.*", "order"),
+			hsm.Transition(hsm.On("ready"), hsm.Target("../ready")),
+		),
+		hsm.State("ready",
+			hsm.Transition(hsm.On("step.*", "order"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				received = append(received, event.Name)
+			})),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	for _, name := range []string{"step.1", "order", "step.2", "step.3"} {
+		event := hsm.Event{Name: name}
+		if name != "order" {
+			event.Kind = hsm.CompletionEventKind
+		}
+		<-sm.Dispatch(context.Background(), event)
+	}
+	saved, err := hsm.ExportEvents(sm)
+	if err != nil {
+		t.Fatalf("unexpected export error: %v", err)
+	}
+	restored := hsm.Start(context.Background(), &THSM{}, &model)
+	<-restored.Dispatch(context.Background(), hsm.Event{Name: "ready"})
+	done, err := hsm.ImportEvents(context.Background(), restored, saved)
+	if err != nil {
+		t.Fatalf("unexpected import error: %v", err)
+	}
+	<-done
+	// completion events keep their exported order and are processed ahead of regular events
+	expected := []string{"step.1", "step.2", "step.3", "order"}
+	if !slices.Equal(received, expected) {
+		t.Fatalf("expected %v, got %v", expected, received)
+	}
+}
+
+func TestRandomEvent(t *testing.T) {
+	model := hsm.Define(
+		"TestRandomEventHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle",
+			hsm.Transition(hsm.On("start"), hsm.Target("../running")),
+		),
+		hsm.State("running",
+			hsm.Transition(hsm.On("job.*.done"), hsm.Target("../idle")),
+			hsm.Transition(hsm.After(func(ctx context.Context, sm *THSM, event hsm.Event) time.Duration {
+				return time.Hour
+			}), hsm.Target("../idle")),
+			hsm.Transition(hsm.On("fail"), hsm.Target("../failed")),
+		),
+		hsm.Final("failed"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	rng := rand.New(rand.NewSource(1))
+	visited := map[string]bool{sm.State(): true}
+	for range 100 {
+		event := hsm.RandomEvent(&model, sm.State(), rng)
+		if event.Name == "" {
+			break
+		}
+		if strings.HasPrefix(event.Name, "/") || strings.Contains(event.Name, "*") {
+			t.Fatalf("unexpected event %q", event.Name)
+		}
+		previous := sm.State()
+		<-sm.Dispatch(context.Background(), event)
+		if sm.State() == previous {
+			t.Fatalf("expected %q to trigger a transition from %s", event.Name, previous)
+		}
+		visited[sm.State()] = true
+	}
+	if !visited["/failed"] || !visited["/running"] {
+		t.Fatalf("expected the walk to reach every state, visited %v", visited)
+	}
+	if event := hsm.RandomEvent(&model, "/failed", rng); event.Name != "" {
+		t.Fatalf("expected no event from a final state, got %q", event.Name)
+	}
+}
+
+func TestChoiceDeadEnd(t *testing.T) {
+	var entries, exits int
+	var errs []error
+	model := hsm.Define(
+		"TestChoiceDeadEndHSM",
+		hsm.Initial(hsm.Target("machine/idle")),
+		hsm.State("machine",
+			hsm.State("idle",
+				hsm.Entry(func(ctx context.Context, sm *THSM, event hsm.Event) { entries++ }),
+				hsm.Exit(func(ctx context.Context, sm *THSM, event hsm.Event) { exits++ }),
+				hsm.Transition(hsm.On(hsm.ErrorEvent.Name), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+					errs = append(errs, event.Data.(error))
+				})),
+			),
+			hsm.Choice("pick",
+				hsm.Transition(hsm.Target("/done"), hsm.PreExit(func(ctx context.Context, sm *THSM, event hsm.Event) error {
+					return errors.New("not ready")
+				})),
+			),
+			hsm.Transition(hsm.On("go"), hsm.Source("idle"), hsm.Target("pick")),
+		),
+		hsm.State("done"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "go"})
+	// the aborted branch leaves the machine in the exited source state instead of the choice
+	if sm.State() != "/machine/idle" {
+		t.Fatalf("expected the source state to be restored, got %s", sm.State())
+	}
+	if entries != 2 || exits != 1 {
+		t.Fatalf("expected the source state to be entered again, got %d entries and %d exits", entries, exits)
+	}
+	if len(errs) != 1 || errs[0].Error() != "not ready" {
+		t.Fatalf("expected the PreExit error to be dispatched, got %v", errs)
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "go"})
+	if sm.State() != "/machine/idle" || entries != 3 || exits != 2 {
+		t.Fatalf("expected the machine to keep working, got %s with %d entries and %d exits", sm.State(), entries, exits)
+	}
+}
+
+func TestKeepActivitiesOnSelf(t *testing.T) {
+	var starts, cancellations, entries atomic.Int32
+	poll := func(ctx context.Context, sm *THSM, event hsm.Event) {
+		starts.Add(1)
+		<-ctx.Done()
+		cancellations.Add(1)
+	}
+	model := hsm.Define(
+		"TestKeepActivitiesOnSelfHSM",
+		hsm.Initial(hsm.Target("polling")),
+		hsm.State("polling",
+			hsm.KeepActivitiesOnSelf(),
+			hsm.Entry(func(ctx context.Context, sm *THSM, event hsm.Event) { entries.Add(1) }),
+			hsm.Activity(poll),
+			hsm.Transition(hsm.On("configure"), hsm.Target(".")),
+			hsm.Transition(hsm.On("stop"), hsm.Target("../stopped")),
+		),
+		hsm.State("stopped",
+			hsm.Transition(hsm.On("start"), hsm.Target("../polling")),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "configure"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "configure"})
+	time.Sleep(10 * time.Millisecond)
+	if starts.Load() != 1 || cancellations.Load() != 0 || entries.Load() != 3 {
+		t.Fatalf("expected the activity to survive self-transitions, got %d starts, %d cancellations and %d entries", starts.Load(), cancellations.Load(), entries.Load())
+	}
+	// other transitions still terminate the activities and start them again
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "stop"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "start"})
+	time.Sleep(10 * time.Millisecond)
+	if starts.Load() != 2 || cancellations.Load() != 1 {
+		t.Fatalf("expected the activity to restart after leaving the state, got %d starts and %d cancellations", starts.Load(), cancellations.Load())
+	}
+}
+
+func TestDeferredEvents(t *testing.T) {
+	model := hsm.Define(
+		"TestDeferredEventsHSM",
+		hsm.Initial(hsm.Target("busy")),
+		hsm.State("busy",
+			hsm.Defer("job"),
+			hsm.Transition(hsm.On("ping"), hsm.Target(".")),
+			hsm.Transition(hsm.On("ready"), hsm.Target("../ready")),
+		),
+		hsm.State("ready",
+			hsm.Transition(hsm.On("job"), hsm.Target("../busy")),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "job", Data: 1})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "job", Data: 2})
+	deferred := hsm.DeferredEvents(sm)
+	if len(deferred) != 2 || deferred[0].Data != 1 || deferred[1].Data != 2 {
+		t.Fatalf("expected both jobs to be deferred in order, got %v", deferred)
+	}
+	if snapshot := hsm.TakeSnapshot(context.Background(), sm); snapshot.QueueLen != 0 {
+		t.Fatalf("expected deferred events not to count as queued, got %d", snapshot.QueueLen)
+	}
+	// the first job is handled once ready, the second is deferred again in busy
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "ready"})
+	deferred = hsm.DeferredEvents(sm)
+	if sm.State() != "/busy" || len(deferred) != 1 || deferred[0].Data != 2 {
+		t.Fatalf("expected the second job to remain deferred in /busy, got %s and %v", sm.State(), deferred)
+	}
+}
+
+func TestDispatchOne(t *testing.T) {
+	unblock := make(chan struct{})
+	model := hsm.Define(
+		"TestDispatchOneHSM",
+		hsm.Initial(hsm.Target("ready")),
+		hsm.State("ready",
+			hsm.Transition(hsm.On("task"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				sm.foo++
+			})),
+			hsm.Transition(hsm.On("block"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				<-unblock
+			})),
+		),
+	)
+	registry := hsm.NewRegistry()
+	ctx := registry.Context(context.Background())
+	workers := []*THSM{}
+	for i := range 3 {
+		workers = append(workers, hsm.Start(ctx, &THSM{}, &model, hsm.Config{ID: fmt.Sprintf("worker-%d", i)}))
+	}
+	other := hsm.Start(ctx, &THSM{}, &model, hsm.Config{ID: "other"})
+	for range 6 {
+		<-hsm.DispatchOne(ctx, hsm.Event{Name: "task"}, hsm.RoundRobin, "worker-*")
+	}
+	for _, worker := range workers {
+		if worker.foo != 2 {
+			t.Fatalf("expected round robin to spread the tasks evenly, got %d for %s", worker.foo, hsm.ID(worker))
+		}
+	}
+	<-registry.DispatchOne(context.Background(), hsm.Event{Name: "task"}, hsm.Random, "worker-*")
+	if total := workers[0].foo + workers[1].foo + workers[2].foo; total != 7 || other.foo != 0 {
+		t.Fatalf("expected a single matching worker to get the task, got %d and %d", total, other.foo)
+	}
+	// keep the first worker busy with a queued event
+	workers[0].Dispatch(context.Background(), hsm.Event{Name: "block"})
+	workers[0].Dispatch(context.Background(), hsm.Event{Name: "task"})
+	before := workers[0].foo
+	for range 4 {
+		<-hsm.DispatchOne(ctx, hsm.Event{Name: "task"}, hsm.LeastQueued, "worker-*")
+	}
+	close(unblock)
+	<-workers[0].Dispatch(context.Background(), hsm.Event{Name: "noop"})
+	if workers[0].foo != before+1 {
+		t.Fatalf("expected the busy worker to be skipped, got %d tasks", workers[0].foo-before)
+	}
+	// the round-robin position is not kept in the instances map
+	ctx.Value(hsm.Keys.Instances).(*sync.Map).Range(func(key, value any) bool {
+		_ = value.(hsm.Instance)
+		return true
+	})
+	if count := hsm.InstanceCount(ctx); count != 4 {
+		t.Fatalf("expected 4 instances, got %d", count)
+	}
+	if instances, _ := hsm.InstancesFromContext(ctx); len(instances) != 4 {
+		t.Fatalf("expected 4 instances, got %d", len(instances))
+	}
+	<-registry.DispatchTo(context.Background(), hsm.Event{Name: "task"})
+	if other.foo != 1 {
+		t.Fatalf("expected DispatchTo to reach every instance, got %d", other.foo)
+	}
+}
+
+func TestInstanceCount(t *testing.T) {
+	model := hsm.Define(
+		"TestInstanceCountHSM",
+		hsm.Initial(hsm.Target("ready")),
+		hsm.State("ready",
+			hsm.Transition(hsm.On("spawn"), hsm.Guard(func(ctx context.Context, sm *THSM, event hsm.Event) bool {
+				return hsm.InstanceCount(ctx) < 3
+			}), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				sm.foo++
+			})),
+		),
+	)
+	registry := hsm.NewRegistry()
+	ctx := registry.Context(context.Background())
+	if hsm.InstanceCount(context.Background()) != 0 || hsm.InstanceCount(ctx) != 0 {
+		t.Fatalf("expected no instances")
+	}
+	supervisor := hsm.Start(ctx, &THSM{}, &model)
+	worker := hsm.Start(ctx, &THSM{}, &model)
+	<-supervisor.Dispatch(context.Background(), hsm.Event{Name: "spawn"})
+	hsm.Start(ctx, &THSM{}, &model)
+	<-supervisor.Dispatch(context.Background(), hsm.Event{Name: "spawn"})
+	if hsm.InstanceCount(ctx) != 3 || supervisor.foo != 1 {
+		t.Fatalf("expected the guard to pass only under capacity, got %d instances and %d spawns", hsm.InstanceCount(ctx), supervisor.foo)
+	}
+	<-hsm.Stop(context.Background(), worker)
+	if hsm.InstanceCount(ctx) != 2 {
+		t.Fatalf("expected stopped instances not to be counted, got %d", hsm.InstanceCount(ctx))
+	}
+}
+
+func TestPanicInfo(t *testing.T) {
+	errs := make(chan error, 1)
+	model := hsm.Define(
+		"TestPanicInfoHSM",
+		hsm.Initial(hsm.Target("charging")),
+		hsm.State("charging",
+			hsm.Transition(hsm.On("charge"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				panic(context.DeadlineExceeded)
+			})),
+			hsm.Transition(hsm.On(hsm.ErrorEvent.Name), hsm.Target("../review"), hsm.Guard(func(ctx context.Context, sm *THSM, event hsm.Event) bool {
+				info, ok := event.Data.(*hsm.PanicInfo)
+				return ok && info.Event.Name == "charge"
+			}), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				errs <- event.Data.(error)
+			})),
+		),
+		hsm.State("review"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	sm.Dispatch(context.Background(), hsm.Event{Name: "charge", Data: 42})
+	var err error
+	select {
+	case err = <-errs:
+	case <-time.After(time.Second):
+		t.Fatal("expected the panic to be routed to review")
+	}
+	var info *hsm.PanicInfo
+	if !errors.As(err, &info) || info.State != "/charging" || info.Event.Data != 42 || info.Stack == "" {
+		t.Fatalf("expected structured panic info, got %#v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "charge in state /charging") {
+		t.Fatalf("expected a readable error wrapping the panic value, got %v", err)
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "noop"})
+	if sm.State() != "/review" {
+		t.Fatalf("expected /review, got %s", sm.State())
+	}
+}
+
+func TestCollector(t *testing.T) {
+	model := hsm.Define(
+		"TestCollectorHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle",
+			hsm.Transition(hsm.On("start"), hsm.Target("../running")),
+		),
+		hsm.State("running",
+			hsm.Transition(hsm.On("stop"), hsm.Target("../idle")),
+		),
+	)
+	collector := hsm.NewCollector()
+	sm := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{ID: "a", Collector: collector})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "start"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "stop"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "start"})
+	values := map[string]float64{}
+	for _, metric := range collector.Metrics() {
+		if metric.Labels["instance"] != "a" {
+			t.Fatalf("unexpected instance label in %+v", metric)
+		}
+		key := metric.Name
+		if transition, ok := metric.Labels["transition"]; ok {
+			key += " " + path.Base(transition)
+		}
+		if state, ok := metric.Labels["state"]; ok {
+			key += " " + state
+		}
+		values[key] = metric.Value
+	}
+	if values["hsm_state /running"] != 1 || values["hsm_queue_depth"] != 0 || values["hsm_processing_seconds_count"] != 3 {
+		t.Fatalf("unexpected metrics %v", values)
+	}
+	total := 0.0
+	for key, value := range values {
+		if strings.HasPrefix(key, "hsm_transitions_total") {
+			total += value
+		}
+	}
+	if total < 3 {
+		t.Fatalf("expected at least 3 transitions, got %v", values)
+	}
+	<-hsm.Stop(context.Background(), sm)
+	if metrics := collector.Metrics(); len(metrics) != 0 {
+		t.Fatalf("expected stopped instances to be removed, got %v", metrics)
+	}
+}
+
+func TestAlias(t *testing.T) {
+	model := hsm.Define(
+		"TestAliasHSM",
+		hsm.Alias("cancel", "abort", "stop"),
+		hsm.Initial(hsm.Target("running")),
+		hsm.State("running",
+			hsm.Transition(hsm.On("cancel"), hsm.Target("../cancelled")),
+		),
+		hsm.State("cancelled",
+			hsm.Transition(hsm.On("resume"), hsm.Target("../running")),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	for _, name := range []string{"abort", "stop", "cancel"} {
+		<-sm.Dispatch(context.Background(), hsm.Event{Name: name})
+		if sm.State() != "/cancelled" {
+			t.Fatalf("expected %s to cancel, got %s", name, sm.State())
+		}
+		<-sm.Dispatch(context.Background(), hsm.Event{Name: "resume"})
+	}
+	// transactions check and apply the canonical event as well
+	err := hsm.Transaction(context.Background(), func(tx *hsm.Tx) error {
+		tx.Dispatch(sm, hsm.Event{Name: "abort"})
+		return nil
+	})
+	if err != nil || sm.State() != "/cancelled" {
+		t.Fatalf("expected a transaction dispatching an alias to cancel, got %s: %v", sm.State(), err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected an alias mapped to two events to panic")
+			}
+		}()
+		hsm.Define(
+			"TestAliasConflictHSM",
+			hsm.Alias("cancel", "stop"),
+			hsm.Alias("pause", "stop"),
+			hsm.Initial(hsm.Target("running")),
+			hsm.State("running"),
+		)
+	}()
+}
+
+func TestDefineFunc(t *testing.T) {
+	type params struct {
+		target string
+	}
+	factory := hsm.DefineFunc("TestDefineFuncHSM", func(p params) []hsm.RedefinableElement {
+		return []hsm.RedefinableElement{
+			hsm.Initial(hsm.Target("idle")),
+			hsm.State("idle", hsm.Transition(hsm.On("go"), hsm.Target(p.target))),
+			hsm.State("left"),
+			hsm.State("right"),
+		}
+	})
+	left, right := factory(params{target: "../left"}), factory(params{target: "../right"})
+	for model, expected := range map[*hsm.Model]string{&left: "/left", &right: "/right"} {
+		sm := hsm.Start(context.Background(), &THSM{}, model)
+		<-sm.Dispatch(context.Background(), hsm.Event{Name: "go"})
+		if sm.State() != expected {
+			t.Fatalf("expected %s, got %s", expected, sm.State())
+		}
+	}
+}
+
+func TestTransitionKind(t *testing.T) {
+	model := hsm.Define(
+		"TestTransitionKindHSM",
+		hsm.Initial(hsm.Target("parent")),
+		hsm.State("parent",
+			hsm.State("child"),
+			hsm.Transition(hsm.On("internal"), hsm.Effect(noBehavior)),
+			hsm.Transition(hsm.On("self"), hsm.Target(".")),
+			hsm.Transition(hsm.On("local"), hsm.Target("child")),
+			hsm.Transition(hsm.On("external"), hsm.Target("../other")),
+		),
+		hsm.State("other"),
+	)
+	expected := map[string]uint64{
+		"internal": hsm.InternalKind,
+		"self":     hsm.SelfKind,
+		"local":    hsm.LocalKind,
+		"external": hsm.ExternalKind,
+	}
+	found := 0
+	for _, member := range model.Members() {
+		transition, ok := member.(elements.Transition)
+		if !ok || len(transition.Events()) != 1 {
+			continue
+		}
+		if kind, ok := expected[transition.Events()[0]]; ok {
+			found++
+			if transition.TransitionKind() != kind {
+				t.Fatalf("expected %s to be %s, got %s", transition.Events()[0], hsm.KindName(kind), hsm.KindName(transition.TransitionKind()))
+			}
+		}
+	}
+	if found != len(expected) {
+		t.Fatalf("expected %d transitions, found %d", len(expected), found)
+	}
+}
+
+func TestMaxConcurrentActivities(t *testing.T) {
+	var running, peak, finished atomic.Int32
+	work := func(ctx context.Context, sm *THSM, event hsm.Event) {
+		now := running.Add(1)
+		for {
+			previous := peak.Load()
+			if now <= previous || peak.CompareAndSwap(previous, now) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		running.Add(-1)
+		finished.Add(1)
+	}
+	model := hsm.Define(
+		"TestMaxConcurrentActivitiesHSM",
+		hsm.Initial(hsm.Target("busy")),
+		hsm.State("busy",
+			hsm.Activity(work, work, work, work, work),
+		),
+	)
+	hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{MaxConcurrentActivities: 2})
+	deadline := time.Now().Add(time.Second)
+	for finished.Load() < 5 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if finished.Load() != 5 {
+		t.Fatalf("expected every activity to run eventually, %d finished", finished.Load())
+	}
+	if peak.Load() > 2 {
+		t.Fatalf("expected at most 2 activities at once, got %d", peak.Load())
+	}
+	// activities waiting for a slot have no goroutine and never start once their state is exited
+	var started atomic.Int32
+	blocking := func(ctx context.Context, sm *THSM, event hsm.Event) {
+		started.Add(1)
+		<-ctx.Done()
+	}
+	activities := make([]func(ctx context.Context, sm *THSM, event hsm.Event), 50)
+	for i := range activities {
+		activities[i] = blocking
+	}
+	waiting := hsm.Define(
+		"TestMaxConcurrentActivitiesWaitingHSM",
+		hsm.Initial(hsm.Target("busy")),
+		hsm.State("busy",
+			hsm.Activity(activities...),
+			hsm.Transition(hsm.On("done"), hsm.Target("../idle")),
+		),
+		hsm.State("idle"),
+	)
+	goroutines := runtime.NumGoroutine()
+	sm := hsm.Start(context.Background(), &THSM{}, &waiting, hsm.Config{MaxConcurrentActivities: 1})
+	if added := runtime.NumGoroutine() - goroutines; added >= 50 {
+		t.Fatalf("expected waiting activities not to have goroutines, %d were started", added)
+	}
+	began := time.Now()
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "done"})
+	if elapsed := time.Since(began); elapsed > 500*time.Millisecond {
+		t.Fatalf("expected the waiting activities to terminate right away, took %s", elapsed)
+	}
+	if started.Load() > 1 {
+		t.Fatalf("expected only the activity holding the slot to start, %d started", started.Load())
+	}
+}
+
+func TestRestartAt(t *testing.T) {
+	var entered []string
+	entry := func(ctx context.Context, sm *THSM, event hsm.Event) {
+		entered = append(entered, sm.State()+" "+fmt.Sprint(event.Data))
+	}
+	model := hsm.Define(
+		"TestRestartAtHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle", hsm.Entry(entry)),
+		hsm.State("running", hsm.Entry(entry),
+			hsm.Initial(hsm.Target("downloading")),
+			hsm.State("downloading", hsm.Entry(entry)),
+			hsm.State("uploading", hsm.Entry(entry),
+				hsm.Transition(hsm.On("done"), hsm.Target("/idle")),
+			),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	if _, err := hsm.RestartAt(context.Background(), sm, "/missing"); !errors.Is(err, hsm.ErrInvalidState) {
+		t.Fatalf("expected an invalid state error, got %v", err)
+	}
+	entered = nil
+	done, err := hsm.RestartAt(context.Background(), sm, "/running/uploading", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if sm.State() != "/running/uploading" || len(entered) != 2 {
+		t.Fatalf("expected to resume in /running/uploading through its ancestors, got %s after %v", sm.State(), entered)
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "done"})
+	if sm.State() != "/idle" {
+		t.Fatalf("expected the resumed instance to keep working, got %s", sm.State())
+	}
+	// a composite state is entered with its default descendants
+	done, _ = hsm.RestartAt(context.Background(), sm, "/running")
+	<-done
+	if sm.State() != "/running/downloading" {
+		t.Fatalf("expected the default entry of /running, got %s", sm.State())
+	}
+}
+
+func TestCloserAndString(t *testing.T) {
+	model := hsm.Define(
+		"TestCloserAndStringHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{ID: "a", Name: "worker"})
+	if got := fmt.Sprintf("%s", sm); got != "a@worker:/idle" {
+		t.Fatalf("expected a@worker:/idle, got %s", got)
+	}
+	if err := hsm.Closer(sm).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if hsm.Termination(sm) != hsm.Stopped {
+		t.Fatalf("expected Close to stop the instance, got %s", hsm.Termination(sm))
+	}
+	var unstarted THSM
+	if unstarted.String() != "<nil>" {
+		t.Fatalf("expected <nil> for an unstarted instance, got %s", unstarted.String())
+	}
+}
+
+func countedGuard(ctx context.Context, sm *THSM, event hsm.Event) bool {
+	sm.foo++
+	return event.Data == "allow"
+}
+
+func TestPureGuard(t *testing.T) {
+	model := hsm.Define(
+		"TestPureGuardHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle",
+			hsm.Transition(hsm.On("go"), hsm.Target("../a"), hsm.PureGuard("counted", countedGuard)),
+			hsm.Transition(hsm.On("go"), hsm.Target("../b"), hsm.PureGuard("counted", countedGuard)),
+			hsm.Transition(hsm.On("go"), hsm.Target("../c"), hsm.PureGuard("counted", countedGuard)),
+		),
+		hsm.State("a"),
+		hsm.State("b"),
+		hsm.State("c"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "go"})
+	if sm.foo != 1 || sm.State() != "/idle" {
+		t.Fatalf("expected the shared guard to run once per event, ran %d times in %s", sm.foo, sm.State())
+	}
+	// results are not reused across events
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "go", Data: "allow"})
+	if sm.foo != 2 || sm.State() != "/a" {
+		t.Fatalf("expected a fresh evaluation for the next event, ran %d times in %s", sm.foo, sm.State())
+	}
+	// closures of the same function are told apart by their keys
+	minimum := func(amount int) func(ctx context.Context, sm *THSM, event hsm.Event) bool {
+		return func(ctx context.Context, sm *THSM, event hsm.Event) bool {
+			return event.Data.(int) >= amount
+		}
+	}
+	keyed := hsm.Define(
+		"TestPureGuardKeyedHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle",
+			hsm.Transition(hsm.On("pay"), hsm.Target("../large"), hsm.PureGuard("min100", minimum(100))),
+			hsm.Transition(hsm.On("pay"), hsm.Target("../small"), hsm.PureGuard("min10", minimum(10))),
+		),
+		hsm.State("large"),
+		hsm.State("small"),
+	)
+	sm = hsm.Start(context.Background(), &THSM{}, &keyed)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "pay", Data: 50})
+	if sm.State() != "/small" {
+		t.Fatalf("expected each key to run its own guard, got %s", sm.State())
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected two functions under the same key to panic")
+		}
+	}()
+	hsm.Define(
+		"TestPureGuardConflictHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle",
+			hsm.Transition(hsm.On("go"), hsm.Target("."), hsm.PureGuard("guard", countedGuard)),
+			hsm.Transition(hsm.On("go"), hsm.Target("."), hsm.PureGuard("guard", func(ctx context.Context, sm *THSM, event hsm.Event) bool {
+				return true
+			})),
+		),
+	)
+}
+
+func TestStartSettles(t *testing.T) {
+	model := hsm.Define(
+		"TestStartSettlesHSM",
+		hsm.Initial(hsm.Target("booting"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+			sm.Dispatch(ctx, hsm.Event{Name: "boot"})
+		})),
+		hsm.State("booting",
+			hsm.Entry(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				sm.Dispatch(ctx, hsm.Event{Name: "configure"})
+			}),
+			hsm.Transition(hsm.On("boot"), hsm.Target("../configuring")),
+		),
+		hsm.State("configuring",
+			hsm.Transition(hsm.On("configure"), hsm.Target("../ready")),
+		),
+		hsm.State("ready"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	if sm.State() != "/ready" {
+		t.Fatalf("expected events dispatched during start to be processed before Start returns, got %s", sm.State())
+	}
+}
+
+func TestTraceToFile(t *testing.T) {
+	model := hsm.Define(
+		"TestTraceToFileHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle",
+			hsm.Transition(hsm.On("start"), hsm.Target("../running"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				time.Sleep(20 * time.Millisecond)
+			})),
+		),
+		hsm.State("running"),
+	)
+	filename := path.Join(t.TempDir(), "trace.json")
+	trace, err := hsm.TraceToFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{ID: "traced", EventObserver: trace})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "start"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "unknown"})
+	if err := trace.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// events after closing are not written
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "late"})
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var timeline struct {
+		TraceEvents []struct {
+			Name     string            `json:"name"`
+			Phase    string            `json:"ph"`
+			Duration float64           `json:"dur"`
+			Args     map[string]string `json:"args"`
+		} `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(data, &timeline); err != nil {
+		t.Fatal(err)
+	}
+	spans := []string{}
+	for _, event := range timeline.TraceEvents {
+		switch event.Phase {
+		case "M":
+			if event.Args["name"] != "traced" {
+				t.Fatalf("expected a track named after the instance, got %v", event.Args)
+			}
+		case "X":
+			if event.Name == "start" && event.Duration < 20000 {
+				t.Fatalf("expected the span to cover the effect, got %vµs", event.Duration)
+			}
+			spans = append(spans, fmt.Sprintf("%s %s %s->%s", event.Name, event.Args["outcome"], event.Args["from"], event.Args["to"]))
+		}
+	}
+	expected := []string{"start handled /idle->/running", "unknown dropped /running->/running"}
+	if !slices.Equal(spans, expected) {
+		t.Fatalf("expected spans %v, got %v", expected, spans)
+	}
+}
+
+func TestTracerLimit(t *testing.T) {
+	model := hsm.Define(
+		"TestTracerLimitHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle"),
+	)
+	tracer := hsm.NewTracer()
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	for i := range hsm.MaxTraceSpans + 10 {
+		tracer.Processed(context.Background(), sm, hsm.Event{Name: fmt.Sprint(i)})
+	}
+	var buffer bytes.Buffer
+	if _, err := tracer.WriteTo(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	var timeline struct {
+		TraceEvents []struct {
+			Name  string `json:"name"`
+			Phase string `json:"ph"`
+		} `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(buffer.Bytes(), &timeline); err != nil {
+		t.Fatal(err)
+	}
+	spans := slices.DeleteFunc(timeline.TraceEvents, func(event struct {
+		Name  string `json:"name"`
+		Phase string `json:"ph"`
+	}) bool {
+		return event.Phase != "X"
+	})
+	if len(spans) != hsm.MaxTraceSpans || spans[0].Name != "10" || spans[len(spans)-1].Name != fmt.Sprint(hsm.MaxTraceSpans+9) {
+		t.Fatalf("expected the most recent %d spans in order, got %d from %s to %s", hsm.MaxTraceSpans, len(spans), spans[0].Name, spans[len(spans)-1].Name)
+	}
+}
+
+func TestParent(t *testing.T) {
+	model := hsm.Define(
+		"TestParentHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle"),
+	)
+	root := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{ID: "root"})
+	child := hsm.Start(root.Context(), &THSM{}, &model, hsm.Config{ID: "child"})
+	grandchild := hsm.Start(child.Context(), &THSM{}, &model, hsm.Config{ID: "grandchild"})
+	if _, ok := hsm.Parent(root); ok {
+		t.Fatal("expected a top-level instance to have no parent")
+	}
+	if parent, ok := hsm.Parent(child); !ok || hsm.ID(parent) != "root" {
+		t.Fatalf("expected root to be the parent of child, got %v", parent)
+	}
+	if parent, ok := hsm.Parent(grandchild); !ok || hsm.ID(parent) != "child" {
+		t.Fatalf("expected child to be the parent of grandchild, got %v", parent)
+	}
+}
+
+func TestDispatchCallback(t *testing.T) {
+	release := make(chan struct{})
+	model := hsm.Define(
+		"TestDispatchCallbackHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle",
+			hsm.Transition(hsm.On("start"), hsm.Target("../running")),
+		),
+		hsm.State("running",
+			hsm.Transition(hsm.On("block"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				<-release
+			})),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	type result struct {
+		state string
+		err   error
+	}
+	results := make(chan result, 1)
+	callback := func(state string, err error) {
+		results <- result{state, err}
+	}
+	hsm.DispatchCallback(context.Background(), sm, hsm.Event{Name: "start"}, callback)
+	if got := <-results; got.err != nil || got.state != "/running" {
+		t.Fatalf("expected /running without error, got %s %v", got.state, got.err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	hsm.DispatchCallback(ctx, sm, hsm.Event{Name: "block"}, callback)
+	if got := <-results; !errors.Is(got.err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context error while the event is still processing, got %v", got.err)
+	}
+	close(release)
+}
+
+func TestAutoRestart(t *testing.T) {
+	var starts atomic.Int32
+	model := hsm.Define(
+		"TestAutoRestartHSM",
+		hsm.Initial(hsm.Target("working"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+			starts.Add(1)
+			if event.Data != nil && event.Data != "next" {
+				t.Errorf("expected the restart data, got %v", event.Data)
+			}
+		})),
+		hsm.State("working",
+			hsm.Transition(hsm.On("done"), hsm.Target("../finished")),
+		),
+		hsm.Final("finished", hsm.AutoRestart("next", 20*time.Millisecond)),
+	)
+	began := time.Now()
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "done"})
+	deadline := time.Now().Add(time.Second)
+	for starts.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if starts.Load() != 2 {
+		t.Fatalf("expected the final state to restart the instance, started %d times", starts.Load())
+	}
+	if elapsed := time.Since(began); elapsed < 20*time.Millisecond {
+		t.Fatalf("expected the restart to wait out the minimum interval, restarted after %s", elapsed)
+	}
+	for sm.State() != "/working" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if sm.State() != "/working" || hsm.Termination(sm) != hsm.NotTerminated {
+		t.Fatalf("expected a running instance back in /working, got %s %s", sm.State(), hsm.Termination(sm))
+	}
+	// stopping while the restart is pending gives it up
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "done"})
+	<-hsm.Stop(context.Background(), sm)
+	time.Sleep(40 * time.Millisecond)
+	if starts.Load() != 2 || hsm.Termination(sm) != hsm.Stopped {
+		t.Fatalf("expected a stopped instance to stay stopped, started %d times, %s", starts.Load(), hsm.Termination(sm))
+	}
+}
+
+func TestUnreachableStates(t *testing.T) {
+	model := hsm.Define(
+		"TestUnreachableStatesHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle",
+			hsm.Transition(hsm.On("review"), hsm.Target("../reviewing")),
+			hsm.Transition(hsm.On("jump"), hsm.Target("../composite/second")),
+		),
+		hsm.Choice("reviewing",
+			hsm.Transition(hsm.Target("approved"), hsm.Guard(func(ctx context.Context, sm *THSM, event hsm.Event) bool {
+				return false
+			})),
+			hsm.Transition(hsm.Target("idle")),
+		),
+		hsm.State("approved"),
+		// only entered through a descendant, so its initial transition is never taken
+		hsm.State("composite",
+			hsm.Initial(hsm.Target("first")),
+			hsm.State("first"),
+			hsm.State("second"),
+		),
+		hsm.State("orphan",
+			hsm.State("nested"),
+			hsm.Transition(hsm.On("back"), hsm.Target("../idle")),
+		),
+		hsm.Final("done"),
+	)
+	expected := []string{"/composite/first", "/done", "/orphan", "/orphan/nested"}
+	if unreachable := hsm.UnreachableStates(&model); !slices.Equal(unreachable, expected) {
+		t.Fatalf("expected %v to be unreachable, got %v", expected, unreachable)
+	}
+}
+
+func TestSnapshotOf(t *testing.T) {
+	leaderModel := hsm.Define(
+		"TestSnapshotOfLeaderHSM",
+		hsm.Initial(hsm.Target("standby")),
+		hsm.State("standby", hsm.Transition(hsm.On("elect"), hsm.Target("../active"))),
+		hsm.State("active"),
+	)
+	followerModel := hsm.Define(
+		"TestSnapshotOfFollowerHSM",
+		hsm.Initial(hsm.Target("waiting")),
+		hsm.State("waiting",
+			hsm.Transition(hsm.On("proceed"), hsm.Target("../working"), hsm.Guard(func(ctx context.Context, sm *THSM, event hsm.Event) bool {
+				leader, ok := hsm.SnapshotOf(ctx, "leader")
+				return ok && leader.State == "/active"
+			})),
+		),
+		hsm.State("working"),
+	)
+	ctx := hsm.NewRegistry().Context(context.Background())
+	if _, ok := hsm.SnapshotOf(ctx, "leader"); ok {
+		t.Fatal("expected no snapshot for an unknown instance")
+	}
+	leader := hsm.Start(ctx, &THSM{}, &leaderModel, hsm.Config{ID: "leader"})
+	follower := hsm.Start(ctx, &THSM{}, &followerModel, hsm.Config{ID: "follower"})
+	<-follower.Dispatch(context.Background(), hsm.Event{Name: "proceed"})
+	if follower.State() != "/waiting" {
+		t.Fatalf("expected the follower to wait for an active leader, got %s", follower.State())
+	}
+	<-leader.Dispatch(context.Background(), hsm.Event{Name: "elect"})
+	<-follower.Dispatch(context.Background(), hsm.Event{Name: "proceed"})
+	if follower.State() != "/working" {
+		t.Fatalf("expected the follower to proceed once the leader is active, got %s", follower.State())
+	}
+}
+
+func TestConfigInitialEvent(t *testing.T) {
+	started := make(chan hsm.Event, 2)
+	model := hsm.Define(
+		"TestConfigInitialEventHSM",
+		hsm.Initial(hsm.Target("idle"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+			started <- event
+		})),
+		hsm.State("idle"),
+	)
+	bootstrap := hsm.Event{Name: "bootstrap", Kind: hsm.CompletionEventKind, Data: "marker"}
+	sm := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{InitialEvent: bootstrap})
+	if event := <-started; event.Name != "bootstrap" || event.Data != "marker" || sm.State() != "/idle" {
+		t.Fatalf("expected to start with the bootstrap event in /idle, got %v in %s", event, sm.State())
+	}
+	<-hsm.Restart(context.Background(), sm)
+	if event := <-started; event.Name != hsm.InitialEvent.Name {
+		t.Fatalf("expected restarts to use the default initial event, got %s", event.Name)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a non-completion initial event to panic")
+		}
+	}()
+	hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{InitialEvent: hsm.Event{Name: "bootstrap", Kind: hsm.EventKind}})
+}
+
+func TestMaxCascadeDepth(t *testing.T) {
+	errs := make(chan error, 1)
+	model := hsm.Define(
+		"TestMaxCascadeDepthHSM",
+		hsm.Initial(hsm.Target("running")),
+		hsm.State("running",
+			hsm.Initial(hsm.Target("ping")),
+			hsm.State("ping",
+				hsm.Entry(func(ctx context.Context, sm *THSM, event hsm.Event) {
+					sm.Dispatch(ctx, hsm.Event{Name: "pong"})
+				}),
+				hsm.Transition(hsm.On("pong"), hsm.Target("../pong")),
+			),
+			hsm.State("pong",
+				hsm.Entry(func(ctx context.Context, sm *THSM, event hsm.Event) {
+					sm.Dispatch(ctx, hsm.Event{Name: "ping"})
+				}),
+				hsm.Transition(hsm.On("ping"), hsm.Target("../ping")),
+			),
+			hsm.Transition(hsm.On(hsm.ErrorEvent), hsm.Target("../halted"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				errs <- event.Data.(error)
+			})),
+		),
+		hsm.State("halted"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{MaxCascadeDepth: 100})
+	select {
+	case err := <-errs:
+		if !errors.Is(err, hsm.ErrCascadeLimit) || !strings.Contains(err.Error(), "ping, pong") {
+			t.Fatalf("expected a cascade limit error listing the recent events, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the cascade to be aborted")
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "noop"})
+	if sm.State() != "/halted" {
+		t.Fatalf("expected the instance to settle in /halted, got %s", sm.State())
+	}
+}
+
+func TestNew(t *testing.T) {
+	model := hsm.Define(
+		"TestNewHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle",
+			hsm.Transition(hsm.On("work"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				sm.foo++
+			})),
+		),
+	)
+	sm := hsm.New[THSM](context.Background(), &model, hsm.Config{ID: "typed"})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "work"})
+	if sm.foo != 1 || sm.State() != "/idle" || hsm.ID(sm) != "typed" {
+		t.Fatalf("expected a started, configured *THSM, got foo=%d in %s as %s", sm.foo, sm.State(), hsm.ID(sm))
+	}
+}
+
+func TestEntryExitOrder(t *testing.T) {
+	trace := []string{}
+	enter := func(name string) func(ctx context.Context, sm *THSM, event hsm.Event) {
+		return func(ctx context.Context, sm *THSM, event hsm.Event) { trace = append(trace, "enter "+name) }
+	}
+	exit := func(name string) func(ctx context.Context, sm *THSM, event hsm.Event) {
+		return func(ctx context.Context, sm *THSM, event hsm.Event) { trace = append(trace, "exit "+name) }
+	}
+	// children are deliberately declared before and after their siblings and transitions
+	model := hsm.Define(
+		"TestEntryExitOrderHSM",
+		hsm.State("a",
+			hsm.Transition(hsm.On("local"), hsm.Target("b/c/d")),
+			hsm.State("e",
+				hsm.State("f",
+					hsm.Exit(exit("f")),
+					hsm.State("g", hsm.Exit(exit("g")), hsm.Entry(enter("g"))),
+					hsm.Entry(enter("f")),
+					hsm.Initial(hsm.Target("g")),
+				),
+				hsm.Entry(enter("e")),
+				hsm.Exit(exit("e")),
+				hsm.Initial(hsm.Target("f")),
+			),
+			hsm.State("b",
+				hsm.Initial(hsm.Target("c")),
+				hsm.State("c",
+					hsm.State("d", hsm.Entry(enter("d")), hsm.Exit(exit("d")),
+						hsm.Transition(hsm.On("external"), hsm.Target("/a/e/f/g")),
+					),
+					hsm.Initial(hsm.Target("d")),
+					hsm.Entry(enter("c")),
+					hsm.Exit(exit("c")),
+				),
+				hsm.Transition(hsm.On("self"), hsm.Target(".")),
+				hsm.Exit(exit("b")),
+				hsm.Entry(enter("b")),
+			),
+			hsm.Entry(enter("a")),
+			hsm.Exit(exit("a")),
+			hsm.Initial(hsm.Target("b")),
+		),
+		hsm.Initial(hsm.Target("a")),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	steps := []struct {
+		event    string
+		state    string
+		expected []string
+	}{
+		{"", "/a/b/c/d", []string{"enter a", "enter b", "enter c", "enter d"}},
+		{"self", "/a/b/c/d", []string{"exit d", "exit c", "exit b", "enter b", "enter c", "enter d"}},
+		{"external", "/a/e/f/g", []string{"exit d", "exit c", "exit b", "enter e", "enter f", "enter g"}},
+		{"local", "/a/b/c/d", []string{"exit g", "exit f", "exit e", "enter b", "enter c", "enter d"}},
+	}
+	for _, step := range steps {
+		if step.event != "" {
+			trace = nil
+			<-sm.Dispatch(context.Background(), hsm.Event{Name: step.event})
+		}
+		if sm.State() != step.state || !slices.Equal(trace, step.expected) {
+			t.Fatalf("%q: expected %v ending in %s, got %v ending in %s", step.event, step.expected, step.state, trace, sm.State())
+		}
+	}
+	trace = nil
+	<-hsm.Stop(context.Background(), sm)
+	if expected := []string{"exit d", "exit c", "exit b", "exit a"}; !slices.Equal(trace, expected) {
+		t.Fatalf("expected stop to exit %v, got %v", expected, trace)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	published := make(chan struct{})
+	model := hsm.Define(
+		"TestProgressHSM",
+		hsm.Initial(hsm.Target("uploading")),
+		hsm.State("uploading",
+			hsm.Entry(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				// only activities publish progress
+				hsm.SetProgress(ctx, 1, "entry")
+			}),
+			hsm.Activity(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				hsm.SetProgress(ctx, 0.5, "halfway")
+				close(published)
+				<-ctx.Done()
+			}),
+			hsm.Transition(hsm.On("done"), hsm.Target("../idle")),
+		),
+		hsm.State("idle"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	<-published
+	if value, detail := hsm.Progress(sm); value != 0.5 || detail != "halfway" {
+		t.Fatalf("expected the activity's progress, got %v %q", value, detail)
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "done"})
+	if value, detail := hsm.Progress(sm); value != 0 || detail != "" {
+		t.Fatalf("expected the progress to be cleared with its state, got %v %q", value, detail)
+	}
+	// progress published while the state is being exited does not outlive it
+	spinning := hsm.Define(
+		"TestProgressExitHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle",
+			hsm.Transition(hsm.On("start"), hsm.Target("../busy")),
+		),
+		hsm.State("busy",
+			hsm.Activity(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				for ctx.Err() == nil {
+					hsm.SetProgress(ctx, 0.5, "spinning")
+					time.Sleep(10 * time.Microsecond)
+				}
+			}),
+			hsm.Transition(hsm.On("stop"), hsm.Target("../idle")),
+		),
+	)
+	sm = hsm.Start(context.Background(), &THSM{}, &spinning, hsm.Config{ActivityTimeout: time.Second})
+	for range 50 {
+		<-sm.Dispatch(context.Background(), hsm.Event{Name: "start"})
+		<-sm.Dispatch(context.Background(), hsm.Event{Name: "stop"})
+		if _, detail := hsm.Progress(sm); detail != "" {
+			t.Fatalf("expected no progress once the state was exited, got %q", detail)
+		}
+	}
+}
+
+func BenchmarkDefineLarge(b *testing.B) {
+	groups := make([]hsm.RedefinableElement, 0, 100)
+	for group := range 100 {
+		states := make([]hsm.RedefinableElement, 0, 101)
+		for state := range 100 {
+			states = append(states, hsm.State(fmt.Sprintf("s%d", state),
+				hsm.Transition(hsm.On("next"), hsm.Target(fmt.Sprintf("../s%d", (state+1)%100))),
+			))
+		}
+		states = append(states, hsm.Initial(hsm.Target("s0")))
+		states = append(states, hsm.Transition(hsm.On("jump"), hsm.Target(fmt.Sprintf("/g%d", (group+1)%100))))
+		groups = append(groups, hsm.State(fmt.Sprintf("g%d", group), states...))
+	}
+	groups = append(groups, hsm.Initial(hsm.Target("g0")))
+	b.ResetTimer()
+	for range b.N {
+		hsm.Define("BenchmarkDefineLargeHSM", groups...)
+	}
+}
+
+func TestDispatchAndSnapshot(t *testing.T) {
+	model := hsm.Define(
+		"TestDispatchAndSnapshotHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle",
+			hsm.Transition(hsm.On("start"), hsm.Target("../running"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				sm.Dispatch(ctx, hsm.Event{Name: "finish"})
+			})),
+		),
+		hsm.State("running",
+			hsm.Transition(hsm.On("finish"), hsm.Target("../done")),
+		),
+		hsm.State("done"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	snapshot, err := hsm.DispatchAndSnapshot(context.Background(), sm, hsm.Event{Name: "start"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.State != "/running" || snapshot.QueueLen != 1 {
+		t.Fatalf("expected the state right after start with finish pending, got %s with %d queued", snapshot.State, snapshot.QueueLen)
+	}
+	if sm.State() != "/done" {
+		t.Fatalf("expected the follow-up event to be processed, got %s", sm.State())
+	}
+	<-hsm.Drain(context.Background(), sm)
+	if _, err := hsm.DispatchAndSnapshot(context.Background(), sm, hsm.Event{Name: "start"}); !errors.Is(err, hsm.ErrNotProcessed) {
+		t.Fatalf("expected ErrNotProcessed for a drained instance, got %v", err)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	var cancel func()
+	model := hsm.Define(
+		"TestScheduleHSM",
+		hsm.Initial(hsm.Target("waiting")),
+		hsm.State("waiting",
+			hsm.Transition(hsm.On("order"), hsm.Target("../ordered"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				hsm.Schedule(ctx, hsm.Event{Name: "remind"}, 10*time.Millisecond)
+			})),
+			hsm.Transition(hsm.On("later"), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				cancel = hsm.Schedule(ctx, hsm.Event{Name: "order"}, 10*time.Millisecond)
+			})),
+		),
+		hsm.State("ordered",
+			hsm.Transition(hsm.On("remind"), hsm.Target("../reminded")),
+		),
+		hsm.State("reminded"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	// cancelled before it fires
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "later"})
+	cancel()
+	time.Sleep(30 * time.Millisecond)
+	if sm.State() != "/waiting" {
+		t.Fatalf("expected a cancelled event not to be dispatched, got %s", sm.State())
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "order"})
+	deadline := time.Now().Add(time.Second)
+	for sm.State() != "/reminded" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if sm.State() != "/reminded" {
+		t.Fatalf("expected the scheduled event to be dispatched, got %s", sm.State())
+	}
+	// stopping cancels pending events
+	restarted := hsm.Start(context.Background(), &THSM{}, &model)
+	<-restarted.Dispatch(context.Background(), hsm.Event{Name: "later"})
+	<-hsm.Stop(context.Background(), restarted)
+	<-hsm.Restart(context.Background(), restarted)
+	time.Sleep(30 * time.Millisecond)
+	if restarted.State() != "/waiting" {
+		t.Fatalf("expected Stop to cancel scheduled events, got %s", restarted.State())
+	}
+}
+
+func TestBehaviorMiddleware(t *testing.T) {
+	var mutex sync.Mutex
+	wrapped := map[string]int{}
+	model := hsm.Define(
+		"TestBehaviorMiddlewareHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle",
+			hsm.Entry(func(ctx context.Context, sm *THSM, event hsm.Event) {}),
+			hsm.Exit(func(ctx context.Context, sm *THSM, event hsm.Event) {}),
+			hsm.Transition(hsm.On("go"), hsm.Target("../busy"),
+				hsm.Guard(func(ctx context.Context, sm *THSM, event hsm.Event) bool { return true }),
+				hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+					sm.foo++
+				}),
+			),
+		),
+		hsm.State("busy"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{
+		BehaviorMiddleware: func(next hsm.Operation[hsm.Instance]) hsm.Operation[hsm.Instance] {
+			return func(ctx context.Context, instance hsm.Instance, event hsm.Event) {
+				mutex.Lock()
+				wrapped[event.Name]++
+				mutex.Unlock()
+				next(ctx, instance, event)
+			}
+		},
+	})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "go"})
+	if sm.State() != "/busy" || sm.foo != 1 {
+		t.Fatalf("expected the wrapped guard and effect to run, got state %s and foo %d", sm.State(), sm.foo)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	// guard, exit and effect for "go"; the initial entry for the start event
+	if wrapped["go"] != 3 || len(wrapped) != 2 {
+		t.Fatalf("expected every behavior to be wrapped, got %v", wrapped)
+	}
+}
+
+func TestBehaviorMiddlewareSkip(t *testing.T) {
+	var errs atomic.Int32
+	model := hsm.Define(
+		"TestBehaviorMiddlewareSkipHSM",
+		hsm.Initial(hsm.Target("idle")),
+		hsm.State("idle",
+			hsm.Transition(hsm.On("guarded"), hsm.Target("../busy"),
+				hsm.Guard(func(ctx context.Context, sm *THSM, event hsm.Event) bool { return true }),
+			),
+			hsm.Transition(hsm.On("validated"), hsm.Target("../busy"),
+				hsm.PreExit(func(ctx context.Context, sm *THSM, event hsm.Event) error { return nil }),
+			),
+			hsm.Transition(hsm.On(hsm.ErrorEvent.Name), hsm.Effect(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				if err, ok := event.Data.(error); ok && errors.Is(err, hsm.ErrNotRun) {
+					errs.Add(1)
+				}
+			})),
+		),
+		hsm.State("busy"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{
+		BehaviorMiddleware: func(next hsm.Operation[hsm.Instance]) hsm.Operation[hsm.Instance] {
+			return func(ctx context.Context, instance hsm.Instance, event hsm.Event) {
+				// short-circuit everything but the error handler
+				if event.Kind == hsm.ErrorEventKind {
+					next(ctx, instance, event)
+				}
+			}
+		},
+	})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "guarded"})
+	if sm.State() != "/idle" {
+		t.Fatalf("expected a guard skipped by the middleware to be false, got %s", sm.State())
+	}
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "validated"})
+	if sm.State() != "/idle" || errs.Load() != 1 {
+		t.Fatalf("expected a validation skipped by the middleware to abort with ErrNotRun, got %s and %d errors", sm.State(), errs.Load())
+	}
+}
+
+func TestLazyActivities(t *testing.T) {
+	var started atomic.Int32
+	activity := func(ctx context.Context, sm *THSM, event hsm.Event) {
+		started.Add(1)
+		<-ctx.Done()
+	}
+	model := hsm.Define(
+		"TestLazyActivitiesHSM",
+		hsm.Initial(hsm.Target("transient")),
+		hsm.State("transient",
+			hsm.Activity(activity),
+			hsm.Transition(hsm.On("next"), hsm.Target("../settled")),
+		),
+		hsm.State("settled",
+			hsm.LazyActivities(time.Millisecond),
+			hsm.Activity(activity),
+			hsm.Transition(hsm.On("next"), hsm.Target("../eager")),
+		),
+		hsm.State("eager",
+			hsm.LazyActivities(0),
+			hsm.Activity(activity),
+		),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model, hsm.Config{LazyActivities: time.Hour})
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "next"})
+	if started.Load() != 0 {
+		t.Fatal("expected the activity of the transient state to never start")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if started.Load() != 1 {
+		t.Fatalf("expected the activity of the settled state to start after its delay, got %d starts", started.Load())
+	}
+	// a zero delay turns laziness off for the state
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "next"})
+	time.Sleep(50 * time.Millisecond)
+	if started.Load() != 2 {
+		t.Fatalf("expected the activity of the eager state to start on entry, got %d starts", started.Load())
+	}
+	<-hsm.Stop(context.Background(), sm)
+}
+
+func TestCompletionTransition(t *testing.T) {
+	release := make(chan struct{})
+	model := hsm.Define(
+		"TestCompletionTransitionHSM",
+		hsm.Initial(hsm.Target("working")),
+		hsm.State("working",
+			hsm.Entry(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				sm.foo++
+			}),
+		),
+		hsm.Transition(hsm.Source("working"), hsm.Target("waiting")),
+		hsm.State("waiting",
+			hsm.Activity(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				<-release
+			}),
+			hsm.Transition(hsm.Target("../nested")),
+		),
+		hsm.State("nested",
+			hsm.Initial(hsm.Target("step")),
+			hsm.State("step",
+				hsm.Transition(hsm.On("finish"), hsm.Target("../end")),
+			),
+			hsm.Final("end"),
+			hsm.Transition(hsm.Target("../guarded")),
+		),
+		hsm.State("guarded",
+			hsm.Transition(hsm.Target("../done"), hsm.Guard(func(ctx context.Context, sm *THSM, event hsm.Event) bool {
+				return sm.foo > 1
+			})),
+		),
+		hsm.State("done"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	// the simple state completes once entered, the next one once its activity returns
+	if sm.State() != "/waiting" || sm.foo != 1 {
+		t.Fatalf("expected working to complete on entry, got %s", sm.State())
+	}
+	entered := hsm.AfterEntry(context.Background(), sm, "/nested/step")
+	close(release)
+	select {
+	case <-entered:
+	case <-time.After(time.Second):
+		t.Fatalf("expected waiting to complete once its activity returned, got %s", sm.State())
+	}
+	// the composite state completes on entering its final state, the guard holds the last one back
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "finish"})
+	if sm.State() != "/guarded" {
+		t.Fatalf("expected nested to complete on entering its final state, got %s", sm.State())
+	}
+	sm.foo++
+	<-hsm.DispatchCompletion(context.Background(), sm)
+	if sm.State() != "/done" {
+		t.Fatalf("expected the guarded completion transition to be taken once enabled, got %s", sm.State())
+	}
+}
+
+func TestCompletionTransitionTimeout(t *testing.T) {
+	model := hsm.Define(
+		"TestCompletionTransitionTimeoutHSM",
+		hsm.Initial(hsm.Target("working")),
+		hsm.State("working",
+			hsm.Activity(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				time.Sleep(10 * time.Millisecond)
+			}),
+			hsm.Transition(hsm.After(func(ctx context.Context, sm *THSM, event hsm.Event) time.Duration {
+				return 500 * time.Millisecond
+			}), hsm.Target("../timeout")),
+			hsm.Transition(hsm.Target("../polling")),
+		),
+		hsm.State("polling",
+			hsm.Transition(hsm.Every(func(ctx context.Context, sm *THSM, event hsm.Event) time.Duration {
+				return time.Second
+			}), hsm.Target(".")),
+			hsm.Transition(hsm.Target("../done")),
+		),
+		hsm.State("timeout"),
+		hsm.State("done"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	entered := hsm.AfterEntry(context.Background(), sm, "/done")
+	select {
+	case <-entered:
+	case <-time.After(250 * time.Millisecond):
+		t.Fatalf("expected the states to complete without waiting for their timers, got %s", sm.State())
+	}
+}
+
+func TestCompletionTransitionReentry(t *testing.T) {
+	var runs atomic.Int32
+	release := make(chan struct{})
+	model := hsm.Define(
+		"TestCompletionTransitionReentryHSM",
+		hsm.Initial(hsm.Target("working")),
+		hsm.State("working",
+			hsm.Activity(func(ctx context.Context, sm *THSM, event hsm.Event) {
+				if runs.Add(1) == 1 {
+					// the first run ignores its cancellation and returns after the state was re-entered
+					<-release
+					return
+				}
+				<-ctx.Done()
+			}),
+			hsm.Transition(hsm.On("again"), hsm.Target(".")),
+			hsm.Transition(hsm.Target("../done")),
+		),
+		hsm.State("done"),
+	)
+	sm := hsm.Start(context.Background(), &THSM{}, &model)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "again"})
+	for deadline := time.Now().Add(time.Second); runs.Load() < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+	<-sm.Dispatch(context.Background(), hsm.Event{Name: "noop"})
+	if sm.State() != "/working" {
+		t.Fatalf("expected the run of the previous entry not to complete the state, got %s", sm.State())
+	}
+}
@@ -127,6 +127,42 @@ var (
 	Custom          = Kind(id.Next(), Element)
 )
 
+var names = sync.OnceValue(func() map[uint64]string {
+	return map[uint64]string{
+		Null:            "Null",
+		Element:         "Element",
+		Namespace:       "Namespace",
+		Vertex:          "Vertex",
+		Constraint:      "Constraint",
+		Behavior:        "Behavior",
+		Concurrent:      "Concurrent",
+		StateMachine:    "StateMachine",
+		State:           "State",
+		Transition:      "Transition",
+		Internal:        "Internal",
+		External:        "External",
+		Local:           "Local",
+		Self:            "Self",
+		Event:           "Event",
+		CompletionEvent: "CompletionEvent",
+		ErrorEvent:      "ErrorEvent",
+		TimeEvent:       "TimeEvent",
+		Pseudostate:     "Pseudostate",
+		Initial:         "Initial",
+		FinalState:      "FinalState",
+		Choice:          "Choice",
+		Custom:          "Custom",
+	}
+})
+
+// Name returns the name of a kind defined in this package, e.g. "State", or "Unknown" for any other value.
+func Name(kind uint64) string {
+	if name, ok := names()[kind]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
 var Kinds = sync.OnceValue(func() (kinds kinds) {
 	kinds.Null = Null
 	kinds.Element = Element
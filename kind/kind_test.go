@@ -31,3 +31,15 @@ func TestKinds(t *testing.T) {
 	}
 
 }
+
+func TestName(t *testing.T) {
+	if Name(State) != "State" {
+		t.Errorf("expected State, got %s", Name(State))
+	}
+	if Name(ErrorEvent) != "ErrorEvent" {
+		t.Errorf("expected ErrorEvent, got %s", Name(ErrorEvent))
+	}
+	if Name(Kind(200, State)) != "Unknown" {
+		t.Errorf("expected Unknown, got %s", Name(Kind(200, State)))
+	}
+}
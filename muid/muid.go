@@ -17,6 +17,7 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -94,6 +95,8 @@ var (
 	shards        = defaultShards()
 )
 
+// Config is the layout of the IDs minted by a Generator. It encodes to and decodes from JSON
+// unchanged, e.g. for services to check that they agree on a layout before exchanging IDs.
 type Config struct {
 	MachineID       uint64
 	TimestampBitLen int
@@ -104,12 +107,78 @@ type Config struct {
 // MUID represents a Monotonically Unique ID.
 type MUID uint64
 
-// String returns the base32 encoded string representation of the MUID,
-// zero-padded to 13 characters.
+// String returns the base32 encoded string representation of the MUID.
+// It is kept for compatibility; use Format for fixed-width, sortable encodings.
 func (m MUID) String() string {
 	return strconv.FormatUint(uint64(m), 32)
 }
 
+// base62 digits in ASCII order so fixed-width encodings sort lexicographically.
+const base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// width returns the number of digits needed to encode any 64-bit value in base.
+func width(base int) int {
+	digits := 0
+	for max := uint64(math.MaxUint64); max > 0; max /= uint64(base) {
+		digits++
+	}
+	return digits
+}
+
+// Format returns the MUID encoded in the given base (2 to 36, or 62), zero-padded to a fixed
+// width so that, like the MUIDs themselves, the encoded strings sort in time order.
+// Base 62 uses the digits 0-9, A-Z and a-z. Format panics on an unsupported base.
+func (m MUID) Format(base int) string {
+	if base == 62 {
+		buffer := make([]byte, width(base))
+		value := uint64(m)
+		for i := len(buffer) - 1; i >= 0; i-- {
+			buffer[i] = base62[value%62]
+			value /= 62
+		}
+		return string(buffer)
+	}
+	if base < 2 || base > 36 {
+		panic("muid: unsupported base " + strconv.Itoa(base))
+	}
+	digits := strconv.FormatUint(uint64(m), base)
+	return strings.Repeat("0", width(base)-len(digits)) + digits
+}
+
+// Hex returns the MUID as 16 zero-padded hexadecimal digits.
+func (m MUID) Hex() string {
+	return m.Format(16)
+}
+
+// Parse decodes a MUID encoded in the given base (2 to 36, or 62), as produced by Format or,
+// for base 32, by String.
+func Parse(s string, base int) (MUID, error) {
+	if base != 62 {
+		value, err := strconv.ParseUint(s, base, 64)
+		return MUID(value), err
+	}
+	if s == "" {
+		return 0, &strconv.NumError{Func: "Parse", Num: s, Err: strconv.ErrSyntax}
+	}
+	var value uint64
+	for i := 0; i < len(s); i++ {
+		digit := strings.IndexByte(base62, s[i])
+		if digit < 0 {
+			return 0, &strconv.NumError{Func: "Parse", Num: s, Err: strconv.ErrSyntax}
+		}
+		if value > (math.MaxUint64-uint64(digit))/62 {
+			return 0, &strconv.NumError{Func: "Parse", Num: s, Err: strconv.ErrRange}
+		}
+		value = value*62 + uint64(digit)
+	}
+	return MUID(value), nil
+}
+
+// ParseHex decodes a MUID encoded with Hex.
+func ParseHex(s string) (MUID, error) {
+	return Parse(s, 16)
+}
+
 // Generator is responsible for generating MUIDs.
 // It maintains the last used timestamp and counter atomically.
 type Generator struct {
@@ -127,6 +196,8 @@ type Generator struct {
 	shardBitLen     int
 	machineIDShift  int
 	shardIndexShift int
+	// overflows counts the IDs minted by advancing the timestamp past an exhausted counter.
+	overflows atomic.Uint64
 }
 
 // NewGenerator creates a new MUID generator based on the provided configuration.
@@ -194,9 +265,11 @@ func (g *Generator) ID() MUID {
 			now = lastTimestamp // Use the last known timestamp if clock went backwards
 		}
 
+		overflowed := false
 		if now == lastTimestamp {
 			// Same millisecond as the last ID generation.
 			if counter >= g.counterBitMask {
+				overflowed = true
 				// Counter overflowed, increment the timestamp virtually.
 				now++
 				counter = 1 // Reset counter for the new virtual millisecond
@@ -213,6 +286,9 @@ func (g *Generator) ID() MUID {
 		newState := (now << g.counterBitLen) | counter
 		// Atomically update the state using Compare-and-Swap.
 		if g.state.CompareAndSwap(previousState, newState) {
+			if overflowed {
+				g.overflows.Add(1)
+			}
 			// Construct the final MUID.
 			// Structure: [Timestamp][MachineID][ShardIndex][Counter]
 			muid := (now << g.timestampBitShift) |
@@ -225,6 +301,41 @@ func (g *Generator) ID() MUID {
 	}
 }
 
+// OverflowCount returns how many times the counter was exhausted within a millisecond, so that the
+// timestamp had to be advanced virtually ahead of the wall clock. A steadily growing count means IDs
+// are minted faster than the layout supports; give the counter more bits by lowering
+// Config.TimestampBitLen or Config.MachineIDBitLen.
+func (g *Generator) OverflowCount() uint64 {
+	return g.overflows.Load()
+}
+
+// Config returns the effective configuration of the generator, i.e. with the defaults of
+// NewGenerator applied and the machine ID masked to its bit length. Passing it back to
+// NewGenerator, with the same shard index and bit length, creates a generator with the same layout.
+// Since NewGenerator replaces a zero MachineID with the default, a machine ID that masked to zero
+// is returned as 1<<MachineIDBitLen, which NewGenerator masks back to zero.
+func (g *Generator) Config() Config {
+	machineID := g.machineID
+	if machineID == 0 {
+		machineID = 1 << g.machineIdBitLen
+	}
+	return Config{
+		MachineID:       machineID,
+		TimestampBitLen: g.timestampBitLen,
+		MachineIDBitLen: g.machineIdBitLen,
+		Epoch:           g.epoch,
+	}
+}
+
+// OverflowCount returns the sum of Generator.OverflowCount over the default sharded generators used by Make.
+func OverflowCount() uint64 {
+	var count uint64
+	for _, generator := range shards.pool {
+		count += generator.OverflowCount()
+	}
+	return count
+}
+
 // Make generates a new MUID using the default sharded generators.
 // It distributes load across generators for better parallel performance.
 func Make() MUID {
@@ -232,3 +343,24 @@ func Make() MUID {
 	idx := shards.idx.Add(1) % shards.size
 	return shards.pool[idx].ID()
 }
+
+// Sequence is a deterministic MUID source. Unlike Generator it does not depend
+// on the wall clock, machine or shard, so the same seed always yields the same
+// series of IDs: seed+1, seed+2, ...
+type Sequence struct {
+	state atomic.Uint64
+}
+
+// NewSequence creates a deterministic MUID source starting after seed.
+func NewSequence(seed uint64) *Sequence {
+	sequence := &Sequence{}
+	sequence.state.Store(seed)
+	return sequence
+}
+
+// ID returns the next MUID in the sequence.
+// It is thread-safe, but the order IDs are handed out in across goroutines
+// is only as deterministic as the callers.
+func (s *Sequence) ID() MUID {
+	return MUID(s.state.Add(1))
+}
@@ -1,6 +1,8 @@
 package muid
 
 import (
+	"encoding/json"
+	"math"
 	"testing"
 )
 
@@ -33,3 +35,106 @@ func TestMUIDStringLength(t *testing.T) {
 		}
 	}
 }
+
+func TestSequence(t *testing.T) {
+	a := NewSequence(42)
+	b := NewSequence(42)
+	for i := 0; i < 1000; i++ {
+		if a.ID() != b.ID() {
+			t.Fatalf("sequences with the same seed diverged at %d", i)
+		}
+	}
+	if NewSequence(0).ID() != 1 {
+		t.Fatalf("expected first id of seed 0 to be 1")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	for _, base := range []int{2, 10, 16, 32, 36, 62} {
+		previous := ""
+		for _, muid := range []MUID{0, 1, 61, 62, Make(), Make(), MUID(math.MaxUint64)} {
+			encoded := muid.Format(base)
+			if previous != "" && len(encoded) != len(previous) {
+				t.Fatalf("base %d encoding is not fixed width: %q and %q", base, previous, encoded)
+			}
+			if encoded < previous {
+				t.Fatalf("base %d encoding does not sort: %q before %q", base, previous, encoded)
+			}
+			previous = encoded
+			decoded, err := Parse(encoded, base)
+			if err != nil {
+				t.Fatalf("failed to parse %q in base %d: %v", encoded, base, err)
+			}
+			if decoded != muid {
+				t.Fatalf("base %d round trip of %d returned %d", base, muid, decoded)
+			}
+		}
+	}
+	muid := Make()
+	if decoded, err := ParseHex(muid.Hex()); err != nil || decoded != muid || len(muid.Hex()) != 16 {
+		t.Fatalf("hex round trip of %d failed: %q %d %v", muid, muid.Hex(), decoded, err)
+	}
+	if decoded, err := Parse(muid.String(), 32); err != nil || decoded != muid {
+		t.Fatalf("failed to parse String() output %q: %v", muid.String(), err)
+	}
+	if _, err := Parse("zzzzzzzzzzzz", 62); err == nil {
+		t.Fatal("expected out of range base62 value to fail")
+	}
+}
+
+func TestOverflowCount(t *testing.T) {
+	// 2 counter bits allow 3 IDs per millisecond
+	narrow := NewGenerator(Config{TimestampBitLen: 40, MachineIDBitLen: 22}, 0, 0)
+	for i := 0; i < 100; i++ {
+		narrow.ID()
+	}
+	if narrow.OverflowCount() == 0 {
+		t.Fatalf("expected the narrow counter to overflow")
+	}
+	wide := NewGenerator(Config{TimestampBitLen: 40, MachineIDBitLen: 1}, 0, 0)
+	for i := 0; i < 100; i++ {
+		wide.ID()
+	}
+	if wide.OverflowCount() != 0 {
+		t.Fatalf("expected the wide counter not to overflow, got %d", wide.OverflowCount())
+	}
+}
+
+func TestGeneratorConfig(t *testing.T) {
+	generator := NewGenerator(Config{MachineID: math.MaxUint64}, 3, 2)
+	config := generator.Config()
+	if config.TimestampBitLen != defaultConfig.TimestampBitLen || config.MachineIDBitLen != defaultConfig.MachineIDBitLen || config.Epoch != defaultConfig.Epoch {
+		t.Fatalf("expected the defaults to be applied, got %+v", config)
+	}
+	if config.MachineID != 1<<config.MachineIDBitLen-1 {
+		t.Fatalf("expected the machine ID to be masked, got %d", config.MachineID)
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Config
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != config {
+		t.Fatalf("expected the config to round-trip through JSON, got %+v from %+v", decoded, config)
+	}
+	equivalent := NewGenerator(decoded, 3, 2)
+	if equivalent.Config() != config || equivalent.counterBitLen != generator.counterBitLen || equivalent.timestampBitShift != generator.timestampBitShift {
+		t.Fatalf("expected an equivalent generator, got %+v", equivalent.Config())
+	}
+	// everything but the timestamp and counter matches
+	mask := uint64(1<<generator.timestampBitShift-1) &^ generator.counterBitMask
+	if uint64(generator.ID())&mask != uint64(equivalent.ID())&mask {
+		t.Fatal("expected both generators to mint IDs with the same machine and shard bits")
+	}
+	// a machine ID that masks to zero is not mistaken for a missing one
+	zero := NewGenerator(Config{MachineID: 1 << defaultConfig.MachineIDBitLen}, 3, 2)
+	if zero.machineID != 0 {
+		t.Fatalf("expected the machine ID to mask to zero, got %d", zero.machineID)
+	}
+	if equivalent := NewGenerator(zero.Config(), 3, 2); equivalent.machineID != 0 || equivalent.Config() != zero.Config() {
+		t.Fatalf("expected an equivalent generator, got machine ID %d", equivalent.machineID)
+	}
+}
@@ -17,11 +17,14 @@ func idFromQualifiedName(qualifiedName string) string {
 	return strings.ReplaceAll(strings.ReplaceAll(strings.ReplaceAll(strings.TrimPrefix(strings.TrimPrefix(qualifiedName, "/"), "."), "-", "_"), "/.", "/"), "/", ".")
 }
 
-func generateState(builder *strings.Builder, depth int, state elements.NamedElement, model elements.Model, allElements []elements.NamedElement, visited map[string]any) {
+func generateState(builder *strings.Builder, depth int, state elements.NamedElement, model elements.Model, allElements []elements.NamedElement, visited map[string]any, active map[string]bool) {
 	if state.QualifiedName() == "/" {
 		return
 	}
 	id := idFromQualifiedName(state.QualifiedName())
+	if active[state.QualifiedName()] {
+		id = fmt.Sprintf("%s %s", id, highlight)
+	}
 	indent := strings.Repeat(" ", depth*2)
 	composite := false
 	visited[state.QualifiedName()] = struct{}{}
@@ -35,7 +38,7 @@ func generateState(builder *strings.Builder, depth int, state elements.NamedElem
 					composite = true
 					fmt.Fprintf(builder, "%sstate %s{\n", indent, id)
 				}
-				generateVertex(builder, depth+1, element, model, allElements, visited)
+				generateVertex(builder, depth+1, element, model, allElements, visited, active)
 			}
 		}
 	}
@@ -58,6 +61,7 @@ func generateState(builder *strings.Builder, depth int, state elements.NamedElem
 		}
 		fmt.Fprintf(builder, "%sstate %s%s\n", indent, id, tag)
 	}
+	id = idFromQualifiedName(state.QualifiedName())
 	if kind.IsKind(state.Kind(), kind.State) {
 		state := state.(elements.State)
 		for _, entry := range state.Entry() {
@@ -76,9 +80,9 @@ func generateState(builder *strings.Builder, depth int, state elements.NamedElem
 	}
 }
 
-func generateVertex(builder *strings.Builder, depth int, vertex elements.NamedElement, model elements.Model, allElements []elements.NamedElement, visited map[string]any) {
+func generateVertex(builder *strings.Builder, depth int, vertex elements.NamedElement, model elements.Model, allElements []elements.NamedElement, visited map[string]any, active map[string]bool) {
 	if kind.IsKind(vertex.Kind(), kind.State) {
-		generateState(builder, depth, vertex, model, allElements, visited)
+		generateState(builder, depth, vertex, model, allElements, visited, active)
 	}
 }
 
@@ -107,7 +111,7 @@ func generateTransition(builder *strings.Builder, depth int, transition elements
 		label = fmt.Sprintf(" : %s", label)
 	}
 	indent := strings.Repeat(" ", depth*2)
-	if transition.Kind() == kind.Internal {
+	if transition.TransitionKind() == kind.Internal {
 		fmt.Fprintf(builder, "%sstate %s%s\n", indent, idFromQualifiedName(source), label)
 	} else {
 		target := transition.Target()
@@ -116,14 +120,14 @@ func generateTransition(builder *strings.Builder, depth int, transition elements
 
 }
 
-func generateElements(builder *strings.Builder, depth int, model elements.Model, allElements []elements.NamedElement, visited map[string]any) {
+func generateElements(builder *strings.Builder, depth int, model elements.Model, allElements []elements.NamedElement, visited map[string]any, active map[string]bool) {
 	fmt.Fprintf(builder, "@startuml %s\n", path.Base(model.Id()))
 	for _, element := range allElements {
 		if _, ok := visited[element.QualifiedName()]; ok {
 			continue
 		}
 		if kind.IsKind(element.Kind(), kind.State, kind.Choice) {
-			generateState(builder, depth+1, element, model, allElements, visited)
+			generateState(builder, depth+1, element, model, allElements, visited, active)
 		}
 	}
 	if initial, ok := model.Members()[path.Join(model.QualifiedName(), ".initial")]; ok {
@@ -142,7 +146,12 @@ func generateElements(builder *strings.Builder, depth int, model elements.Model,
 	fmt.Fprintln(builder, "@enduml")
 }
 
-func Generate(writer io.Writer, model elements.Model) error {
+// highlight is the PlantUML color applied to active states.
+const highlight = "#palegreen"
+
+// Generate writes a PlantUML state diagram of the model. States whose qualified names are passed
+// as active, e.g. an instance's active configuration, are highlighted.
+func Generate(writer io.Writer, model elements.Model, active ...string) error {
 	var builder strings.Builder
 	elements := []elements.NamedElement{}
 	for _, element := range model.Members() {
@@ -169,7 +178,11 @@ func Generate(writer io.Writer, model elements.Model) error {
 		return len(iPath) < len(jPath)
 	})
 
-	generateElements(&builder, 0, model, elements, map[string]any{})
+	highlighted := map[string]bool{}
+	for _, qualifiedName := range active {
+		highlighted[qualifiedName] = true
+	}
+	generateElements(&builder, 0, model, elements, map[string]any{}, highlighted)
 	_, err := writer.Write([]byte(builder.String()))
 	return err
 }
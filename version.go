@@ -1,4 +1,4 @@
 package hsm
 
 // Version is the current version of the hsm package.
-const Version = "v2.1.2"
+const Version = "v2.89.0"